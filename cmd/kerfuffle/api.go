@@ -8,10 +8,15 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"kerfuffle/pkg/auth"
 	"kerfuffle/pkg/kerfuffle"
+	"kerfuffle/pkg/metrics"
+	"kerfuffle/pkg/proxy_handler"
 	"net/http"
 	"time"
 )
@@ -20,27 +25,40 @@ var (
 	ErrApplicationNotExist = errors.New("application does not exist")
 )
 
+// maxWebhookSize bounds the payloads accepted by the webhook endpoint, push events
+// are well under it.
+const maxWebhookSize = 5 << 20
+
 type RestApi struct {
 	manager *kerfuffle.Manager
+	auth    *auth.Store
 }
 
-func NewRestApi(manager *kerfuffle.Manager) *RestApi {
-	return &RestApi{manager: manager}
+func NewRestApi(manager *kerfuffle.Manager, store *auth.Store) *RestApi {
+	return &RestApi{manager: manager, auth: store}
 }
 
 func (r *RestApi) GenerateEndpoints() *gin.Engine {
 	mux := gin.Default()
 	mux.Use(cors.Default())
 	mux.Use(ErrMiddleware())
+	mux.GET("/login", func(context *gin.Context) {
+		context.Data(200, "text/html; charset=utf-8", loginPage)
+	})
+	// scrapers authenticate with a read token like everyone else
+	mux.GET("/metrics", r.requireScope(auth.ScopeRead), gin.WrapH(metrics.Default.Handler()))
 	api := mux.Group("/api")
 	r.v1ApiGenerate(api.Group("/v1"))
 	return mux
 }
 
 func (r *RestApi) v1ApiGenerate(v1 *gin.RouterGroup) {
-	application := v1.Group("/application")
+	r.authApiGenerate(v1.Group("/auth"))
+
+	deploy := r.requireScope(auth.ScopeDeploy)
+	application := v1.Group("/application", r.requireScope(auth.ScopeRead))
 	{
-		application.POST("", func(context *gin.Context) {
+		application.POST("", deploy, func(context *gin.Context) {
 			config := &kerfuffle.InstallConfiguration{}
 			err := context.ShouldBind(config)
 			if err != nil {
@@ -60,7 +78,7 @@ func (r *RestApi) v1ApiGenerate(v1 *gin.RouterGroup) {
 			context.JSON(200, r.manager.GetAllApplications())
 		})
 
-		application.DELETE("/:id", func(context *gin.Context) {
+		application.DELETE("/:id", deploy, func(context *gin.Context) {
 			id := context.Param("id")
 			app := r.manager.GetApplication(id)
 			if app == nil {
@@ -87,14 +105,23 @@ func (r *RestApi) v1ApiGenerate(v1 *gin.RouterGroup) {
 			})
 		})
 
-		application.PATCH("/:id/hold", func(context *gin.Context) {
+		application.PATCH("/:id/hold", deploy, func(context *gin.Context) {
 			id := context.Param("id")
 			app := r.manager.GetApplication(id)
 			if app == nil {
 				handleErr(context, http.StatusNotFound, id, ErrApplicationNotExist)
 				return
 			}
-			err := r.manager.SetAppMaintenanceMode(app.ID, !app.MaintenanceMode)
+			var maintenance *proxy_handler.Maintenance
+			if !app.InMaintenanceMode() {
+				var err error
+				maintenance, err = maintenanceQuery(context)
+				if err != nil {
+					handleErr(context, http.StatusBadRequest, id, err)
+					return
+				}
+			}
+			err := r.manager.SetAppMaintenance(app.ID, maintenance)
 			context.JSON(200, gin.H{"error": err})
 		})
 
@@ -105,46 +132,102 @@ func (r *RestApi) v1ApiGenerate(v1 *gin.RouterGroup) {
 				handleErr(context, http.StatusNotFound, id, ErrApplicationNotExist)
 				return
 			}
-			context.JSON(200, app.GetAllProcessIds())
+			context.JSON(200, app.GetProcessResources())
 		})
 
-		application.GET("/:id/provisions", func(context *gin.Context) {
+		application.GET("/:id/health", func(context *gin.Context) {
 			id := context.Param("id")
 			app := r.manager.GetApplication(id)
 			if app == nil {
 				handleErr(context, http.StatusNotFound, id, ErrApplicationNotExist)
 				return
 			}
-			context.JSON(200, app.GetAllProvisions())
+			context.JSON(200, app.GetHealthReports())
 		})
 
-		application.GET("/:id/provision/:provisionId/output/:t", func(context *gin.Context) {
+		application.GET("/:id/upstream_failures", func(context *gin.Context) {
 			id := context.Param("id")
-			provision := context.Param("provisionId")
-			t := context.Param("t")
 			app := r.manager.GetApplication(id)
 			if app == nil {
 				handleErr(context, http.StatusNotFound, id, ErrApplicationNotExist)
 				return
 			}
-			process := app.GetProcess(provision)
-			log.Debug().Interface("process", process).Msg("")
+			context.JSON(200, app.GetUpstreamFailures())
+		})
+
+		application.GET("/:id/provisions", func(context *gin.Context) {
+			id := context.Param("id")
+			app := r.manager.GetApplication(id)
+			if app == nil {
+				handleErr(context, http.StatusNotFound, id, ErrApplicationNotExist)
+				return
+			}
+			context.JSON(200, app.GetAllProvisions())
+		})
+
+		application.GET("/:id/provision/:provisionId/output/:t", func(context *gin.Context) {
+			provision := context.Param("provisionId")
+			t := context.Param("t")
+			process := r.lookupProcess(context)
 			if process == nil {
-				handleErr(context, http.StatusNotFound, provision, errors.New("process does not exist"))
 				return
 			}
 			switch t {
 			case "log":
-				context.String(200, process.Log().String())
+				context.String(200, process.Output().String(kerfuffle.StreamStdout))
 			case "err":
-				context.String(200, process.Err().String())
+				context.String(200, process.Output().String(kerfuffle.StreamStderr))
 			default:
 				log.Error().Str("buffer", t).Msg("buffer does not exist")
 				handleErr(context, http.StatusNotFound, provision, errors.New("buffer does not exist"))
 			}
 		})
 
-		application.GET("/:id/provision/:provisionId/reload", func(context *gin.Context) {
+		application.GET("/:id/provision/:provisionId/logs", r.logs)
+		application.GET("/:id/provision/:provisionId/logs/ws", r.logsWebSocket)
+
+		application.GET("/:id/logs", func(context *gin.Context) {
+			id := context.Param("id")
+			segments, err := r.manager.GetLogSegments(id)
+			if err == kerfuffle.ErrNotFound {
+				handleErr(context, http.StatusNotFound, id, ErrApplicationNotExist)
+				return
+			}
+			if err != nil {
+				handleErr(context, http.StatusInternalServerError, id, err)
+				return
+			}
+			context.JSON(200, segments)
+		})
+
+		application.GET("/:id/logs/:file", func(context *gin.Context) {
+			id := context.Param("id")
+			file := context.Param("file")
+			path, err := r.manager.LogSegmentPath(id, file)
+			if err != nil {
+				handleErr(context, http.StatusNotFound, file, err)
+				return
+			}
+			context.FileAttachment(path, file)
+		})
+
+		application.GET("/:id/provision/:provisionId/restarts", func(context *gin.Context) {
+			id := context.Param("id")
+			provision := context.Param("provisionId")
+			app := r.manager.GetApplication(id)
+			if app == nil {
+				handleErr(context, http.StatusNotFound, id, ErrApplicationNotExist)
+				return
+			}
+			process := app.GetProcess(provision)
+			if process == nil {
+				handleErr(context, http.StatusNotFound, provision, errors.New("process does not exist"))
+				return
+			}
+			context.JSON(200, process.GetRestarts())
+		})
+
+		application.GET("/:id/provision/:provisionId/reload", deploy, func(context *gin.Context) {
 			id := context.Param("id")
 			target := context.Param("provisionId")
 			app := r.manager.GetApplication(id)
@@ -152,52 +235,210 @@ func (r *RestApi) v1ApiGenerate(v1 *gin.RouterGroup) {
 				handleErr(context, http.StatusNotFound, id, ErrApplicationNotExist)
 				return
 			}
-			err := app.ReloadProvision(target)
+			if app.GetProvision(target) == nil {
+				handleErr(context, http.StatusNotFound, target, errors.New("provision does not exist"))
+				return
+			}
+			if app.IsDeploying() {
+				handleErr(context, http.StatusConflict, id, kerfuffle.ErrDeployInProgress)
+				return
+			}
+			// the new revision is booted next to the running one, which can take a while
+			go func() {
+				err := r.manager.ReloadProvision(id, target)
+				if err != nil {
+					log.Err(err).Str("app", id).Str("target", target).Msg("failed to reload provision")
+				}
+			}()
+			context.String(http.StatusAccepted, "ok")
+		})
+		application.GET("/:id/reload", deploy, func(context *gin.Context) {
+			id := context.Param("id")
+			app := r.manager.GetApplication(id)
+			if app == nil {
+				handleErr(context, http.StatusNotFound, id, ErrApplicationNotExist)
+				return
+			}
+			if app.IsDeploying() {
+				handleErr(context, http.StatusConflict, id, kerfuffle.ErrDeployInProgress)
+				return
+			}
+			// the progress of the redeploy is reported through the application's status log
+			go func() {
+				_ = r.manager.Redeploy(id)
+			}()
+			context.String(http.StatusAccepted, "ok")
+		})
+		application.GET("/:id/releases", func(context *gin.Context) {
+			id := context.Param("id")
+			if r.manager.GetApplication(id) == nil {
+				handleErr(context, http.StatusNotFound, id, ErrApplicationNotExist)
+				return
+			}
+			releases, err := r.manager.GetReleases(id)
 			if err != nil {
 				handleErr(context, http.StatusInternalServerError, id, err)
 				return
 			}
-			context.String(200, "ok")
+			context.JSON(200, releases)
 		})
-		application.GET("/:id/reload", func(context *gin.Context) {
+		application.POST("/:id/rollback/:commit", deploy, func(context *gin.Context) {
 			id := context.Param("id")
+			commit := context.Param("commit")
 			app := r.manager.GetApplication(id)
 			if app == nil {
 				handleErr(context, http.StatusNotFound, id, ErrApplicationNotExist)
 				return
 			}
-			// todo: make reload
-			context.String(200, "ok")
+			if app.IsDeploying() {
+				handleErr(context, http.StatusConflict, id, kerfuffle.ErrDeployInProgress)
+				return
+			}
+			_, err := r.manager.FindRelease(id, commit)
+			if err == kerfuffle.ErrUnknownRelease {
+				handleErr(context, http.StatusNotFound, commit, err)
+				return
+			}
+			if err != nil {
+				handleErr(context, http.StatusInternalServerError, id, err)
+				return
+			}
+			go func() {
+				_ = r.manager.Rollback(id, commit)
+			}()
+			context.String(http.StatusAccepted, "ok")
+		})
+		application.GET("/:id/webhook", deploy, func(context *gin.Context) {
+			id := context.Param("id")
+			if r.manager.GetApplication(id) == nil {
+				handleErr(context, http.StatusNotFound, id, ErrApplicationNotExist)
+				return
+			}
+			secret, err := r.manager.WebhookSecret(id)
+			if err != nil {
+				handleErr(context, http.StatusInternalServerError, id, err)
+				return
+			}
+			context.JSON(200, gin.H{"url": "/api/v1/webhook", "secret": secret})
+		})
+		application.POST("/:id/webhook/secret", deploy, func(context *gin.Context) {
+			id := context.Param("id")
+			if r.manager.GetApplication(id) == nil {
+				handleErr(context, http.StatusNotFound, id, ErrApplicationNotExist)
+				return
+			}
+			secret, err := r.manager.RegenerateWebhookSecret(id)
+			if err != nil {
+				handleErr(context, http.StatusInternalServerError, id, err)
+				return
+			}
+			context.JSON(200, gin.H{"url": "/api/v1/webhook", "secret": secret})
+		})
+		application.GET("/:id/proxy/:proxyId/access", deploy, func(context *gin.Context) {
+			id := context.Param("id")
+			proxy := context.Param("proxyId")
+			access, overridden, err := r.manager.GetProxyAccess(id, proxy)
+			if err != nil {
+				handleAccessErr(context, id, proxy, err)
+				return
+			}
+			context.JSON(200, gin.H{"access": access, "overridden": overridden})
+		})
+		application.PUT("/:id/proxy/:proxyId/access", deploy, func(context *gin.Context) {
+			id := context.Param("id")
+			proxy := context.Param("proxyId")
+			access := &kerfuffle.ProxyAccess{}
+			err := context.ShouldBindJSON(access)
+			if err != nil {
+				handleErr(context, http.StatusBadRequest, proxy, err)
+				return
+			}
+			err = r.manager.SetProxyAccess(id, proxy, access)
+			if err != nil {
+				handleAccessErr(context, id, proxy, err)
+				return
+			}
+			context.JSON(200, gin.H{"access": access, "overridden": true})
+		})
+		application.DELETE("/:id/proxy/:proxyId/access", deploy, func(context *gin.Context) {
+			id := context.Param("id")
+			proxy := context.Param("proxyId")
+			err := r.manager.SetProxyAccess(id, proxy, nil)
+			if err != nil {
+				handleAccessErr(context, id, proxy, err)
+				return
+			}
+			access, _, _ := r.manager.GetProxyAccess(id, proxy)
+			context.JSON(200, gin.H{"access": access, "overridden": false})
 		})
-
 	}
 
-	debug := v1.Group("/debug")
+	v1.POST("/webhook", func(context *gin.Context) {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(context.Writer, context.Request.Body, maxWebhookSize))
+		if err != nil {
+			handleErr(context, http.StatusRequestEntityTooLarge, "", err)
+			return
+		}
+		apps, err := r.manager.HandlePushEvent(context.Request.Header, body)
+		switch err {
+		case nil:
+		case kerfuffle.ErrNotPushEvent:
+			// pings and tag pushes are acknowledged but ignored
+			context.String(200, "ignored")
+			return
+		case kerfuffle.ErrInvalidSignature:
+			handleErr(context, http.StatusUnauthorized, "", err)
+			return
+		case kerfuffle.ErrNoMatchingApplication:
+			handleErr(context, http.StatusNotFound, "", err)
+			return
+		default:
+			handleErr(context, http.StatusBadRequest, "", err)
+			return
+		}
+
+		var ids []string
+		for _, app := range apps {
+			ids = append(ids, app.ID)
+		}
+		context.JSON(http.StatusAccepted, gin.H{"redeploying": ids})
+	})
+
+	debug := v1.Group("/debug", r.requireScope(auth.ScopeAdmin))
 
-	debug.GET("/shutdown", yellowTape, func(context *gin.Context) {
+	debug.GET("/shutdown", func(context *gin.Context) {
 		r.manager.Shutdown()
 		context.String(200, "kerfuffle is shutting down in 1 second")
 	})
 
-	debug.GET("/force_error", yellowTape, func(context *gin.Context) {
+	debug.GET("/force_error", func(context *gin.Context) {
 		handleErr(context, http.StatusBadRequest, "hello world", errors.New("big boy error"))
 	})
 }
 
-// Todo: for testing purposes only, delete in the future
-func yellowTape(c *gin.Context) {
-	// Get the Basic Authentication credentials
-	if x, _ := c.Cookie("debug_auth"); x == "yes" {
-		return
+func handleAccessErr(context *gin.Context, id, proxy string, err error) {
+	switch err {
+	case kerfuffle.ErrNotFound:
+		handleErr(context, http.StatusNotFound, id, ErrApplicationNotExist)
+	case kerfuffle.ErrUnknownProxy:
+		handleErr(context, http.StatusNotFound, proxy, err)
+	default:
+		handleErr(context, http.StatusBadRequest, proxy, err)
 	}
-	user, password, hasAuth := c.Request.BasicAuth()
-	if hasAuth && user == "testuser" && password == "testpass" {
-		log.Debug().Str("user", user).Msg("User authenticated")
-		c.SetCookie("debug_auth", "yes", int(time.Hour.Seconds()), "", "", false, false)
-	} else {
-		c.Status(401)
-		c.Writer.Header().Set("WWW-Authenticate", "Basic realm=Restricted")
-		c.Abort()
-		return
+}
+
+// maintenanceQuery reads the reason and eta parameters of a hold. The ETA is either
+// a duration from now, e.g. "30m", or an RFC 3339 timestamp.
+func maintenanceQuery(context *gin.Context) (*proxy_handler.Maintenance, error) {
+	maintenance := &proxy_handler.Maintenance{Reason: context.Query("reason")}
+	if eta := context.Query("eta"); eta != "" {
+		if d, err := time.ParseDuration(eta); err == nil && d > 0 {
+			maintenance.Until = time.Now().Add(d)
+		} else if t, err := time.Parse(time.RFC3339, eta); err == nil {
+			maintenance.Until = t
+		} else {
+			return nil, fmt.Errorf("invalid eta '%v'", eta)
+		}
 	}
+	return maintenance, nil
 }
@@ -0,0 +1,275 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"kerfuffle/pkg/auth"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookie = "kerfuffle_session"
+	principalKey  = "principal"
+)
+
+var (
+	ErrUnauthorized   = errors.New("authentication required")
+	ErrForbidden      = errors.New("insufficient scope")
+	ErrPasswordNeeded = errors.New("passwords can only be changed after logging in with one")
+)
+
+//go:embed assets/login.html
+var loginPage []byte
+
+// authenticate resolves the principal of the request from a bearer token, basic
+// auth credentials or a console session, in that order.
+func (r *RestApi) authenticate(c *gin.Context) *auth.Principal {
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		principal, err := r.auth.VerifyToken(strings.TrimPrefix(header, "Bearer "))
+		if err != nil {
+			return nil
+		}
+		return principal
+	}
+	if username, password, ok := c.Request.BasicAuth(); ok {
+		principal, err := r.auth.Authenticate(username, password)
+		if err != nil {
+			return nil
+		}
+		return principal
+	}
+	if session, err := c.Cookie(sessionCookie); err == nil {
+		principal, err := r.auth.VerifySession(session)
+		if err != nil {
+			return nil
+		}
+		return principal
+	}
+	return nil
+}
+
+// requireScope aborts requests which aren't authenticated with at least the given scope.
+// Requests already authenticated by the middleware of a group aren't authenticated again.
+func (r *RestApi) requireScope(scope auth.Scope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var principal *auth.Principal
+		if authenticated, exists := c.Get(principalKey); exists {
+			principal = authenticated.(*auth.Principal)
+		} else {
+			principal = r.authenticate(c)
+		}
+		if principal == nil {
+			c.Header("WWW-Authenticate", `Basic realm="kerfuffle"`)
+			handleErr(c, http.StatusUnauthorized, "", ErrUnauthorized)
+			c.Abort()
+			return
+		}
+		if !auth.Allows(principal.Scope, scope) {
+			handleErr(c, http.StatusForbidden, scope, ErrForbidden)
+			c.Abort()
+			return
+		}
+		c.Set(principalKey, principal)
+	}
+}
+
+// requireSession sends visitors of the console without a session to the login page.
+func (r *RestApi) requireSession(c *gin.Context) {
+	if r.authenticate(c) == nil {
+		c.Redirect(http.StatusFound, "/login")
+		c.Abort()
+	}
+}
+
+func principalOf(c *gin.Context) *auth.Principal {
+	return c.MustGet(principalKey).(*auth.Principal)
+}
+
+func setSessionCookie(c *gin.Context, value string, expires time.Time) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+type loginRequest struct {
+	Username string `json:"username" form:"username" binding:"required"`
+	Password string `json:"password" form:"password" binding:"required"`
+	// Redirect is used by the login page to get back to the console.
+	Redirect string `json:"redirect" form:"redirect"`
+}
+
+type tokenRequest struct {
+	Name  string `json:"name" binding:"required"`
+	Scope string `json:"scope" binding:"required"`
+}
+
+type userRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+	Scope    string `json:"scope" binding:"required"`
+}
+
+func (r *RestApi) authApiGenerate(group *gin.RouterGroup) {
+	group.POST("/login", func(context *gin.Context) {
+		login := &loginRequest{}
+		err := context.ShouldBind(login)
+		if err != nil {
+			handleErr(context, http.StatusBadRequest, "", err)
+			return
+		}
+		principal, err := r.auth.Authenticate(login.Username, login.Password)
+		if err != nil {
+			if login.Redirect != "" {
+				context.Redirect(http.StatusFound, "/login?failed=1")
+				return
+			}
+			handleErr(context, http.StatusUnauthorized, "", err)
+			return
+		}
+		session, expires, err := r.auth.CreateSession(principal.Username)
+		if err != nil {
+			handleErr(context, http.StatusInternalServerError, "", err)
+			return
+		}
+		setSessionCookie(context, session, expires)
+		// only local redirects, the login page must not become an open redirect
+		if strings.HasPrefix(login.Redirect, "/") && !strings.HasPrefix(login.Redirect, "//") {
+			context.Redirect(http.StatusFound, login.Redirect)
+			return
+		}
+		context.JSON(200, principal)
+	})
+
+	group.POST("/logout", func(context *gin.Context) {
+		if session, err := context.Cookie(sessionCookie); err == nil {
+			r.auth.DeleteSession(session)
+		}
+		setSessionCookie(context, "", time.Unix(0, 0))
+		context.String(200, "ok")
+	})
+
+	group.GET("/me", r.requireScope(auth.ScopeRead), func(context *gin.Context) {
+		context.JSON(200, principalOf(context))
+	})
+
+	group.PUT("/password", r.requireScope(auth.ScopeRead), func(context *gin.Context) {
+		request := &struct {
+			Password string `json:"password" binding:"required"`
+		}{}
+		err := context.ShouldBind(request)
+		if err != nil {
+			handleErr(context, http.StatusBadRequest, "", err)
+			return
+		}
+		// a leaked token mustn't be enough to take over its owner
+		principal := principalOf(context)
+		if principal.Via == auth.ViaToken {
+			handleErr(context, http.StatusForbidden, "", ErrPasswordNeeded)
+			return
+		}
+		// the other sessions of the user are ended, the one changing the password stays
+		keep := ""
+		if principal.Via == auth.ViaSession {
+			keep, _ = context.Cookie(sessionCookie)
+		}
+		err = r.auth.SetPassword(principal.Username, request.Password, keep)
+		if err != nil {
+			handleErr(context, http.StatusBadRequest, "", err)
+			return
+		}
+		context.String(200, "ok")
+	})
+
+	// every user can manage their own tokens, admins can see and revoke all of them
+	group.GET("/tokens", r.requireScope(auth.ScopeRead), func(context *gin.Context) {
+		principal := principalOf(context)
+		owner := principal.Username
+		if principal.Scope == auth.ScopeAdmin {
+			owner = ""
+		}
+		context.JSON(200, r.auth.GetTokens(owner))
+	})
+
+	group.POST("/tokens", r.requireScope(auth.ScopeRead), func(context *gin.Context) {
+		request := &tokenRequest{}
+		err := context.ShouldBind(request)
+		if err != nil {
+			handleErr(context, http.StatusBadRequest, "", err)
+			return
+		}
+		principal := principalOf(context)
+		plain, token, err := r.auth.CreateToken(principal.Username, request.Name, request.Scope, principal.Scope)
+		if err != nil {
+			handleErr(context, http.StatusBadRequest, "", err)
+			return
+		}
+		token.Hash = ""
+		context.JSON(200, gin.H{"token": plain, "info": token})
+	})
+
+	group.DELETE("/tokens/:tokenId", r.requireScope(auth.ScopeRead), func(context *gin.Context) {
+		id := context.Param("tokenId")
+		principal := principalOf(context)
+		owned := false
+		for _, token := range r.auth.GetTokens(principal.Username) {
+			owned = owned || token.Id == id
+		}
+		if !owned && principal.Scope != auth.ScopeAdmin {
+			handleErr(context, http.StatusNotFound, id, auth.ErrNotFound)
+			return
+		}
+		err := r.auth.RevokeToken(id)
+		if err != nil {
+			handleErr(context, http.StatusNotFound, id, err)
+			return
+		}
+		context.String(200, "ok")
+	})
+
+	users := group.Group("/users", r.requireScope(auth.ScopeAdmin))
+	users.GET("", func(context *gin.Context) {
+		context.JSON(200, r.auth.GetUsers())
+	})
+	users.POST("", func(context *gin.Context) {
+		request := &userRequest{}
+		err := context.ShouldBind(request)
+		if err != nil {
+			handleErr(context, http.StatusBadRequest, "", err)
+			return
+		}
+		err = r.auth.CreateUser(request.Username, request.Password, request.Scope)
+		if err != nil {
+			handleErr(context, http.StatusBadRequest, request.Username, err)
+			return
+		}
+		context.String(200, "ok")
+	})
+	users.DELETE("/:username", func(context *gin.Context) {
+		username := context.Param("username")
+		err := r.auth.DeleteUser(username)
+		if err == auth.ErrNotFound {
+			handleErr(context, http.StatusNotFound, username, err)
+			return
+		}
+		if err != nil {
+			handleErr(context, http.StatusBadRequest, username, err)
+			return
+		}
+		context.String(200, "ok")
+	})
+}
@@ -12,10 +12,14 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/acme/autocert"
+	"io"
 	"io/ioutil"
 	kerfuffleRoot "kerfuffle"
+	"kerfuffle/pkg/auth"
 	"kerfuffle/pkg/kerfuffle"
 	_ "kerfuffle/pkg/logging"
+	"kerfuffle/pkg/metrics"
 	"kerfuffle/pkg/proxy_handler"
 	"net/http"
 	"os"
@@ -29,7 +33,21 @@ const (
 	CfgApiBind          = "api_bind"
 	CfgReverseProxyBind = "reverse_proxy_bind"
 	CfgZoneDir          = "cf_zones_path"
+	CfgTLSBind          = "reverse_proxy_tls_bind"
+	CfgACMEEmail        = "acme_email"
+	CfgACMEDirectory    = "acme_directory"
 	CFZonePath          = ".cf-zones"
+	CfgLogMaxSize       = "log_max_size"
+	CfgLogMaxAge        = "log_max_age"
+	CfgLogRetention     = "log_retention"
+	CfgLogMaxSegments   = "log_max_segments"
+	CfgCgroupRoot       = "cgroup_root"
+	CfgAccessLog        = "access_log"
+	CfgAccessLogFormat  = "access_log_format"
+	CfgAccessLogSample  = "access_log_sample_rate"
+	CfgProxyHeaderTime  = "reverse_proxy_read_header_timeout"
+	CfgProxyIdleTime    = "reverse_proxy_idle_timeout"
+	CfgTrustedProxies   = "trusted_proxies"
 )
 
 func init() {
@@ -37,6 +55,20 @@ func init() {
 	viper.SetDefault(CfgApiBind, "0.0.0.0:8080")
 	viper.SetDefault(CfgReverseProxyBind, "0.0.0.0:80")
 	viper.SetDefault(CfgZoneDir, CFZonePath)
+	viper.SetDefault(CfgTLSBind, "")
+	viper.SetDefault(CfgACMEEmail, "")
+	viper.SetDefault(CfgACMEDirectory, autocert.DefaultACMEDirectory)
+	viper.SetDefault(CfgLogMaxSize, "10MB")
+	viper.SetDefault(CfgLogMaxAge, "24h")
+	viper.SetDefault(CfgLogRetention, "168h")
+	viper.SetDefault(CfgLogMaxSegments, 10)
+	viper.SetDefault(CfgCgroupRoot, "")
+	viper.SetDefault(CfgAccessLog, "-")
+	viper.SetDefault(CfgAccessLogFormat, proxy_handler.AccessLogJSON)
+	viper.SetDefault(CfgAccessLogSample, 1.0)
+	viper.SetDefault(CfgProxyHeaderTime, "10s")
+	viper.SetDefault(CfgProxyIdleTime, "2m")
+	viper.SetDefault(CfgTrustedProxies, []string{})
 
 	viper.SetConfigName("kerfuffle")
 	viper.SetConfigType("toml")
@@ -75,11 +107,51 @@ func main() {
 
 	kMan := kerfuffle.NewManager()
 	kMan.CloudflareZoneDir = viper.GetString(CfgZoneDir)
+	kMan.LogPolicy = &kerfuffle.LogPolicy{
+		MaxSize:     int64(viper.GetSizeInBytes(CfgLogMaxSize)),
+		MaxAge:      viper.GetDuration(CfgLogMaxAge),
+		Retention:   viper.GetDuration(CfgLogRetention),
+		MaxSegments: viper.GetInt(CfgLogMaxSegments),
+	}
+	kMan.CgroupRoot = viper.GetString(CfgCgroupRoot)
+	kMan.RegisterMetrics(metrics.Default)
 	kMan.SetShutdown(kill)
 
 	// reverse proxy bootstrapping, launches reverse proxy server, usually on port 80
 	{
 		revProxyMan := proxy_handler.NewHttpReverseProxyManager()
+		accessLogger, err := newAccessLogger()
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to set up the access log")
+		}
+		revProxyMan.SetAccessLogger(accessLogger)
+		revProxyMan.SetServerTimeouts(proxy_handler.ServerTimeouts{
+			ReadHeader: viper.GetDuration(CfgProxyHeaderTime),
+			Idle:       viper.GetDuration(CfgProxyIdleTime),
+		})
+		err = revProxyMan.SetTrustedProxies(viper.GetStringSlice(CfgTrustedProxies))
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to set the trusted proxies")
+		}
+
+		// TLS termination is only enabled when a TLS bind address is configured
+		if viper.GetString(CfgTLSBind) != "" {
+			err := revProxyMan.EnableACME(&proxy_handler.ACMEConfig{
+				CacheDir:     filepath.Join(kMan.AppDataPath, "certs"),
+				Email:        viper.GetString(CfgACMEEmail),
+				DirectoryURL: viper.GetString(CfgACMEDirectory),
+			})
+			if err != nil {
+				log.Err(err).Msg("failed to enable ACME")
+			} else {
+				go func(r *proxy_handler.HttpReverseProxyManager) {
+					log.Info().Str("api", viper.GetString(CfgTLSBind)).Msg("exposing tls reverse proxy")
+					err := <-r.LaunchTLS(viper.GetString(CfgTLSBind))
+					log.Err(err).Msg("tls proxy manager failed")
+				}(revProxyMan)
+			}
+		}
+
 		go func(r *proxy_handler.HttpReverseProxyManager) {
 			log.Info().Str("api", viper.GetString(CfgReverseProxyBind)).Msg("exposing reverse proxy")
 			err := <-r.Launch(viper.GetString(CfgReverseProxyBind))
@@ -91,12 +163,32 @@ func main() {
 	// loading all of the existing stuff
 	kMan.Load()
 
+	// the management api requires authentication, the first run creates an admin
+	store, err := auth.NewStore(filepath.Join(kMan.AppDataPath, "auth.json"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load users")
+	}
+	password, err := store.Bootstrap()
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to create the bootstrap admin")
+	}
+	if password != "" {
+		// the password is kept out of the logs, only the owner of the data directory can read it
+		passwordPath := filepath.Join(kMan.AppDataPath, "admin_password")
+		err = ioutil.WriteFile(passwordPath, []byte(password+"\n"), 0600)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to write the password of the bootstrap admin")
+		}
+		log.Warn().Str("username", auth.BootstrapUser).Str("path", passwordPath).Msg("created the bootstrap admin, delete the password file after logging in")
+	}
+
 	// api services bootstrapping, starts api endpoint server on port 8080
 	{
 		go func(k *kerfuffle.Manager) {
 			log.Info().Str("api", viper.GetString(CfgApiBind)).Msg("exposing api")
-			api := NewRestApi(k).GenerateEndpoints()
-			api.StaticFS("/console", http.FS(kerfuffleRoot.ClientFS))
+			restApi := NewRestApi(k, store)
+			api := restApi.GenerateEndpoints()
+			api.Group("/console", restApi.requireSession).StaticFS("/", http.FS(kerfuffleRoot.ClientFS))
 			api.GET("/", func(context *gin.Context) {
 				context.Redirect(http.StatusPermanentRedirect, path.Join(context.Request.URL.String(), "console"))
 			})
@@ -118,3 +210,21 @@ func main() {
 	}
 	log.Info().Msg("kerfuffle has been terminated")
 }
+
+// newAccessLogger opens the access log, "-" writes it to stdout and an empty path disables it.
+func newAccessLogger() (*proxy_handler.AccessLogger, error) {
+	var out io.Writer
+	switch path := viper.GetString(CfgAccessLog); path {
+	case "":
+		return nil, nil
+	case "-":
+		out = os.Stdout
+	default:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+	return proxy_handler.NewAccessLogger(out, viper.GetString(CfgAccessLogFormat), viper.GetFloat64(CfgAccessLogSample))
+}
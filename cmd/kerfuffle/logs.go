@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+	"io"
+	"io/ioutil"
+	"kerfuffle/pkg/kerfuffle"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTailLines = 100
+	// logHeartbeat keeps idle log streams from being closed by proxies in between.
+	logHeartbeat = time.Second * 15
+)
+
+var (
+	ErrProcessNotExist = errors.New("process does not exist")
+	ErrInvalidStream   = errors.New("stream must be either stdout or stderr")
+	ErrInvalidOrigin   = errors.New("websocket origin doesn't match the host")
+)
+
+// lookupProcess resolves the process of the request, it responds with a 404 when it doesn't exist.
+func (r *RestApi) lookupProcess(context *gin.Context) *kerfuffle.Process {
+	id := context.Param("id")
+	provision := context.Param("provisionId")
+	app := r.manager.GetApplication(id)
+	if app == nil {
+		handleErr(context, http.StatusNotFound, id, ErrApplicationNotExist)
+		return nil
+	}
+	process := app.GetProcess(provision)
+	if process == nil {
+		handleErr(context, http.StatusNotFound, provision, ErrProcessNotExist)
+		return nil
+	}
+	return process
+}
+
+// logQuery reads the lines, since and stream parameters. Since is either a
+// duration, e.g. "10m", or an RFC 3339 timestamp.
+func logQuery(context *gin.Context) (*kerfuffle.LogQuery, error) {
+	query := &kerfuffle.LogQuery{Lines: defaultTailLines, Stream: context.Query("stream")}
+	switch query.Stream {
+	case "", kerfuffle.StreamStdout, kerfuffle.StreamStderr:
+	default:
+		return nil, ErrInvalidStream
+	}
+
+	if lines := context.Query("lines"); lines != "" {
+		n, err := strconv.Atoi(lines)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid lines '%v'", lines)
+		}
+		query.Lines = n
+	}
+
+	if since := context.Query("since"); since != "" {
+		if d, err := time.ParseDuration(since); err == nil {
+			query.Since = time.Now().Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, since); err == nil {
+			query.Since = t
+		} else {
+			return nil, fmt.Errorf("invalid since '%v'", since)
+		}
+	}
+
+	// reconnecting event streams pick up where they left off
+	if id := context.GetHeader("Last-Event-ID"); id != "" {
+		seq, err := strconv.ParseUint(id, 10, 64)
+		if err == nil {
+			query.After = seq
+			query.Lines = 0
+		}
+	}
+	return query, nil
+}
+
+func wantsFollow(context *gin.Context) bool {
+	follow, _ := strconv.ParseBool(context.Query("follow"))
+	return follow || strings.Contains(context.GetHeader("Accept"), "text/event-stream")
+}
+
+// logs returns the tail of the process' output, or follows it as server-sent events.
+func (r *RestApi) logs(context *gin.Context) {
+	process := r.lookupProcess(context)
+	if process == nil {
+		return
+	}
+	query, err := logQuery(context)
+	if err != nil {
+		handleErr(context, http.StatusBadRequest, "", err)
+		return
+	}
+	if !wantsFollow(context) {
+		context.JSON(200, process.Output().Tail(query))
+		return
+	}
+
+	backlog, lines, cancel := process.Output().Follow(query)
+	defer cancel()
+
+	w := context.Writer
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	send := func(line *kerfuffle.LogLine) error {
+		b, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %v\ndata: %s\n\n", line.Seq, b)
+		return err
+	}
+
+	for _, line := range backlog {
+		if send(line) != nil {
+			return
+		}
+	}
+	w.Flush()
+
+	heartbeat := time.NewTicker(logHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-context.Request.Context().Done():
+			return
+		case line, ok := <-lines:
+			if !ok || send(line) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		w.Flush()
+	}
+}
+
+// logsWebSocket follows the process' output over a websocket, every line is sent as a JSON message.
+func (r *RestApi) logsWebSocket(context *gin.Context) {
+	process := r.lookupProcess(context)
+	if process == nil {
+		return
+	}
+	query, err := logQuery(context)
+	if err != nil {
+		handleErr(context, http.StatusBadRequest, "", err)
+		return
+	}
+
+	server := websocket.Server{
+		Handshake: checkOrigin,
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			backlog, lines, cancel := process.Output().Follow(query)
+			defer cancel()
+
+			closed := make(chan interface{})
+			go func() {
+				// clients don't send anything, reading only notices when they leave
+				_, _ = io.Copy(ioutil.Discard, ws)
+				close(closed)
+			}()
+
+			for _, line := range backlog {
+				if websocket.JSON.Send(ws, line) != nil {
+					return
+				}
+			}
+			for {
+				select {
+				case <-closed:
+					return
+				case line, ok := <-lines:
+					if !ok || websocket.JSON.Send(ws, line) != nil {
+						return
+					}
+				}
+			}
+		},
+	}
+	server.ServeHTTP(context.Writer, context.Request)
+}
+
+// checkOrigin only lets browsers connect from the console itself, otherwise any
+// site could read the logs with the session of a logged in visitor.
+func checkOrigin(config *websocket.Config, req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host != req.Host {
+		return ErrInvalidOrigin
+	}
+	config.Origin = u
+	return nil
+}
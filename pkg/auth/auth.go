@@ -0,0 +1,441 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Scope = string
+
+const (
+	// ScopeRead can only look at applications.
+	ScopeRead Scope = "read"
+	// ScopeDeploy can install, reload, redeploy and roll back applications.
+	ScopeDeploy Scope = "deploy"
+	// ScopeAdmin can do everything, including managing users and tokens.
+	ScopeAdmin Scope = "admin"
+
+	BootstrapUser = "admin"
+	// TokenPrefix makes kerfuffle tokens recognizable, e.g. when they leak into a repository.
+	TokenPrefix = "kft_"
+
+	SessionTTL = time.Hour * 24
+	// lastUsedInterval throttles how often the last use of a token is written to disk.
+	lastUsedInterval = time.Minute
+)
+
+// How a principal was authenticated.
+const (
+	ViaPassword = "password"
+	ViaToken    = "token"
+	ViaSession  = "session"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrInvalidScope       = errors.New("scope must be one of read, deploy or admin")
+	ErrUserExists         = errors.New("user already exists")
+	ErrNotFound           = errors.New("resource not found")
+	ErrLastAdmin          = errors.New("cannot remove the last admin")
+)
+
+var scopeRanks = map[Scope]int{
+	ScopeRead:   1,
+	ScopeDeploy: 2,
+	ScopeAdmin:  3,
+}
+
+// Allows reports if the granted scope covers the required one, scopes are hierarchical.
+func Allows(granted, required Scope) bool {
+	return scopeRanks[granted] != 0 && scopeRanks[granted] >= scopeRanks[required]
+}
+
+func ValidScope(scope Scope) bool {
+	return scopeRanks[scope] != 0
+}
+
+type User struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_hash"`
+	Scope        Scope     `json:"scope"`
+	Created      time.Time `json:"created"`
+}
+
+// Token is a long-lived API token, only the hash of the token is stored.
+type Token struct {
+	Id       string    `json:"id"`
+	Name     string    `json:"name"`
+	Owner    string    `json:"owner"`
+	Scope    Scope     `json:"scope"`
+	Hash     string    `json:"hash,omitempty"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used,omitempty"`
+}
+
+type session struct {
+	username string
+	expires  time.Time
+}
+
+// Principal is whoever a request was authenticated as.
+type Principal struct {
+	Username string `json:"username"`
+	Scope    Scope  `json:"scope"`
+	// Via is either ViaPassword, ViaToken or ViaSession.
+	Via string `json:"via"`
+	// Token is the name of the token used, if any.
+	Token string `json:"token,omitempty"`
+}
+
+// Store keeps the users and tokens on disk, sessions only live in memory.
+type Store struct {
+	sync.Mutex
+	path string
+
+	Users  map[string]*User  `json:"users"`
+	Tokens map[string]*Token `json:"tokens"`
+
+	sessions map[string]*session
+}
+
+// NewStore loads the store from path, a missing file results in an empty store.
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		path:     path,
+		Users:    map[string]*User{},
+		Tokens:   map[string]*Token{},
+		sessions: map[string]*session{},
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v: %v", path, err)
+	}
+	return s, nil
+}
+
+func (s *Store) save() error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(s.path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path, b, 0600)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Bootstrap creates the admin user with a random password when there are no users
+// yet. The password is only returned when the user was created.
+func (s *Store) Bootstrap() (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.Users) != 0 {
+		return "", nil
+	}
+	password, err := randomHex(12)
+	if err != nil {
+		return "", err
+	}
+	err = s.createUser(BootstrapUser, password, ScopeAdmin)
+	if err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+func (s *Store) CreateUser(username, password string, scope Scope) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.createUser(username, password, scope)
+}
+
+func (s *Store) createUser(username, password string, scope Scope) error {
+	username = strings.TrimSpace(username)
+	if username == "" || password == "" {
+		return errors.New("username and password cannot be empty")
+	}
+	if !ValidScope(scope) {
+		return ErrInvalidScope
+	}
+	if _, exists := s.Users[username]; exists {
+		return ErrUserExists
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	s.Users[username] = &User{
+		Username:     username,
+		PasswordHash: string(hash),
+		Scope:        scope,
+		Created:      time.Now(),
+	}
+	return s.save()
+}
+
+// DeleteUser removes the user along with its tokens and sessions.
+func (s *Store) DeleteUser(username string) error {
+	s.Lock()
+	defer s.Unlock()
+	user, exists := s.Users[username]
+	if !exists {
+		return ErrNotFound
+	}
+	if user.Scope == ScopeAdmin {
+		admins := 0
+		for _, u := range s.Users {
+			if u.Scope == ScopeAdmin {
+				admins++
+			}
+		}
+		if admins == 1 {
+			return ErrLastAdmin
+		}
+	}
+
+	delete(s.Users, username)
+	for id, token := range s.Tokens {
+		if token.Owner == username {
+			delete(s.Tokens, id)
+		}
+	}
+	for id, sess := range s.sessions {
+		if sess.username == username {
+			delete(s.sessions, id)
+		}
+	}
+	return s.save()
+}
+
+// SetPassword changes the password of the user and ends every session of theirs
+// except keep, the one the password was changed from.
+func (s *Store) SetPassword(username, password, keep string) error {
+	s.Lock()
+	defer s.Unlock()
+	user, exists := s.Users[username]
+	if !exists {
+		return ErrNotFound
+	}
+	if password == "" {
+		return errors.New("password cannot be empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = string(hash)
+	kept := hashSecret(keep)
+	for id, sess := range s.sessions {
+		if sess.username == username && (keep == "" || id != kept) {
+			delete(s.sessions, id)
+		}
+	}
+	return s.save()
+}
+
+// GetUsers returns the users without their password hashes.
+func (s *Store) GetUsers() []*User {
+	s.Lock()
+	defer s.Unlock()
+	users := []*User{}
+	for _, u := range s.Users {
+		users = append(users, &User{Username: u.Username, Scope: u.Scope, Created: u.Created})
+	}
+	return users
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHashed   []byte
+)
+
+func dummyHash() []byte {
+	dummyHashOnce.Do(func() {
+		dummyHashed, _ = bcrypt.GenerateFromPassword([]byte("kerfuffle"), bcrypt.DefaultCost)
+	})
+	return dummyHashed
+}
+
+func (s *Store) Authenticate(username, password string) (*Principal, error) {
+	s.Lock()
+	user, exists := s.Users[username]
+	s.Unlock()
+	if !exists {
+		// spend the same time as a wrong password so usernames can't be probed
+		_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{Username: user.Username, Scope: user.Scope, Via: ViaPassword}, nil
+}
+
+// CreateToken issues a token for the owner, the scope can't exceed the owner's own nor
+// the granted one, the scope the owner is authenticated with. The plain token is only
+// ever returned here.
+func (s *Store) CreateToken(owner, name string, scope, granted Scope) (string, *Token, error) {
+	s.Lock()
+	defer s.Unlock()
+	if !ValidScope(scope) {
+		return "", nil, ErrInvalidScope
+	}
+	user, exists := s.Users[owner]
+	if !exists {
+		return "", nil, ErrNotFound
+	}
+	if !Allows(user.Scope, scope) || !Allows(granted, scope) {
+		return "", nil, fmt.Errorf("'%v' can't issue %v tokens", owner, scope)
+	}
+
+	var secret string
+	for secret == "" || s.Tokens[secret[:8]] != nil {
+		var err error
+		secret, err = randomHex(32)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	plain := TokenPrefix + secret
+	token := &Token{
+		Id:      secret[:8],
+		Name:    name,
+		Owner:   owner,
+		Scope:   scope,
+		Hash:    hashSecret(plain),
+		Created: time.Now(),
+	}
+	s.Tokens[token.Id] = token
+	return plain, token, s.save()
+}
+
+func (s *Store) RevokeToken(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, exists := s.Tokens[id]; !exists {
+		return ErrNotFound
+	}
+	delete(s.Tokens, id)
+	return s.save()
+}
+
+// GetTokens returns the tokens of the owner, or every token when owner is empty.
+func (s *Store) GetTokens(owner string) []*Token {
+	s.Lock()
+	defer s.Unlock()
+	tokens := []*Token{}
+	for _, t := range s.Tokens {
+		if owner == "" || t.Owner == owner {
+			token := *t
+			token.Hash = ""
+			tokens = append(tokens, &token)
+		}
+	}
+	return tokens
+}
+
+// VerifyToken resolves a plain token to its principal. A token never has more
+// rights than its owner currently has.
+func (s *Store) VerifyToken(plain string) (*Principal, error) {
+	if !strings.HasPrefix(plain, TokenPrefix) || len(plain) < len(TokenPrefix)+8 {
+		return nil, ErrInvalidCredentials
+	}
+	s.Lock()
+	defer s.Unlock()
+	token, exists := s.Tokens[plain[len(TokenPrefix):len(TokenPrefix)+8]]
+	if !exists || subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hashSecret(plain))) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	user, exists := s.Users[token.Owner]
+	if !exists {
+		return nil, ErrInvalidCredentials
+	}
+	scope := token.Scope
+	if !Allows(user.Scope, scope) {
+		scope = user.Scope
+	}
+	if time.Since(token.LastUsed) >= lastUsedInterval {
+		token.LastUsed = time.Now()
+		// the token was verified, failing to record its use doesn't change that
+		_ = s.save()
+	}
+	return &Principal{Username: token.Owner, Scope: scope, Via: ViaToken, Token: token.Name}, nil
+}
+
+// CreateSession starts a login session for the user of the console.
+func (s *Store) CreateSession(username string) (string, time.Time, error) {
+	id, err := randomHex(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expires := time.Now().Add(SessionTTL)
+	s.Lock()
+	defer s.Unlock()
+	for key, sess := range s.sessions {
+		if time.Now().After(sess.expires) {
+			delete(s.sessions, key)
+		}
+	}
+	s.sessions[hashSecret(id)] = &session{username: username, expires: expires}
+	return id, expires, nil
+}
+
+func (s *Store) VerifySession(id string) (*Principal, error) {
+	s.Lock()
+	defer s.Unlock()
+	sess, exists := s.sessions[hashSecret(id)]
+	if !exists || time.Now().After(sess.expires) {
+		return nil, ErrInvalidCredentials
+	}
+	user, exists := s.Users[sess.username]
+	if !exists {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{Username: user.Username, Scope: user.Scope, Via: ViaSession}, nil
+}
+
+func (s *Store) DeleteSession(id string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.sessions, hashSecret(id))
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.json")
+	store, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	password, err := store.Bootstrap()
+	if err != nil || password == "" {
+		t.Fatalf("expected the admin to be created, got %q %v", password, err)
+	}
+	if again, _ := store.Bootstrap(); again != "" {
+		t.Error("bootstrap should only happen once")
+	}
+	if _, err := store.Authenticate(BootstrapUser, "wrong"); err != ErrInvalidCredentials {
+		t.Errorf("expected %v, got %v", ErrInvalidCredentials, err)
+	}
+	admin, err := store.Authenticate(BootstrapUser, password)
+	if err != nil || admin.Scope != ScopeAdmin {
+		t.Fatalf("unexpected principal %+v %v", admin, err)
+	}
+
+	if err := store.CreateUser("ci", "hunter2", ScopeDeploy); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.CreateToken("ci", "too much", ScopeAdmin, ScopeAdmin); err == nil {
+		t.Error("tokens shouldn't exceed the scope of their owner")
+	}
+	if _, _, err := store.CreateToken("ci", "escalated", ScopeDeploy, ScopeRead); err == nil {
+		t.Error("tokens shouldn't exceed the scope they're created with")
+	}
+	plain, token, err := store.CreateToken("ci", "github actions", ScopeDeploy, ScopeDeploy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Hash == plain {
+		t.Error("token should be stored hashed")
+	}
+
+	// users and tokens survive a restart, sessions don't
+	session, _, err := store.CreateSession("ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal, err := store.VerifySession(session); err != nil || principal.Username != "ci" {
+		t.Errorf("unexpected session principal %+v %v", principal, err)
+	}
+	store, err = NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.VerifySession(session); err != ErrInvalidCredentials {
+		t.Errorf("expected %v, got %v", ErrInvalidCredentials, err)
+	}
+	principal, err := store.VerifyToken(plain)
+	if err != nil || principal.Username != "ci" || principal.Scope != ScopeDeploy || principal.Token != "github actions" {
+		t.Fatalf("unexpected token principal %+v %v", principal, err)
+	}
+	if _, err := store.VerifyToken(plain + "0"); err != ErrInvalidCredentials {
+		t.Errorf("expected %v, got %v", ErrInvalidCredentials, err)
+	}
+	// the last use is saved, at most once every lastUsedInterval
+	if reloaded, err := NewStore(path); err != nil || reloaded.Tokens[token.Id].LastUsed.IsZero() {
+		t.Errorf("expected the last use of the token to be saved, %v", err)
+	}
+
+	if err := store.RevokeToken(token.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.VerifyToken(plain); err != ErrInvalidCredentials {
+		t.Errorf("revoked token still works: %v", err)
+	}
+
+	// changing the password ends every other session of the user
+	current, _, _ := store.CreateSession("ci")
+	other, _, _ := store.CreateSession("ci")
+	adminSession, _, _ := store.CreateSession(BootstrapUser)
+	if err := store.SetPassword("ci", "hunter3", current); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.VerifySession(current); err != nil {
+		t.Errorf("the session changing the password should stay valid: %v", err)
+	}
+	if _, err := store.VerifySession(other); err != ErrInvalidCredentials {
+		t.Errorf("expected the other session to be ended, got %v", err)
+	}
+	if _, err := store.VerifySession(adminSession); err != nil {
+		t.Errorf("sessions of other users should stay valid: %v", err)
+	}
+	if _, err := store.Authenticate("ci", "hunter3"); err != nil {
+		t.Errorf("expected the new password to work: %v", err)
+	}
+
+	if err := store.DeleteUser(BootstrapUser); err != ErrLastAdmin {
+		t.Errorf("expected %v, got %v", ErrLastAdmin, err)
+	}
+}
+
+func TestAllows(t *testing.T) {
+	tests := []struct {
+		granted, required Scope
+		allowed           bool
+	}{
+		{ScopeAdmin, ScopeDeploy, true},
+		{ScopeDeploy, ScopeDeploy, true},
+		{ScopeDeploy, ScopeAdmin, false},
+		{ScopeRead, ScopeDeploy, false},
+		{"", ScopeRead, false},
+	}
+	for _, tt := range tests {
+		if Allows(tt.granted, tt.required) != tt.allowed {
+			t.Errorf("Allows(%q, %q) should be %v", tt.granted, tt.required, tt.allowed)
+		}
+	}
+}
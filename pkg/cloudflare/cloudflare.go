@@ -149,7 +149,7 @@ func (c *CloudflareConfig) CheckAndClearRecords() error {
 	}
 
 	for _, record := range response.Result {
-		if record.Name != c.DNS.Name && record.Type != c.DNS.Type {
+		if record.Name != c.DNS.Name || record.Type != c.DNS.Type {
 			continue
 		}
 		err := c.RemoveConfiguration(zone.ID, record.ID)
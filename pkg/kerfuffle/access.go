@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var ErrUnknownProxy = errors.New("proxy does not exist")
+
+func (m *Manager) accessPath(id string) string {
+	return filepath.Join(m.AppDataPath, id+".access")
+}
+
+// accessOverrides returns the access controls set through the API, by proxy.
+func (m *Manager) accessOverrides(id string) (map[string]*ProxyAccess, error) {
+	overrides := map[string]*ProxyAccess{}
+	b, err := ioutil.ReadFile(m.accessPath(id))
+	if os.IsNotExist(err) {
+		return overrides, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &overrides)
+	return overrides, err
+}
+
+// proxyAccess returns the access control in effect for the proxy, and whether it was set through the API.
+func (m *Manager) proxyAccess(id, proxyID string, proxy *Proxy) (*ProxyAccess, bool, error) {
+	overrides, err := m.accessOverrides(id)
+	if err != nil {
+		return nil, false, err
+	}
+	if access, exists := overrides[proxyID]; exists {
+		return access, true, nil
+	}
+	return proxy.Access, false, nil
+}
+
+// GetProxyAccess returns the access control in effect for the proxy, and whether it was set through the API.
+func (m *Manager) GetProxyAccess(id, proxyID string) (*ProxyAccess, bool, error) {
+	app := m.GetApplication(id)
+	if app == nil {
+		return nil, false, ErrNotFound
+	}
+	proxy := app.GetProxy(proxyID)
+	if proxy == nil {
+		return nil, false, ErrUnknownProxy
+	}
+	return m.proxyAccess(id, proxyID, proxy)
+}
+
+// SetProxyAccess replaces the access control of a proxy without redeploying it, the
+// override is kept across redeploys. nil removes the override so the proxy goes back
+// to the access control of its .kerfuffle file.
+func (m *Manager) SetProxyAccess(id, proxyID string, access *ProxyAccess) error {
+	app := m.GetApplication(id)
+	if app == nil {
+		return ErrNotFound
+	}
+	proxy := app.GetProxy(proxyID)
+	if proxy == nil {
+		return ErrUnknownProxy
+	}
+	err := access.control().Validate()
+	if err != nil {
+		return err
+	}
+
+	m.accessLock.Lock()
+	defer m.accessLock.Unlock()
+	overrides, err := m.accessOverrides(id)
+	if err != nil {
+		return err
+	}
+	if access == nil {
+		delete(overrides, proxyID)
+		access = proxy.Access
+	} else {
+		overrides[proxyID] = access
+	}
+	if len(overrides) == 0 {
+		err = os.Remove(m.accessPath(id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		b, err := json.Marshal(overrides)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(m.accessPath(id), b, 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	// routes which aren't installed pick the override up when they're deployed
+	if m.HttpReverseProxyManager == nil {
+		return nil
+	}
+	for _, host := range proxy.Host {
+		err = m.HttpReverseProxyManager.SetAccessControl(host, access.control())
+		if err != nil {
+			log.Warn().Err(err).Str("app", id).Str("route", host).Msg("failed to apply access control")
+		}
+	}
+	return nil
+}
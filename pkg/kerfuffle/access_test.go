@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"kerfuffle/pkg/proxy_handler"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestManager_SetProxyAccess(t *testing.T) {
+	m := NewManager()
+	m.AppDataPath = t.TempDir()
+	m.HttpReverseProxyManager = proxy_handler.NewHttpReverseProxyManager()
+
+	app := NewApplication(&InstallConfiguration{Repository: "https://example.com/access", Branch: "master"})
+	app.proxies = map[string]*Proxy{"web": {
+		Host:   []string{"access.local"},
+		Ports:  []string{"1"},
+		Access: &ProxyAccess{Deny: []string{"203.0.113.0/24"}},
+	}}
+	m.applications[app.ID] = app
+	if err := m.bootstrapProxies(app); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := m.HttpReverseProxyManager.Handler(false)
+	forbidden := func() bool {
+		req := httptest.NewRequest("GET", "http://access.local/", nil)
+		req.RemoteAddr = "203.0.113.7:4000"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code == http.StatusForbidden
+	}
+	if !forbidden() {
+		t.Fatal("expected the .kerfuffle deny list to apply")
+	}
+
+	if err := m.SetProxyAccess(app.ID, "web", &ProxyAccess{Allow: []string{"203.0.113.7"}}); err != nil {
+		t.Fatal(err)
+	}
+	if forbidden() {
+		t.Error("expected the override to apply to the running route")
+	}
+	// overrides survive redeploys
+	m.uninstallProxies(app.GetAllProxies())
+	if err := m.bootstrapProxies(app); err != nil {
+		t.Fatal(err)
+	}
+	if access, overridden, err := m.GetProxyAccess(app.ID, "web"); err != nil || !overridden || forbidden() {
+		t.Errorf("expected the override to be kept, got %+v %v %v", access, overridden, err)
+	}
+
+	if err := m.SetProxyAccess(app.ID, "web", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !forbidden() {
+		t.Error("expected the .kerfuffle deny list to be restored")
+	}
+	if err := m.SetProxyAccess(app.ID, "web", &ProxyAccess{BasicAuth: []string{"qa:plain"}}); err == nil {
+		t.Error("expected plain passwords to be rejected")
+	}
+	if err := m.SetProxyAccess(app.ID, "api", nil); err != ErrUnknownProxy {
+		t.Errorf("expected an unknown proxy, got %v", err)
+	}
+}
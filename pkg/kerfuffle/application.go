@@ -10,12 +10,14 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/pelletier/go-toml"
 	"github.com/rs/zerolog/log"
 	"github.com/tv42/slug"
 	_ "kerfuffle/pkg/logging"
+	"kerfuffle/pkg/proxy_handler"
 	"kerfuffle/pkg/utils"
 	"net/http"
 	"os"
@@ -30,11 +32,12 @@ var (
 )
 
 var (
-	StatusBooting = "booting"
-	StatusRunning = "running"
-	StatusFailed  = "failed"
-	StatusCrashed = "crashed"
-	StatusUnknown = "unknown"
+	StatusBooting   = "booting"
+	StatusRunning   = "running"
+	StatusFailed    = "failed"
+	StatusCrashed   = "crashed"
+	StatusUnhealthy = "unhealthy"
+	StatusUnknown   = "unknown"
 )
 
 type AppStatus struct {
@@ -51,11 +54,43 @@ type Application struct {
 	Created              time.Time             `json:"created"`
 	MaintenanceMode      bool                  `json:"maintenance_mode"`
 
-	appPath    string
+	appPath string
+	// mu guards the configuration, the processes and the health monitors,
+	// statusLock guards Statuses.
+	mu         sync.RWMutex
+	statusLock sync.Mutex
 	process    map[string]*Process
+	// pending holds the processes booted by a reload which aren't swapped in yet
+	pending    map[*Process]struct{}
 	provisions map[string]*Provision
 	proxies    map[string]*Proxy
 	cfs        map[string]*Cloudflare
+	pages      *proxy_handler.ErrorPages
+	health     map[string]*healthMonitor
+	logFiles   map[string]*logFile
+	deploying  int32
+	// pushQueued is set while a pushed redeploy waits for the running deploy to finish
+	pushQueued int32
+	// samplerStop stops the sampling of the resource usage, guarded by mu
+	samplerStop chan interface{}
+	// maintenance holds the reason and ETA of the maintenance, guarded by mu
+	maintenance *proxy_handler.Maintenance
+
+	// failureLock guards failures, the latest requests the proxy failed to get answered
+	failureLock sync.Mutex
+	failures    []*UpstreamFailure
+
+	// scheduleLock guards scheduleCancel, which abandons the provisions still
+	// waiting on their dependencies.
+	scheduleLock   sync.Mutex
+	scheduleCancel chan interface{}
+
+	// logDir is where the output of the processes is written to, it's left
+	// empty to only keep the output in memory.
+	logDir    string
+	logPolicy *LogPolicy
+	// cgroupRoot is where the cgroups of provisions with resource limits are created
+	cgroupRoot string
 }
 
 func NewApplication(config *InstallConfiguration) *Application {
@@ -68,17 +103,78 @@ func NewApplication(config *InstallConfiguration) *Application {
 	return &Application{ID: s,
 		InstallConfiguration: config,
 		process:              map[string]*Process{},
+		pending:              map[*Process]struct{}{},
+		health:               map[string]*healthMonitor{},
+		logFiles:             map[string]*logFile{},
 		Created:              time.Now(),
 		Statuses:             []*AppStatus{},
 	}
 }
 
 func (a *Application) setStatus(flag, reason string) {
+	a.statusLock.Lock()
+	defer a.statusLock.Unlock()
 	a.Statuses = append(a.Statuses, &AppStatus{
 		flag, reason, time.Now(),
 	})
 }
 
+func (a *Application) GetStatuses() []*AppStatus {
+	a.statusLock.Lock()
+	defer a.statusLock.Unlock()
+	return append([]*AppStatus{}, a.Statuses...)
+}
+
+func (a *Application) InMaintenanceMode() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.MaintenanceMode
+}
+
+// GetMaintenance returns the reason and ETA of the maintenance, nil when the application isn't on hold.
+func (a *Application) GetMaintenance() *proxy_handler.Maintenance {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if !a.MaintenanceMode {
+		return nil
+	}
+	if a.maintenance == nil {
+		return &proxy_handler.Maintenance{}
+	}
+	return a.maintenance
+}
+
+func (a *Application) errorPages() *proxy_handler.ErrorPages {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.pages
+}
+
+// MarshalJSON takes a snapshot of the application under its locks.
+func (a *Application) MarshalJSON() ([]byte, error) {
+	a.mu.RLock()
+	meta, maintenance := a.Meta, a.MaintenanceMode
+	var reason string
+	var until *time.Time
+	if maintenance && a.maintenance != nil {
+		reason = a.maintenance.Reason
+		if !a.maintenance.Until.IsZero() {
+			until = &a.maintenance.Until
+		}
+	}
+	a.mu.RUnlock()
+	return json.Marshal(&struct {
+		ID                   string                `json:"id"`
+		InstallConfiguration *InstallConfiguration `json:"install_configuration"`
+		Meta                 *Meta                 `json:"meta"`
+		Statuses             []*AppStatus          `json:"status_log"`
+		Created              time.Time             `json:"created"`
+		MaintenanceMode      bool                  `json:"maintenance_mode"`
+		MaintenanceReason    string                `json:"maintenance_reason,omitempty"`
+		MaintenanceUntil     *time.Time            `json:"maintenance_until,omitempty"`
+	}{a.ID, a.InstallConfiguration, meta, a.GetStatuses(), a.Created, maintenance, reason, until})
+}
+
 func (a *Application) AppPath() string {
 	return a.appPath
 }
@@ -88,10 +184,25 @@ func (a *Application) SetAppPath(appPath string) {
 }
 
 func (a *Application) GetProcess(id string) *Process {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
 	return a.process[id]
 }
 
+// processes returns a snapshot of the application's processes.
+func (a *Application) processes() map[string]*Process {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	processes := map[string]*Process{}
+	for id, process := range a.process {
+		processes[id] = process
+	}
+	return processes
+}
+
 func (a *Application) GetAllProcessIds() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
 	var keys []string
 	for s := range a.process {
 		keys = append(keys, s)
@@ -100,15 +211,23 @@ func (a *Application) GetAllProcessIds() []string {
 }
 
 func (a *Application) GetProvision(id string) *Provision {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
 	return a.provisions[id]
 }
 
 func (a *Application) GetAllProvisions() map[string]*Provision {
-	return a.provisions
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	provisions := map[string]*Provision{}
+	for id, provision := range a.provisions {
+		provisions[id] = provision
+	}
+	return provisions
 }
 
 func (a *Application) GetProcessStatus(id string) (*BasicProcessState, error) {
-	proc := a.process[id]
+	proc := a.GetProcess(id)
 	if proc == nil {
 		return nil, ErrNotFound
 	}
@@ -117,26 +236,59 @@ func (a *Application) GetProcessStatus(id string) (*BasicProcessState, error) {
 
 func (a *Application) GetAllProcessStatus() map[string]*BasicProcessState {
 	var statuses = map[string]*BasicProcessState{}
-	for s, process := range a.process {
+	for s, process := range a.processes() {
 		statuses[s] = process.Status()
 	}
 	return statuses
 }
 
+// GetProxy returns a copy of the proxy, its ports change when the provision is reloaded.
 func (a *Application) GetProxy(id string) *Proxy {
-	return a.proxies[id]
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	proxy, exists := a.proxies[id]
+	if !exists {
+		return nil
+	}
+	p := *proxy
+	return &p
 }
 
 func (a *Application) GetAllProxies() map[string]*Proxy {
-	return a.proxies
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	proxies := map[string]*Proxy{}
+	for id, proxy := range a.proxies {
+		p := *proxy
+		proxies[id] = &p
+	}
+	return proxies
+}
+
+// setProxyPorts replaces the ports of the proxy, the first one becomes its bind port.
+func (a *Application) setProxyPorts(id string, ports []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if proxy, exists := a.proxies[id]; exists {
+		proxy.Ports = ports
+		proxy.BindPort = ports[0]
+	}
 }
 
 func (a *Application) GetCf(id string) *Cloudflare {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
 	return a.cfs[id]
 }
 
 func (a *Application) GetAllCfs() map[string]*Cloudflare {
-	return a.cfs
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	cfs := map[string]*Cloudflare{}
+	for id, cf := range a.cfs {
+		cfs[id] = cf
+	}
+	return cfs
 }
 
 func (a *Application) BootstrapConfigs() error {
@@ -147,14 +299,31 @@ func (a *Application) BootstrapConfigs() error {
 		return err
 	}
 
-	a.Meta = new(Meta)
-	err = config.Get("meta").(*toml.Tree).Unmarshal(a.Meta)
+	meta := new(Meta)
+	err = config.Get("meta").(*toml.Tree).Unmarshal(meta)
 	if err != nil {
 		return err
 	}
-	log.Debug().Interface("meta", a.Meta).Msg("")
+	log.Debug().Interface("meta", meta).Msg("")
 
-	a.provisions = make(map[string]*Provision)
+	var pages *proxy_handler.ErrorPages
+	if tree, ok := config.Get("pages").(*toml.Tree); ok {
+		p := new(Pages)
+		err = tree.Unmarshal(p)
+		if err != nil {
+			return err
+		}
+		name := meta.Name
+		if name == "" {
+			name = a.ID
+		}
+		pages, err = p.load(a.AppPath(), name)
+		if err != nil {
+			return err
+		}
+	}
+
+	provisions := make(map[string]*Provision)
 	for _, key := range config.GetArray("provision").(*toml.Tree).Keys() {
 		p := new(Provision)
 		err := config.GetArray("provision").(*toml.Tree).Get(key).(*toml.Tree).Unmarshal(p)
@@ -162,22 +331,38 @@ func (a *Application) BootstrapConfigs() error {
 			return err
 		}
 		p.Id = key
+		err = p.validate()
+		if err != nil {
+			return err
+		}
 		log.Debug().Interface("provision", p).Str("id", key).Msg("loaded provision")
-		a.provisions[key] = p
+		provisions[key] = p
+	}
+	err = resolveDependencies(provisions)
+	if err != nil {
+		return err
 	}
 
-	a.proxies = make(map[string]*Proxy)
+	proxies := make(map[string]*Proxy)
 	for _, key := range config.GetArray("proxy").(*toml.Tree).Keys() {
 		p := new(Proxy)
 		err := config.GetArray("proxy").(*toml.Tree).Get(key).(*toml.Tree).Unmarshal(p)
 		if err != nil {
 			return err
 		}
+		err = p.validate(key)
+		if err != nil {
+			return err
+		}
+		err = p.applyReplicas(key, provisions[key])
+		if err != nil {
+			return err
+		}
 		log.Debug().Interface("proxy", p).Str("id", key).Msg("loaded proxy")
-		a.proxies[key] = p
+		proxies[key] = p
 	}
 
-	a.cfs = make(map[string]*Cloudflare)
+	cfs := make(map[string]*Cloudflare)
 	for _, key := range config.GetArray("cloudflare").(*toml.Tree).Keys() {
 		p := new(Cloudflare)
 		err := config.GetArray("cloudflare").(*toml.Tree).Get(key).(*toml.Tree).Unmarshal(p)
@@ -185,16 +370,20 @@ func (a *Application) BootstrapConfigs() error {
 			return err
 		}
 		log.Debug().Interface("cloudflare", p).Str("id", key).Msg("loaded cloudflare")
-		a.cfs[key] = p
+		cfs[key] = p
 	}
 
+	// only replace the running configuration once the new one has fully loaded
+	a.mu.Lock()
+	a.Meta, a.provisions, a.proxies, a.cfs, a.pages = meta, provisions, proxies, cfs, pages
+	a.mu.Unlock()
 	return nil
 }
 
 func (a *Application) GetUnhealthyProcesses() []*Process {
 	var p []*Process
-	for _, process := range a.process {
-		if len(process.Errors) != 0 {
+	for _, process := range a.processes() {
+		if len(process.GetErrors()) != 0 {
 			p = append(p, process)
 		}
 	}
@@ -216,21 +405,24 @@ func waitForPort(port string) error {
 
 func (a *Application) WaitForBind() {
 	a.setStatus(StatusBooting, "Waiting for application to bind to port")
-	var wg sync.WaitGroup
-	wg.Add(len(a.proxies))
-	var err error
+	var ports []string
+	for _, proxy := range a.GetAllProxies() {
+		ports = append(ports, proxy.Ports...)
+	}
 
-	for _, proxy := range a.proxies {
-		proxy := proxy
+	errs := make(chan error, len(ports))
+	for _, port := range ports {
+		port := port
 		go func() {
-			err1 := waitForPort(proxy.BindPort)
-			if err1 != nil {
-				err = err1
-			}
-			wg.Done()
+			errs <- waitForPort(port)
 		}()
 	}
-	wg.Wait()
+	var err error
+	for range ports {
+		if err1 := <-errs; err1 != nil {
+			err = err1
+		}
+	}
 	if err != nil {
 		a.setStatus(StatusFailed, "Application failed to bind to port")
 	} else {
@@ -238,106 +430,230 @@ func (a *Application) WaitForBind() {
 	}
 }
 
+// replicaId returns the process id of a provision's replica, the first replica
+// keeps the provision's id.
+func replicaId(target string, replica int) string {
+	if replica == 0 {
+		return target
+	}
+	return fmt.Sprintf("%v.%v", target, replica)
+}
+
+// replicaPort returns the port assigned to a provision's replica, or an empty
+// string if the provision isn't proxied.
+func (a *Application) replicaPort(target string, replica int) string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	proxy, exists := a.proxies[target]
+	if !exists || replica >= len(proxy.Ports) {
+		return ""
+	}
+	return proxy.Ports[replica]
+}
+
+// ReplicaAlive reports if the process of the given replica is running.
+func (a *Application) ReplicaAlive(target string, replica int) bool {
+	process := a.GetProcess(replicaId(target, replica))
+	return process != nil && process.Alive()
+}
+
+// spawnProvision launches every replica of the provision under the supervisor.
+func (a *Application) spawnProvision(provision *Provision, target string) []*Process {
+	var processes []*Process
+	for i := 0; i < provision.ReplicaCount(); i++ {
+		id := replicaId(target, i)
+		port := a.replicaPort(target, i)
+		log.Debug().Str("target", target).Str("id", id).Interface("provision", provision).Msg("spawning provision")
+		process := a.newProcess(provision, id, port)
+		processes = append(processes, process)
+		go func() {
+			err := a.superviseProcess(process)
+			if err != nil {
+				log.Err(err).Str("id", id).Msg("provision returned an error")
+			}
+		}()
+	}
+	return processes
+}
+
 func (a *Application) BootstrapProvisions() error {
 	go a.WaitForBind()
-	init, exists := a.provisions["init"]
+	a.startSampler()
+	provisions := a.GetAllProvisions()
+	init, exists := provisions["init"]
 	if exists {
-		err := a.executeProvision(init, "init")
+		err := a.executeProvision(init, "init", "")
 		if err != nil {
 			return fmt.Errorf("init failed to finish: %v", err)
 		}
 	}
 
-	for target, provision := range a.provisions {
-		if target == "init" {
-			continue
-		}
-		log.Debug().Str("target", target).Interface("provision", provision).Msg("spawning provision")
-		provision := provision
-		target := target
-		go func() {
-			err := a.executeProvision(provision, target)
-			if err != nil {
-				log.Err(err).Str("id", provision.Id).Msg("provision returned an error")
-			}
-		}()
-	}
+	delete(provisions, "init")
+	a.scheduleProvisions(provisions)
 	return nil
 }
 
+// ReloadProvision kills the provision's processes and starts them again, proxied
+// provisions should go through Manager.ReloadProvision to avoid the downtime.
 func (a *Application) ReloadProvision(target string) error {
-
-	if provision, exists := a.provisions[target]; exists {
+	if provision := a.GetProvision(target); provision != nil {
 		log.Debug().Str("target", target).Interface("provision", provision).Msg("reloading provision")
-		_ = a.process[target].Kill()
-		delete(a.process, target)
-		go func() {
-			err := a.executeProvision(provision, target)
-			if err != nil {
-				log.Err(err).Str("id", provision.Id).Msg("provision returned an error")
+		for i := 0; i < provision.ReplicaCount(); i++ {
+			if process := a.removeProcess(replicaId(target, i)); process != nil {
+				_ = process.Kill()
 			}
-		}()
+		}
+		a.spawnProvision(provision, target)
 		return nil
 	}
 	return errors.New("target provision does not exist")
 }
 
-func (a *Application) executeProvision(provision *Provision, target string) error {
+// executeProvision launches the provision's commands under the supervisor, which
+// restarts them according to the provision's restart policy.
+func (a *Application) executeProvision(provision *Provision, id string, port string) error {
+	process := a.newProcess(provision, id, port)
+	return a.superviseProcess(process)
+}
+
+func (a *Application) newProcess(provision *Provision, id string, port string) *Process {
+	process := a.createProcess(provision, id, port)
+	a.replaceProcess(process)
+	return process
+}
+
+// replaceProcess registers the process, returning the one it replaced.
+func (a *Application) replaceProcess(process *Process) *Process {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.pending, process)
+	previous := a.process[process.id]
+	a.process[process.id] = process
+	return previous
+}
+
+// addPending keeps track of a process which isn't registered yet, so Shutdown
+// kills it as well.
+func (a *Application) addPending(process *Process) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending[process] = struct{}{}
+}
+
+func (a *Application) removePending(process *Process) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.pending, process)
+}
+
+func (a *Application) removeProcess(id string) *Process {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	process := a.process[id]
+	delete(a.process, id)
+	return process
+}
+
+// createProcess prepares a process without registering it in the application.
+func (a *Application) createProcess(provision *Provision, id string, port string) *Process {
 	process := new(Process)
-	a.process[target] = process
+	process.id = id
+	process.port = port
 	process.provision = provision
-	process.done = make(chan interface{}, 1)
 	process.Errors = []error{}
-	defer close(process.done)
-
-	process.err = bytes.NewBufferString("")
-	process.log = bytes.NewBufferString("")
+	process.Restarts = []*RestartRecord{}
+	process.stop = make(chan interface{})
+	process.started = make(chan interface{})
+	process.finished = make(chan interface{})
+
+	process.output = NewLogBuffer(provision.LogLines)
+	if file := a.logFile(id); file != nil {
+		process.output.sink = file
+	}
 
 	process.env = os.Environ()
 	process.env = append(process.env, provision.EnvironmentVariables...)
 	process.directory = filepath.Join(a.AppPath(), provision.BaseDirectory)
 
-	if proxy, exists := a.proxies[target]; exists {
-		log.Debug().Str("id", target).Str("port", proxy.BindPort).Msg("assigning port")
+	if port != "" {
+		log.Debug().Str("id", id).Str("port", port).Msg("assigning port")
 		process.env = append(
 			process.env,
-			fmt.Sprintf("APP_HOST=localhost:%v", proxy.BindPort),
-			fmt.Sprintf("APP_PORT=%v", proxy.BindPort),
+			fmt.Sprintf("APP_HOST=localhost:%v", port),
+			fmt.Sprintf("APP_PORT=%v", port),
 		)
 	}
+	return process
+}
 
+// runProcess runs every command of the provision once, in order.
+func (a *Application) runProcess(process *Process) error {
+	done := make(chan interface{})
+	process.mu.Lock()
+	process.done = done
+	process.mu.Unlock()
+	defer close(done)
+
+	provision := process.provision
+	if err := a.attachCgroup(process); err != nil {
+		process.addError(err)
+		a.setStatus(StatusFailed, fmt.Sprintf("Provision '%v' wasn't started: %v", process.id, err))
+		return err
+	}
 	for i, commands := range provision.Run {
-		log.Info().Str("base_dir", process.directory).Str("id", provision.Id).Msgf("Launching CMD (%v/%v) '%v'", i+1, len(provision.Run), commands)
+		if process.isStopped() {
+			return nil
+		}
+		log.Info().Str("base_dir", process.directory).Str("id", process.id).Msgf("Launching CMD (%v/%v) '%v'", i+1, len(provision.Run), commands)
 		cmd := exec.Command(commands[0], commands[1:]...)
 		utils.AttachSysProcAttr(cmd)
 		cmd.Dir = process.directory
 		cmd.Env = process.env
-		process.cmd = cmd
-
-		cmd.Stdout = process.log
-		cmd.Stderr = process.err
+		cmd.Stdout = process.output.Writer(StreamStdout)
+		cmd.Stderr = process.output.Writer(StreamStderr)
 
-		err := cmd.Run()
+		err := process.run(cmd)
+		process.output.Flush()
 		if err != nil {
-			process.Errors = append(process.Errors, err)
-			if i == len(provision.Run)-1 {
-				a.setStatus(StatusCrashed, fmt.Sprintf("Provision '%v' crashed: %v", provision.Id, err))
+			process.addError(err)
+			if i == len(provision.Run)-1 && !process.isStopped() {
+				if process.wasOOMKilled() {
+					a.setStatus(StatusOOMKilled, fmt.Sprintf("Provision '%v' ran out of memory (memory_max %v) and was killed", process.id, provision.MemoryMax))
+				} else {
+					a.setStatus(StatusCrashed, fmt.Sprintf("Provision '%v' crashed: %v", process.id, err))
+				}
 			}
 			return err
 		}
-		log.Info().Str("id", provision.Id).Msgf("Finished CMD (%v/%v) '%v'", i+1, len(provision.Run), commands)
+		log.Info().Str("id", process.id).Msgf("Finished CMD (%v/%v) '%v'", i+1, len(provision.Run), commands)
 	}
 	return nil
 }
 
 func (a *Application) Shutdown() {
 	log.Debug().Str("app", a.ID).Msg("shutting down application")
-	for s, process := range a.process {
+	a.stopScheduling()
+	a.stopHealthChecks()
+	a.stopSampler()
+	for s, process := range a.processes() {
 		err := process.Kill()
 		if err != nil {
 			log.Err(err).Str("process", s).Msg("failed to kill")
 		}
 	}
+	a.mu.RLock()
+	var pending []*Process
+	for process := range a.pending {
+		pending = append(pending, process)
+	}
+	a.mu.RUnlock()
+	for _, process := range pending {
+		err := process.Kill()
+		if err != nil {
+			log.Err(err).Str("process", process.id).Msg("failed to kill")
+		}
+	}
+	a.closeLogFiles()
 }
 
 func (a *Application) GetLastGitCommit() (string, error) {
@@ -351,6 +667,12 @@ func (a *Application) GetLastGitCommit() (string, error) {
 	return output.String(), err
 }
 
+// GetStatus returns the latest status of the application, or nil if it has none.
 func (a *Application) GetStatus() *AppStatus {
+	a.statusLock.Lock()
+	defer a.statusLock.Unlock()
+	if len(a.Statuses) == 0 {
+		return nil
+	}
 	return a.Statuses[len(a.Statuses)-1]
 }
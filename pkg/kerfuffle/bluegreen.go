@@ -0,0 +1,233 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"errors"
+	"fmt"
+	"github.com/phayes/freeport"
+	"github.com/rs/zerolog/log"
+	"kerfuffle/pkg/proxy_handler"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// readyTimeout is how long a new revision gets to pass its health check
+	// (or bind to its port) before the reload is aborted.
+	readyTimeout = time.Minute
+	// drainTimeout is how long the old revision gets to finish its in-flight requests.
+	drainTimeout = time.Second * 30
+)
+
+// ReloadProvision restarts a provision without downtime when it's proxied. The new
+// revision boots on fresh ports next to the running one, and the route is only
+// swapped over to it once it's ready. The old processes are killed after they've
+// drained. Provisions which aren't proxied are simply restarted.
+func (m *Manager) ReloadProvision(id, target string) error {
+	app := m.GetApplication(id)
+	if app == nil {
+		return ErrNotFound
+	}
+	provision := app.GetProvision(target)
+	if provision == nil {
+		return errors.New("target provision does not exist")
+	}
+	proxy := app.GetProxy(target)
+	if proxy == nil || m.HttpReverseProxyManager == nil {
+		return app.ReloadProvision(target)
+	}
+	if !atomic.CompareAndSwapInt32(&app.deploying, 0, 1) {
+		return ErrDeployInProgress
+	}
+	defer atomic.StoreInt32(&app.deploying, 0)
+
+	log.Info().Str("app", app.ID).Str("target", target).Msg("reloading provision (blue/green)")
+	app.setStatus(StatusDeploying, fmt.Sprintf("Booting a new revision of '%v'", target))
+
+	var (
+		ports     []string
+		processes []*Process
+	)
+	abort := func(err error) error {
+		for _, process := range processes {
+			_ = process.Kill()
+			app.removePending(process)
+		}
+		app.setStatus(StatusFailed, fmt.Sprintf("Reload of '%v' aborted, keeping the running revision: %v", target, err))
+		return err
+	}
+
+	for i := 0; i < provision.ReplicaCount(); i++ {
+		port, err := freeport.GetFreePort()
+		if err != nil {
+			return abort(err)
+		}
+		ports = append(ports, fmt.Sprintf("%v", port))
+
+		process := app.createProcess(provision, replicaId(target, i), ports[i])
+		app.addPending(process)
+		processes = append(processes, process)
+	}
+
+	ready := make(chan error, len(processes))
+	for _, process := range processes {
+		process := process
+		exited := make(chan interface{})
+		go func() {
+			err := app.superviseProcess(process)
+			if err != nil {
+				log.Err(err).Str("id", process.id).Msg("provision returned an error")
+			}
+			close(exited)
+		}()
+		go func() {
+			ready <- waitReady(process, exited)
+		}()
+	}
+	for range processes {
+		if err := <-ready; err != nil {
+			return abort(err)
+		}
+	}
+
+	app.setStatus(StatusDeploying, fmt.Sprintf("Switching '%v' over to the new revision", target))
+	var (
+		swapped  = map[string][]*proxy_handler.Backend{}
+		previous []*proxy_handler.Backend
+		current  []*proxy_handler.Backend
+	)
+	for _, host := range proxy.Host {
+		backends, err := newBackends(ports, func(i int) (string, func() bool) {
+			return processes[i].id, processes[i].Alive
+		})
+		if err != nil {
+			m.unswapBackends(swapped, current)
+			return abort(err)
+		}
+		current = append(current, backends...)
+
+		old, err := m.HttpReverseProxyManager.SwapBackends(host, backends)
+		if err != nil {
+			m.unswapBackends(swapped, current)
+			return abort(err)
+		}
+		swapped[host] = old
+		previous = append(previous, old...)
+	}
+
+	var stale []*Process
+	for i, process := range processes {
+		if old := app.replaceProcess(process); old != nil {
+			stale = append(stale, old)
+		}
+		if provision.HealthEndpoint != "" {
+			app.startHealthCheck(provision, process.id, ports[i])
+		}
+	}
+	app.setProxyPorts(target, ports)
+
+	app.setStatus(StatusDeploying, fmt.Sprintf("Draining the previous revision of '%v'", target))
+	for _, backend := range previous {
+		if !backend.Drain(drainTimeout) {
+			log.Warn().Str("app", app.ID).Str("backend", backend.Target.Host).Int64("active", backend.Active()).Msg("backend didn't drain in time")
+		}
+	}
+	for _, process := range stale {
+		err := process.Kill()
+		if err != nil {
+			log.Err(err).Str("id", process.id).Msg("failed to kill previous revision")
+		}
+	}
+
+	app.setStatus(StatusRunning, fmt.Sprintf("Provision '%v' reloaded", target))
+	return nil
+}
+
+// newBackends creates a backend for every port of a route, replica returns the
+// name and the liveness check of the one at index i. Every route gets backends
+// of its own, they can't be shared.
+func newBackends(ports []string, replica func(i int) (string, func() bool)) ([]*proxy_handler.Backend, error) {
+	var backends []*proxy_handler.Backend
+	for i, port := range ports {
+		name, alive := replica(i)
+		backend, err := proxy_handler.NewBackend(fmt.Sprintf("http://localhost:%v", port), alive)
+		if err != nil {
+			return nil, err
+		}
+		backend.Name = name
+		backends = append(backends, backend)
+	}
+	return backends, nil
+}
+
+// unswapBackends puts the running revision back on the hosts already swapped over
+// to the new one, and lets the new backends finish their requests before they're killed.
+func (m *Manager) unswapBackends(swapped map[string][]*proxy_handler.Backend, backends []*proxy_handler.Backend) {
+	if len(swapped) == 0 {
+		return
+	}
+	for host, previous := range swapped {
+		_, err := m.HttpReverseProxyManager.SwapBackends(host, previous)
+		if err != nil {
+			log.Err(err).Str("host", host).Msg("failed to restore the backends of the running revision")
+		}
+	}
+	for _, backend := range backends {
+		backend.Drain(drainTimeout)
+	}
+}
+
+// waitReady blocks until the process passes its health check, or accepts
+// requests on its port when the provision has no health endpoint.
+func waitReady(process *Process, exited chan interface{}) error {
+	provision := process.provision
+	client := &http.Client{Timeout: defaultHealthTimeout}
+	probe := func() bool {
+		res, err := client.Get(fmt.Sprintf("http://localhost:%v", process.port))
+		if err != nil {
+			return false
+		}
+		_ = res.Body.Close()
+		return true
+	}
+	threshold := 1
+	if provision.HealthEndpoint != "" {
+		monitor, err := newHealthMonitor(process.id, process.port, provision)
+		if err != nil {
+			return err
+		}
+		probe = func() bool {
+			return monitor.probe().Healthy
+		}
+		threshold = monitor.healthyThreshold
+	}
+
+	deadline := time.After(readyTimeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	successes := 0
+	for {
+		select {
+		case <-exited:
+			return fmt.Errorf("'%v' exited before becoming ready", process.id)
+		case <-deadline:
+			return fmt.Errorf("'%v' wasn't ready after %v", process.id, readyTimeout)
+		case <-ticker.C:
+		}
+
+		if !probe() {
+			successes = 0
+			continue
+		}
+		successes++
+		if successes >= threshold {
+			return nil
+		}
+	}
+}
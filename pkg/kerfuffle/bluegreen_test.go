@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"kerfuffle/pkg/proxy_handler"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestHelperServer isn't a real test, it's the provision launched by the tests
+// below. It serves the REVISION environment variable on APP_PORT.
+func TestHelperServer(t *testing.T) {
+	if os.Getenv("KERFUFFLE_HELPER_SERVER") != "1" {
+		t.Skip("helper process")
+	}
+	revision := os.Getenv("REVISION")
+	_ = http.ListenAndServe(":"+os.Getenv("APP_PORT"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// keep requests in flight for a while so draining matters
+		time.Sleep(time.Millisecond * 50)
+		_, _ = fmt.Fprint(w, revision)
+	}))
+	os.Exit(0)
+}
+
+func helperProvision(revision string) *Provision {
+	return &Provision{
+		Id:  "web",
+		Run: [][]string{{os.Args[0], "-test.run=^TestHelperServer$"}},
+		EnvironmentVariables: []string{
+			"KERFUFFLE_HELPER_SERVER=1",
+			"REVISION=" + revision,
+		},
+	}
+}
+
+func TestManager_ReloadProvision(t *testing.T) {
+	m := NewManager()
+	m.AppDataPath = t.TempDir()
+	m.HttpReverseProxyManager = proxy_handler.NewHttpReverseProxyManager()
+
+	app := NewApplication(&InstallConfiguration{Repository: "https://example.com/blue-green", Branch: "master"})
+	app.SetAppPath(m.AppDataPath)
+	app.provisions = map[string]*Provision{"web": helperProvision("blue")}
+	app.proxies = map[string]*Proxy{"web": {Host: []string{"bluegreen.local"}}}
+	app.cfs = map[string]*Cloudflare{}
+	m.applications[app.ID] = app
+	defer app.Shutdown()
+
+	if err := allocatePorts(app); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.bootstrapProxies(app); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.BootstrapProvisions(); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := m.HttpReverseProxyManager.Handler(false)
+	get := func() (int, string) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://bluegreen.local/", nil))
+		body, _ := ioutil.ReadAll(rec.Body)
+		return rec.Code, string(body)
+	}
+
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		if code, body := get(); code == http.StatusOK && body == "blue" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("blue revision never came up")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	var failures int64
+	stop := make(chan interface{})
+	done := make(chan interface{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if code, body := get(); code != http.StatusOK {
+				atomic.AddInt64(&failures, 1)
+				t.Logf("request failed during reload: %v %v", code, body)
+			}
+		}
+	}()
+
+	blue := app.GetProcess("web")
+	app.mu.Lock()
+	app.provisions["web"] = helperProvision("green")
+	app.mu.Unlock()
+	err := m.ReloadProvision(app.ID, "web")
+	close(stop)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if failures != 0 {
+		t.Errorf("%v requests failed during the reload", failures)
+	}
+	if _, body := get(); body != "green" {
+		t.Errorf("expected the green revision, got %q", body)
+	}
+	if blue.Alive() {
+		t.Error("blue revision should have been killed after draining")
+	}
+
+	// a host failing to swap puts the running revision back on the hosts already swapped
+	app.mu.Lock()
+	app.provisions["web"] = helperProvision("red")
+	app.proxies["web"].Host = append(app.proxies["web"].Host, "missing.local")
+	app.mu.Unlock()
+	if err := m.ReloadProvision(app.ID, "web"); err == nil {
+		t.Fatal("expected the reload to fail")
+	}
+	if code, body := get(); code != http.StatusOK || body != "green" {
+		t.Errorf("expected the green revision to keep serving, got %v %q", code, body)
+	}
+
+	// shutting down while the new revision boots kills it too
+	app.mu.Lock()
+	app.provisions["web"] = &Provision{Id: "web", Run: [][]string{{"sh", "-c", "sleep 30"}}}
+	app.proxies["web"].Host = app.proxies["web"].Host[:1]
+	app.mu.Unlock()
+	reloaded := make(chan error, 1)
+	go func() {
+		reloaded <- m.ReloadProvision(app.ID, "web")
+	}()
+	var pending *Process
+	for deadline := time.Now().Add(time.Second * 10); pending == nil || !pending.Alive(); {
+		if time.Now().After(deadline) {
+			t.Fatal("new revision never started")
+		}
+		time.Sleep(time.Millisecond * 50)
+		app.mu.RLock()
+		for process := range app.pending {
+			pending = process
+		}
+		app.mu.RUnlock()
+	}
+	app.Shutdown()
+	select {
+	case err := <-reloaded:
+		if err == nil {
+			t.Error("expected the reload to be aborted")
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("reload didn't notice the shutdown")
+	}
+	if pending.Alive() {
+		t.Error("pending revision should have been killed by the shutdown")
+	}
+}
@@ -6,6 +6,20 @@
 
 package kerfuffle
 
+import (
+	"fmt"
+	"html/template"
+	"kerfuffle/pkg/proxy_handler"
+	"kerfuffle/pkg/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const defaultStopTimeout = time.Second * 10
+
 type Meta struct {
 	Name string `toml:"name" json:"name"`
 }
@@ -17,12 +31,284 @@ type Provision struct {
 	Run                  [][]string `toml:"run" json:"run,omitempty"`
 	EnvironmentVariables []string   `toml:"envs" json:"environment_variables,omitempty"`
 	BaseDirectory        string     `toml:"base_dir" json:"base_directory,omitempty"`
+	Replicas             int        `toml:"replicas" json:"replicas,omitempty"`
+	HealthInterval       string     `toml:"health_interval" json:"health_interval,omitempty"`
+	HealthTimeout        string     `toml:"health_timeout" json:"health_timeout,omitempty"`
+	HealthyThreshold     int        `toml:"healthy_threshold" json:"healthy_threshold,omitempty"`
+	UnhealthyThreshold   int        `toml:"unhealthy_threshold" json:"unhealthy_threshold,omitempty"`
+	Restart              string     `toml:"restart" json:"restart,omitempty"`
+	MaxRetries           int        `toml:"max_retries" json:"max_retries,omitempty"`
+	RestartBackoff       string     `toml:"restart_backoff" json:"restart_backoff,omitempty"`
+	RestartMaxBackoff    string     `toml:"restart_max_backoff" json:"restart_max_backoff,omitempty"`
+	LogLines             int        `toml:"log_lines" json:"log_lines,omitempty"`
+	StopSignal           string     `toml:"stop_signal" json:"stop_signal,omitempty"`
+	StopTimeout          string     `toml:"stop_timeout" json:"stop_timeout,omitempty"`
+	DependsOn            []string   `toml:"depends_on" json:"depends_on,omitempty"`
+	// Job provisions run once, their dependents wait for them to exit successfully.
+	Job bool `toml:"job" json:"job,omitempty"`
+	// resource limits, applied through a cgroup v2 per replica on linux
+	MemoryMax string `toml:"memory_max" json:"memory_max,omitempty"`
+	CPUWeight int    `toml:"cpu_weight" json:"cpu_weight,omitempty"`
+	PidsMax   int    `toml:"pids_max" json:"pids_max,omitempty"`
+	IOWeight  int    `toml:"io_weight" json:"io_weight,omitempty"`
+
+	dependencies []*Dependency
+}
+
+// validate checks the values which can't be checked by the toml decoder.
+func (p *Provision) validate() error {
+	switch p.Restart {
+	case "", RestartAlways, RestartOnFailure, RestartNever:
+	default:
+		return fmt.Errorf("provision '%v' has an invalid restart policy '%v'", p.Id, p.Restart)
+	}
+	if p.Job && p.Restart == RestartAlways {
+		return fmt.Errorf("provision '%v' is a job, it can't always be restarted", p.Id)
+	}
+
+	for key, value := range map[string]string{
+		"health_interval":     p.HealthInterval,
+		"health_timeout":      p.HealthTimeout,
+		"restart_backoff":     p.RestartBackoff,
+		"restart_max_backoff": p.RestartMaxBackoff,
+		"stop_timeout":        p.StopTimeout,
+	} {
+		if value == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(value); err != nil {
+			return fmt.Errorf("provision '%v' has an invalid %v: %v", p.Id, key, err)
+		}
+	}
+
+	if p.StopSignal != "" {
+		if _, err := utils.ParseSignal(p.StopSignal); err != nil {
+			return fmt.Errorf("provision '%v' has an invalid stop_signal: %v", p.Id, err)
+		}
+	}
+
+	if p.MemoryMax != "" {
+		if _, err := utils.ParseSize(p.MemoryMax); err != nil {
+			return fmt.Errorf("provision '%v' has an invalid memory_max: %v", p.Id, err)
+		}
+	}
+	for key, weight := range map[string]int{"cpu_weight": p.CPUWeight, "io_weight": p.IOWeight} {
+		if weight < 0 || weight > 10000 {
+			return fmt.Errorf("provision '%v' has an invalid %v %v, it has to be between 1 and 10000", p.Id, key, weight)
+		}
+	}
+	if p.PidsMax < 0 {
+		return fmt.Errorf("provision '%v' has an invalid pids_max %v", p.Id, p.PidsMax)
+	}
+	return nil
+}
+
+// limits returns the resource limits of the provision, nil when it has none.
+func (p *Provision) limits() *utils.CgroupLimits {
+	limits := &utils.CgroupLimits{CPUWeight: p.CPUWeight, PidsMax: p.PidsMax, IOWeight: p.IOWeight}
+	limits.MemoryMax, _ = utils.ParseSize(p.MemoryMax)
+	if limits.Empty() {
+		return nil
+	}
+	return limits
+}
+
+// stopSignal returns the signal the provision is stopped with, SIGTERM by default.
+func (p *Provision) stopSignal() os.Signal {
+	if signal, err := utils.ParseSignal(p.StopSignal); err == nil {
+		return signal
+	}
+	return syscall.SIGTERM
+}
+
+func (p *Provision) stopTimeout() time.Duration {
+	return durationOr(p.StopTimeout, defaultStopTimeout)
+}
+
+// ReplicaCount returns the amount of copies of the provision that have to be running.
+func (p *Provision) ReplicaCount() int {
+	if p.Replicas < 1 {
+		return 1
+	}
+	return p.Replicas
 }
 
 type Proxy struct {
-	Host     []string `toml:"host" json:"host"`
-	BindPort string   `toml:"bind_port" json:"bind_port"`
-	Hold     bool     `json:"hold"`
+	Host          []string `toml:"host" json:"host"`
+	BindPort      string   `toml:"bind_port" json:"bind_port"`
+	RedirectHTTPS bool     `toml:"https_redirect" json:"https_redirect"`
+	Balance       string   `toml:"balance" json:"balance,omitempty"`
+	HashHeader    string   `toml:"hash_header" json:"hash_header,omitempty"`
+	HashCookie    string   `toml:"hash_cookie" json:"hash_cookie,omitempty"`
+	// Replicas can be set here instead of on the provision of the same name
+	Replicas int `toml:"replicas" json:"replicas,omitempty"`
+	// StripPrefix removes the path prefix of the hosts before the requests are forwarded,
+	// RewritePrefix replaces it instead
+	StripPrefix   bool   `toml:"strip_prefix" json:"strip_prefix,omitempty"`
+	RewritePrefix string `toml:"rewrite_prefix" json:"rewrite_prefix,omitempty"`
+	// limits of the requests, durations and sizes like the provision's
+	DialTimeout   string `toml:"dial_timeout" json:"dial_timeout,omitempty"`
+	ReadTimeout   string `toml:"read_timeout" json:"read_timeout,omitempty"`
+	WriteTimeout  string `toml:"write_timeout" json:"write_timeout,omitempty"`
+	IdleTimeout   string `toml:"idle_timeout" json:"idle_timeout,omitempty"`
+	FlushInterval string `toml:"flush_interval" json:"flush_interval,omitempty"`
+	MaxBodySize   string `toml:"max_body_size" json:"max_body_size,omitempty"`
+	// RateLimit is the amount of requests per second a client can make, up to RateLimitBurst at once
+	RateLimit              float64 `toml:"rate_limit" json:"rate_limit,omitempty"`
+	RateLimitBurst         int     `toml:"rate_limit_burst" json:"rate_limit_burst,omitempty"`
+	RateLimitMessage       string  `toml:"rate_limit_message" json:"rate_limit_message,omitempty"`
+	MaxConcurrent          int     `toml:"max_concurrent" json:"max_concurrent,omitempty"`
+	MaxConcurrentPerClient int     `toml:"max_concurrent_per_client" json:"max_concurrent_per_client,omitempty"`
+	// Access restricts who can reach the proxy, it can be replaced through the API
+	Access *ProxyAccess `toml:"access" json:"access,omitempty"`
+	// DisableAccessLog keeps the requests of the proxy out of the access logs
+	DisableAccessLog bool `toml:"disable_access_log" json:"disable_access_log,omitempty"`
+	Hold             bool `json:"hold"`
+	// Ports holds the port of every replica, the first one is always BindPort.
+	Ports []string `toml:"-" json:"ports,omitempty"`
+}
+
+// validate checks the values which can't be checked by the toml decoder.
+func (p *Proxy) validate(id string) error {
+	for key, value := range map[string]string{
+		"dial_timeout":   p.DialTimeout,
+		"read_timeout":   p.ReadTimeout,
+		"write_timeout":  p.WriteTimeout,
+		"idle_timeout":   p.IdleTimeout,
+		"flush_interval": p.FlushInterval,
+	} {
+		if value == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(value); err != nil {
+			return fmt.Errorf("proxy '%v' has an invalid %v: %v", id, key, err)
+		}
+	}
+	if p.MaxBodySize != "" {
+		if _, err := utils.ParseSize(p.MaxBodySize); err != nil {
+			return fmt.Errorf("proxy '%v' has an invalid max_body_size: %v", id, err)
+		}
+	}
+	if p.RateLimit < 0 {
+		return fmt.Errorf("proxy '%v' has an invalid rate_limit %v", id, p.RateLimit)
+	}
+	for key, value := range map[string]int{
+		"rate_limit_burst":          p.RateLimitBurst,
+		"max_concurrent":            p.MaxConcurrent,
+		"max_concurrent_per_client": p.MaxConcurrentPerClient,
+	} {
+		if value < 0 {
+			return fmt.Errorf("proxy '%v' has an invalid %v %v", id, key, value)
+		}
+	}
+	if err := p.Access.control().Validate(); err != nil {
+		return fmt.Errorf("proxy '%v' has an invalid access control: %v", id, err)
+	}
+	if p.Replicas < 0 {
+		return fmt.Errorf("proxy '%v' has an invalid replicas %v", id, p.Replicas)
+	}
+	return nil
+}
+
+// applyReplicas moves the replicas of the proxy to the provision of the same name,
+// it's the provision which is replicated.
+func (p *Proxy) applyReplicas(id string, provision *Provision) error {
+	switch {
+	case p.Replicas == 0:
+	case provision == nil:
+		return fmt.Errorf("proxy '%v' sets replicas but there's no provision '%v' to replicate", id, id)
+	case provision.Replicas != 0 && provision.Replicas != p.Replicas:
+		return fmt.Errorf("proxy '%v' sets %v replicas but its provision sets %v", id, p.Replicas, provision.Replicas)
+	default:
+		provision.Replicas = p.Replicas
+	}
+	return nil
+}
+
+func (p *Proxy) rateLimit() proxy_handler.RateLimit {
+	return proxy_handler.RateLimit{
+		Rate:                   p.RateLimit,
+		Burst:                  p.RateLimitBurst,
+		MaxConcurrent:          p.MaxConcurrent,
+		MaxConcurrentPerClient: p.MaxConcurrentPerClient,
+		Message:                p.RateLimitMessage,
+	}
+}
+
+// limits returns the limits of the proxy's routes, unset values are unbounded.
+func (p *Proxy) limits() proxy_handler.RouteLimits {
+	limits := proxy_handler.RouteLimits{
+		DialTimeout:  durationOr(p.DialTimeout, 0),
+		ReadTimeout:  durationOr(p.ReadTimeout, 0),
+		WriteTimeout: durationOr(p.WriteTimeout, 0),
+		IdleTimeout:  durationOr(p.IdleTimeout, 0),
+	}
+	// a negative flush interval flushes after every write
+	limits.FlushInterval, _ = time.ParseDuration(p.FlushInterval)
+	limits.MaxBodySize, _ = utils.ParseSize(p.MaxBodySize)
+	return limits
+}
+
+// ProxyAccess is the access control of a proxy, see proxy_handler.AccessControl.
+type ProxyAccess struct {
+	Allow              []string `toml:"allow" json:"allow,omitempty"`
+	Deny               []string `toml:"deny" json:"deny,omitempty"`
+	BasicAuth          []string `toml:"basic_auth" json:"basic_auth,omitempty"`
+	Realm              string   `toml:"realm" json:"realm,omitempty"`
+	ForwardAuth        string   `toml:"forward_auth" json:"forward_auth,omitempty"`
+	ForwardAuthHeaders []string `toml:"forward_auth_headers" json:"forward_auth_headers,omitempty"`
+}
+
+func (a *ProxyAccess) control() *proxy_handler.AccessControl {
+	if a == nil {
+		return nil
+	}
+	return &proxy_handler.AccessControl{
+		Allow:              a.Allow,
+		Deny:               a.Deny,
+		BasicAuth:          a.BasicAuth,
+		Realm:              a.Realm,
+		ForwardAuth:        a.ForwardAuth,
+		ForwardAuthHeaders: a.ForwardAuthHeaders,
+	}
+}
+
+// Pages are the application's own maintenance and error pages, as paths relative to
+// the application. They're html/template files executed with proxy_handler.PageData.
+type Pages struct {
+	Maintenance string `toml:"maintenance" json:"maintenance,omitempty"`
+	NotFound    string `toml:"not_found" json:"not_found,omitempty"`
+	BadGateway  string `toml:"bad_gateway" json:"bad_gateway,omitempty"`
+}
+
+// load parses the pages, nil is returned when the application has none.
+func (p *Pages) load(appPath, app string) (*proxy_handler.ErrorPages, error) {
+	if p == nil || p.Maintenance == "" && p.NotFound == "" && p.BadGateway == "" {
+		return nil, nil
+	}
+	pages := &proxy_handler.ErrorPages{App: app}
+	for key, page := range map[string]struct {
+		path     string
+		template **template.Template
+	}{
+		"maintenance": {p.Maintenance, &pages.Maintenance},
+		"not_found":   {p.NotFound, &pages.NotFound},
+		"bad_gateway": {p.BadGateway, &pages.BadGateway},
+	} {
+		if page.path == "" {
+			continue
+		}
+		path := filepath.Clean(page.path)
+		if filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("page %v '%v' is outside of the application", key, page.path)
+		}
+		t, err := template.ParseFiles(filepath.Join(appPath, path))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v page: %v", key, err)
+		}
+		*page.template = t
+	}
+	return pages, nil
 }
 
 type Cloudflare struct {
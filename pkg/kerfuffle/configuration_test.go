@@ -0,0 +1,48 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProxy_ApplyReplicas(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		proxy     int
+		provision *Provision
+		replicas  int
+		err       string
+	}{
+		{"unset", 0, &Provision{Replicas: 2}, 2, ""},
+		{"on the proxy", 3, &Provision{}, 3, ""},
+		{"on both", 3, &Provision{Replicas: 3}, 3, ""},
+		{"disagreeing", 3, &Provision{Replicas: 2}, 0, "its provision sets 2"},
+		{"without a provision", 3, nil, 0, "no provision"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := &Proxy{Replicas: test.proxy}
+			err := proxy.applyReplicas("web", test.provision)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count := test.provision.ReplicaCount(); count != test.replicas {
+				t.Errorf("expected %v replicas, got %v", test.replicas, count)
+			}
+		})
+	}
+	if err := (&Proxy{Replicas: -1}).validate("web"); err == nil {
+		t.Error("expected negative replicas to be rejected")
+	}
+}
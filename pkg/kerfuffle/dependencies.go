@@ -0,0 +1,243 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"strings"
+)
+
+const (
+	// ConditionStarted waits until every replica of the dependency is running.
+	ConditionStarted = "started"
+	// ConditionHealthy waits until every replica passed its health check.
+	ConditionHealthy = "healthy"
+	// ConditionCompleted waits until a job exited successfully.
+	ConditionCompleted = "completed"
+)
+
+var (
+	errSchedulingCanceled = errors.New("scheduling canceled")
+)
+
+type Dependency struct {
+	Target    string `json:"target"`
+	Condition string `json:"condition"`
+}
+
+func (d *Dependency) String() string {
+	return d.Target + ":" + d.Condition
+}
+
+// resolveDependencies parses the depends_on entries of the provisions, which are
+// either "<provision>" or "<provision>:<condition>". Without a condition jobs have to
+// complete, provisions with a health endpoint have to be healthy and the rest started.
+func resolveDependencies(provisions map[string]*Provision) error {
+	for id, provision := range provisions {
+		provision.dependencies = nil
+		if id == "init" && len(provision.DependsOn) != 0 {
+			return errors.New("provision 'init' always runs first, it can't depend on other provisions")
+		}
+		for _, entry := range provision.DependsOn {
+			parts := strings.SplitN(entry, ":", 2)
+			dependency := &Dependency{Target: parts[0]}
+			target, exists := provisions[dependency.Target]
+			if !exists {
+				return fmt.Errorf("provision '%v' depends on '%v' which doesn't exist", id, dependency.Target)
+			}
+			// everything waits for init already
+			if dependency.Target == "init" {
+				continue
+			}
+
+			switch {
+			case len(parts) == 2:
+				dependency.Condition = parts[1]
+			case target.Job:
+				dependency.Condition = ConditionCompleted
+			case target.HealthEndpoint != "":
+				dependency.Condition = ConditionHealthy
+			default:
+				dependency.Condition = ConditionStarted
+			}
+			switch dependency.Condition {
+			case ConditionStarted:
+			case ConditionHealthy:
+				if target.HealthEndpoint == "" {
+					return fmt.Errorf("provision '%v' waits for '%v' to be healthy but it has no health_endpoint", id, dependency.Target)
+				}
+			case ConditionCompleted:
+				if !target.Job {
+					return fmt.Errorf("provision '%v' waits for '%v' to complete but it isn't a job", id, dependency.Target)
+				}
+			default:
+				return fmt.Errorf("provision '%v' has an invalid condition '%v', use started, healthy or completed", id, dependency.Condition)
+			}
+			provision.dependencies = append(provision.dependencies, dependency)
+		}
+	}
+	return findCycle(provisions)
+}
+
+// findCycle returns an error describing the first dependency cycle it finds.
+func findCycle(provisions map[string]*Provision) error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	var path []string
+	var visit func(id string) error
+	visit = func(id string) error {
+		switch state[id] {
+		case visited:
+			return nil
+		case visiting:
+			for i, p := range path {
+				if p == id {
+					return fmt.Errorf("provisions depend on each other: %v", strings.Join(append(path[i:], id), " -> "))
+				}
+			}
+		}
+		state[id] = visiting
+		path = append(path, id)
+		for _, dependency := range provisions[id].dependencies {
+			if err := visit(dependency.Target); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[id] = visited
+		return nil
+	}
+
+	// sorted so the same configuration always reports the same cycle
+	var ids []string
+	for id := range provisions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if err := visit(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// provisionRun is a provision launched by the scheduler, its dependents wait on it.
+type provisionRun struct {
+	// spawned is closed once the processes exist, abandoned when they never will.
+	spawned   chan interface{}
+	abandoned chan interface{}
+	processes []*Process
+	monitors  []*healthMonitor
+}
+
+// scheduleProvisions launches every provision once its dependencies are met.
+func (a *Application) scheduleProvisions(provisions map[string]*Provision) {
+	cancel := make(chan interface{})
+	a.scheduleLock.Lock()
+	a.scheduleCancel = cancel
+	a.scheduleLock.Unlock()
+
+	runs := map[string]*provisionRun{}
+	for target := range provisions {
+		runs[target] = &provisionRun{spawned: make(chan interface{}), abandoned: make(chan interface{})}
+	}
+	for target, provision := range provisions {
+		target, provision := target, provision
+		go func() {
+			run := runs[target]
+			for _, dependency := range provision.dependencies {
+				err := waitForDependency(runs[dependency.Target], dependency, cancel)
+				if err == errSchedulingCanceled {
+					close(run.abandoned)
+					return
+				}
+				if err != nil {
+					log.Err(err).Str("app", a.ID).Str("target", target).Msg("dependency failed")
+					a.setStatus(StatusFailed, fmt.Sprintf("Provision '%v' wasn't started: %v", target, err))
+					close(run.abandoned)
+					return
+				}
+			}
+
+			// Shutdown cancels under the same lock, so nothing is spawned after it
+			a.scheduleLock.Lock()
+			defer a.scheduleLock.Unlock()
+			select {
+			case <-cancel:
+				close(run.abandoned)
+				return
+			default:
+			}
+			run.processes = a.spawnProvision(provision, target)
+			run.monitors = a.startHealthChecks(provision, target)
+			close(run.spawned)
+		}()
+	}
+}
+
+// waitForDependency blocks until every replica of the dependency meets the condition.
+func waitForDependency(run *provisionRun, dependency *Dependency, cancel chan interface{}) error {
+	select {
+	case <-run.spawned:
+	case <-run.abandoned:
+		return fmt.Errorf("'%v' wasn't started", dependency.Target)
+	case <-cancel:
+		return errSchedulingCanceled
+	}
+
+	for i, process := range run.processes {
+		var reached chan interface{}
+		switch dependency.Condition {
+		case ConditionStarted:
+			reached = process.started
+		case ConditionHealthy:
+			if i >= len(run.monitors) || run.monitors[i] == nil {
+				return fmt.Errorf("'%v' has no health check", process.id)
+			}
+			reached = run.monitors[i].becameHealthy
+		case ConditionCompleted:
+			reached = process.finished
+		}
+
+		select {
+		case <-reached:
+		case <-process.finished:
+			// the process might have reached the condition right before exiting
+			select {
+			case <-reached:
+			default:
+				return fmt.Errorf("'%v' exited before it was %v: %v", process.id, dependency.Condition, process.getResult())
+			}
+		case <-cancel:
+			return errSchedulingCanceled
+		}
+		if dependency.Condition == ConditionCompleted {
+			if err := process.getResult(); err != nil || process.isStopped() {
+				return fmt.Errorf("job '%v' didn't complete: %v", process.id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// stopScheduling abandons the provisions which are still waiting on their dependencies.
+func (a *Application) stopScheduling() {
+	a.scheduleLock.Lock()
+	defer a.scheduleLock.Unlock()
+	if a.scheduleCancel != nil {
+		close(a.scheduleCancel)
+		a.scheduleCancel = nil
+	}
+}
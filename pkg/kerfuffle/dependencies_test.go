@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveDependencies(t *testing.T) {
+	tests := []struct {
+		name       string
+		provisions map[string]*Provision
+		err        string
+	}{
+		{"defaults", map[string]*Provision{
+			"init":    {},
+			"db":      {HealthEndpoint: "/health"},
+			"migrate": {Job: true, DependsOn: []string{"db"}},
+			"worker":  {},
+			"web":     {DependsOn: []string{"init", "migrate", "worker", "db:started"}},
+		}, ""},
+		{"cycle", map[string]*Provision{
+			"a": {DependsOn: []string{"b"}},
+			"b": {DependsOn: []string{"c"}},
+			"c": {DependsOn: []string{"a"}},
+		}, "a -> b -> c -> a"},
+		{"unknown", map[string]*Provision{"a": {DependsOn: []string{"b"}}}, "doesn't exist"},
+		{"not a job", map[string]*Provision{"a": {DependsOn: []string{"b:completed"}}, "b": {}}, "isn't a job"},
+		{"no health check", map[string]*Provision{"a": {DependsOn: []string{"b:healthy"}}, "b": {}}, "no health_endpoint"},
+		{"invalid condition", map[string]*Provision{"a": {DependsOn: []string{"b:ready"}}, "b": {}}, "invalid condition"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := resolveDependencies(tt.provisions)
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+
+	provisions := tests[0].provisions
+	var web []string
+	for _, dependency := range provisions["web"].dependencies {
+		web = append(web, dependency.String())
+	}
+	if strings.Join(web, " ") != "migrate:completed worker:started db:started" {
+		t.Errorf("unexpected dependencies %v", web)
+	}
+	if provisions["migrate"].dependencies[0].Condition != ConditionHealthy {
+		t.Errorf("provisions with a health endpoint should have to be healthy")
+	}
+}
+
+func TestApplication_ScheduleProvisions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	app := NewApplication(&InstallConfiguration{Repository: "https://example.com/dependencies", Branch: "master"})
+	app.SetAppPath(t.TempDir())
+	app.provisions = map[string]*Provision{
+		"migrate": {Job: true, Run: [][]string{{"sh", "-c", "sleep 0.2; echo migrated > state"}}},
+		"web":     {DependsOn: []string{"migrate"}, Run: [][]string{{"sh", "-c", "cat state; sleep 60"}}},
+		"broken":  {Job: true, Run: [][]string{{"sh", "-c", "exit 1"}}},
+		"never":   {DependsOn: []string{"broken"}, Run: [][]string{{"sh", "-c", "sleep 60"}}},
+	}
+	app.proxies = map[string]*Proxy{}
+	if err := resolveDependencies(app.provisions); err != nil {
+		t.Fatal(err)
+	}
+	defer app.Shutdown()
+	if err := app.BootstrapProvisions(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		web := app.GetProcess("web")
+		if web != nil && strings.Contains(web.Output().String(StreamStdout), "migrated") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("web should have started after the migration")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	for {
+		failed := false
+		for _, status := range app.GetStatuses() {
+			failed = failed || strings.Contains(status.Reason, "'never' wasn't started")
+		}
+		if failed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("never should have been abandoned after broken failed")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	if app.GetProcess("never") != nil {
+		t.Error("never shouldn't have been started")
+	}
+}
@@ -0,0 +1,255 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"kerfuffle/pkg/cloudflare"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrDeployInProgress = errors.New("a deploy is already in progress")
+)
+
+var (
+	StatusDeploying = "deploying"
+)
+
+// stoppedError is a deploy which failed after the running revision was stopped,
+// the application is down until a revision deploys successfully.
+type stoppedError struct {
+	err error
+}
+
+func (e *stoppedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stoppedError) Unwrap() error {
+	return e.err
+}
+
+// git runs a git command inside the application's working tree.
+func (a *Application) git(args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = a.appPath
+	b, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", strings.TrimSpace(string(b)), err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (a *Application) IsDeploying() bool {
+	return atomic.LoadInt32(&a.deploying) == 1
+}
+
+// Redeploy fetches the latest revision of the application's branch and deploys it.
+func (m *Manager) Redeploy(id string) error {
+	app := m.GetApplication(id)
+	if app == nil {
+		return ErrNotFound
+	}
+	if !atomic.CompareAndSwapInt32(&app.deploying, 0, 1) {
+		return ErrDeployInProgress
+	}
+	defer atomic.StoreInt32(&app.deploying, 0)
+
+	started := time.Now()
+	previous, err := app.git("rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	err = m.redeploy(app)
+	m.recordRelease(app, TriggerRedeploy, err)
+	observeDeploy(app, TriggerRedeploy, started, err)
+	if err != nil {
+		log.Err(err).Str("app", app.ID).Msg("redeploy failed")
+		app.setStatus(StatusFailed, fmt.Sprintf("Redeploy failed: %v", err))
+		var stopped *stoppedError
+		if errors.As(err, &stopped) {
+			m.restore(app, previous)
+		}
+	}
+	return err
+}
+
+// restore brings the previous revision back up after a deploy failed with the
+// application stopped, so it isn't left down.
+func (m *Manager) restore(app *Application, commit string) {
+	app.setStatus(StatusDeploying, fmt.Sprintf("Restoring the previous revision '%.7v'", commit))
+	_, err := app.git("reset", "--hard", commit)
+	if err == nil {
+		err = m.deploy(app)
+	}
+	if err != nil {
+		log.Err(err).Str("app", app.ID).Str("commit", commit).Msg("failed to restore the previous revision")
+		app.setStatus(StatusFailed, fmt.Sprintf("Restoring '%.7v' failed, the application is down: %v", commit, err))
+	}
+}
+
+func (m *Manager) redeploy(app *Application) error {
+	config := app.InstallConfiguration
+	app.setStatus(StatusDeploying, fmt.Sprintf("Fetching '%v' from %v", config.Branch, config.Repository))
+	_, err := app.git("fetch", "origin", config.Branch)
+	if err != nil {
+		return err
+	}
+	_, err = app.git("reset", "--hard", "FETCH_HEAD")
+	if err != nil {
+		return err
+	}
+	return m.deploy(app)
+}
+
+// deploy restarts the application from whatever is checked out in its working tree,
+// reconciling the proxy routes and cloudflare records against the new configuration.
+func (m *Manager) deploy(app *Application) (err error) {
+	commit, err := app.git("log", "-n", "1", "--format=%h %s")
+	if err != nil {
+		return err
+	}
+
+	app.setStatus(StatusDeploying, fmt.Sprintf("Reloading configuration at '%v'", commit))
+	proxies, cfs := app.GetAllProxies(), app.GetAllCfs()
+	// the previous configuration keeps running when the new one is invalid
+	err = app.BootstrapConfigs()
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+
+	app.setStatus(StatusDeploying, "Stopping processes")
+	defer func() {
+		if err != nil {
+			err = &stoppedError{err}
+		}
+	}()
+	app.Shutdown()
+	app.mu.Lock()
+	app.process = map[string]*Process{}
+	app.mu.Unlock()
+
+	app.setStatus(StatusDeploying, "Reconciling proxy routes")
+	m.uninstallProxies(proxies)
+	err = allocatePorts(app)
+	if err != nil {
+		return err
+	}
+	err = m.bootstrapProxies(app)
+	if err != nil {
+		return err
+	}
+	if maintenance := app.GetMaintenance(); maintenance != nil {
+		err = m.SetAppMaintenance(app.ID, maintenance)
+		if err != nil {
+			return err
+		}
+	}
+
+	app.setStatus(StatusDeploying, "Reconciling cloudflare records")
+	err = m.reconcileCloudflare(cfs, app.GetAllCfs())
+	if err != nil {
+		return err
+	}
+
+	app.setStatus(StatusDeploying, "Running provisions")
+	return app.BootstrapProvisions()
+}
+
+func (m *Manager) uninstallProxies(proxies map[string]*Proxy) {
+	for _, proxy := range proxies {
+		for _, host := range proxy.Host {
+			err := m.HttpReverseProxyManager.UninstallRoute(host)
+			if err != nil {
+				log.Err(err).Str("route", host).Msg("failed to uninstall route")
+			}
+		}
+	}
+}
+
+// reconcileCloudflare removes the records which are no longer configured and
+// installs the ones that are new or changed.
+func (m *Manager) reconcileCloudflare(previous, current map[string]*Cloudflare) error {
+	wanted := map[string]bool{}
+	for _, cf := range current {
+		for _, host := range cf.Host {
+			wanted[cf.Zone+"/"+host] = true
+		}
+	}
+
+	m.forgetCloudflare(previous)
+	for _, cf := range previous {
+		for _, host := range cf.Host {
+			if wanted[cf.Zone+"/"+host] {
+				continue
+			}
+			err := m.UninstallCloudflareRecord(cf.Zone, host)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for key, cf := range current {
+		if old, exists := previous[key]; exists && fmt.Sprintf("%v", old) == fmt.Sprintf("%v", cf) {
+			m.cfLock.Lock()
+			m.installedCf = append(m.installedCf, cf)
+			m.cfLock.Unlock()
+			continue
+		}
+		err := m.InstallCloudflareConfiguration(cf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UninstallCloudflareRecord removes the A record of the host from the zone.
+func (m *Manager) UninstallCloudflareRecord(zone, host string) error {
+	// do nothing on example domains
+	if zone == "example.com" {
+		return nil
+	}
+
+	token, err := m.cloudflareToken(zone)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("zone", zone).Str("host", host).Msg("removing cloudflare record")
+	started := time.Now()
+	err = cloudflare.
+		AutoCloudflare(token).
+		SetZone(zone).
+		SetDomain(host).
+		CheckAndClearRecords()
+	observeCloudflare(CloudflareUninstall, started, err)
+	return err
+}
+
+// forgetCloudflare drops the configurations from the list of installed ones.
+func (m *Manager) forgetCloudflare(cfs map[string]*Cloudflare) {
+	m.cfLock.Lock()
+	defer m.cfLock.Unlock()
+	var installed []*Cloudflare
+	for _, c := range m.installedCf {
+		forget := false
+		for _, cf := range cfs {
+			forget = forget || c == cf
+		}
+		if !forget {
+			installed = append(installed, c)
+		}
+	}
+	m.installedCf = installed
+}
@@ -0,0 +1,263 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthInterval     = time.Second * 10
+	defaultHealthTimeout      = time.Second * 5
+	defaultHealthyThreshold   = 1
+	defaultUnhealthyThreshold = 3
+
+	// healthHistorySize is the amount of checks kept per process
+	healthHistorySize = 100
+)
+
+type HealthCheck struct {
+	At         time.Time `json:"at"`
+	Healthy    bool      `json:"healthy"`
+	StatusCode int       `json:"status_code,omitempty"`
+	LatencyMs  int64     `json:"latency_ms"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type HealthReport struct {
+	Endpoint string         `json:"endpoint"`
+	Healthy  bool           `json:"healthy"`
+	History  []*HealthCheck `json:"history"`
+}
+
+// healthMonitor periodically probes the health endpoint of a single provision replica.
+type healthMonitor struct {
+	sync.Mutex
+	id                 string
+	url                string
+	interval           time.Duration
+	unhealthyThreshold int
+	healthyThreshold   int
+	client             *http.Client
+
+	healthy   bool
+	successes int
+	failures  int
+	history   []*HealthCheck
+	stop      chan interface{}
+	// becameHealthy is closed the first time the monitor turns healthy
+	becameHealthy chan interface{}
+}
+
+func newHealthMonitor(id, port string, provision *Provision) (*healthMonitor, error) {
+	endpoint := provision.HealthEndpoint
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		if port == "" {
+			return nil, fmt.Errorf("provision '%v' has a relative health endpoint but isn't proxied", id)
+		}
+		endpoint = fmt.Sprintf("http://localhost:%v/%v", port, strings.TrimPrefix(endpoint, "/"))
+	}
+
+	monitor := &healthMonitor{
+		id:                 id,
+		url:                endpoint,
+		interval:           durationOr(provision.HealthInterval, defaultHealthInterval),
+		healthyThreshold:   provision.HealthyThreshold,
+		unhealthyThreshold: provision.UnhealthyThreshold,
+		client: &http.Client{
+			Timeout: durationOr(provision.HealthTimeout, defaultHealthTimeout),
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		history:       []*HealthCheck{},
+		stop:          make(chan interface{}),
+		becameHealthy: make(chan interface{}),
+	}
+	if monitor.healthyThreshold < 1 {
+		monitor.healthyThreshold = defaultHealthyThreshold
+	}
+	if monitor.unhealthyThreshold < 1 {
+		monitor.unhealthyThreshold = defaultUnhealthyThreshold
+	}
+	return monitor, nil
+}
+
+func (h *healthMonitor) probe() *HealthCheck {
+	check := &HealthCheck{At: time.Now()}
+	res, err := h.client.Get(h.url)
+	check.LatencyMs = time.Since(check.At).Milliseconds()
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	_ = res.Body.Close()
+	check.StatusCode = res.StatusCode
+	check.Healthy = res.StatusCode >= 200 && res.StatusCode < 400
+	if !check.Healthy {
+		check.Error = res.Status
+	}
+	return check
+}
+
+// record stores the check and returns true when the health state of the monitor flipped.
+func (h *healthMonitor) record(check *HealthCheck) bool {
+	h.Lock()
+	defer h.Unlock()
+	h.history = append(h.history, check)
+	if len(h.history) > healthHistorySize {
+		h.history = h.history[len(h.history)-healthHistorySize:]
+	}
+
+	if check.Healthy {
+		h.successes++
+		h.failures = 0
+		if !h.healthy && h.successes >= h.healthyThreshold {
+			h.healthy = true
+			select {
+			case <-h.becameHealthy:
+			default:
+				close(h.becameHealthy)
+			}
+			return true
+		}
+		return false
+	}
+
+	h.failures++
+	h.successes = 0
+	if h.healthy && h.failures >= h.unhealthyThreshold {
+		h.healthy = false
+		return true
+	}
+	return false
+}
+
+func (h *healthMonitor) isHealthy() bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.healthy
+}
+
+func (h *healthMonitor) report() *HealthReport {
+	h.Lock()
+	defer h.Unlock()
+	history := make([]*HealthCheck, len(h.history))
+	copy(history, h.history)
+	return &HealthReport{Endpoint: h.url, Healthy: h.healthy, History: history}
+}
+
+func (h *healthMonitor) run(a *Application) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+
+		check := h.probe()
+		if !h.record(check) {
+			continue
+		}
+		if check.Healthy {
+			log.Info().Str("app", a.ID).Str("id", h.id).Msg("provision is healthy")
+			a.checkHealthRecovered()
+		} else {
+			log.Warn().Str("app", a.ID).Str("id", h.id).Str("error", check.Error).Msg("provision is unhealthy")
+			a.setStatus(StatusUnhealthy, fmt.Sprintf("Provision '%v' failed %v health checks: %v", h.id, h.unhealthyThreshold, check.Error))
+		}
+	}
+}
+
+// startHealthChecks launches a monitor for every replica of the provision if it has a health endpoint.
+func (a *Application) startHealthChecks(provision *Provision, target string) []*healthMonitor {
+	if provision.HealthEndpoint == "" {
+		return nil
+	}
+	var monitors []*healthMonitor
+	for i := 0; i < provision.ReplicaCount(); i++ {
+		monitors = append(monitors, a.startHealthCheck(provision, replicaId(target, i), a.replicaPort(target, i)))
+	}
+	return monitors
+}
+
+// startHealthCheck (re)starts the monitor of a single replica.
+func (a *Application) startHealthCheck(provision *Provision, id, port string) *healthMonitor {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if previous, exists := a.health[id]; exists {
+		close(previous.stop)
+		delete(a.health, id)
+	}
+	monitor, err := newHealthMonitor(id, port, provision)
+	if err != nil {
+		log.Err(err).Str("app", a.ID).Msg("skipping health checks")
+		return nil
+	}
+	a.health[id] = monitor
+	go monitor.run(a)
+	return monitor
+}
+
+func (a *Application) stopHealthChecks() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id, monitor := range a.health {
+		close(monitor.stop)
+		delete(a.health, id)
+	}
+}
+
+// checkHealthRecovered flips an unhealthy application back to running once every monitor is healthy.
+func (a *Application) checkHealthRecovered() {
+	for _, monitor := range a.healthMonitors() {
+		if !monitor.isHealthy() {
+			return
+		}
+	}
+	if status := a.GetStatus(); status != nil && status.Flag == StatusUnhealthy {
+		a.setStatus(StatusRunning, "Application passed its health checks")
+	}
+}
+
+func (a *Application) GetHealthReports() map[string]*HealthReport {
+	reports := map[string]*HealthReport{}
+	for id, monitor := range a.healthMonitors() {
+		reports[id] = monitor.report()
+	}
+	return reports
+}
+
+func (a *Application) healthMonitors() map[string]*healthMonitor {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	monitors := map[string]*healthMonitor{}
+	for id, monitor := range a.health {
+		monitors[id] = monitor
+	}
+	return monitors
+}
+
+// durationOr parses a duration from the configuration, invalid or empty values
+// fall back to the default.
+func durationOr(value string, fallback time.Duration) time.Duration {
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return fallback
+	}
+	return d
+}
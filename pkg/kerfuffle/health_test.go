@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// healthBackend answers its health endpoint with whatever status is stored in it.
+func healthBackend(t *testing.T) (*httptest.Server, *int32) {
+	status := int32(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	t.Cleanup(server.Close)
+	return server, &status
+}
+
+func TestHealthMonitor_Thresholds(t *testing.T) {
+	server, status := healthBackend(t)
+	port := server.Listener.Addr().String()[strings.LastIndex(server.Listener.Addr().String(), ":")+1:]
+	monitor, err := newHealthMonitor("web", port, &Provision{HealthEndpoint: "/health", HealthyThreshold: 2, UnhealthyThreshold: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := func(expected int, flipped, healthy bool) {
+		t.Helper()
+		check := monitor.probe()
+		if check.StatusCode != expected {
+			t.Fatalf("expected a %v, got %+v", expected, check)
+		}
+		if monitor.record(check) != flipped || monitor.isHealthy() != healthy {
+			t.Fatalf("expected flipped=%v healthy=%v after a %v", flipped, healthy, expected)
+		}
+	}
+
+	// two successes are needed to turn healthy
+	step(http.StatusOK, false, false)
+	step(http.StatusOK, true, true)
+	step(http.StatusOK, false, true)
+
+	// three failures in a row to turn unhealthy, a success in between starts over
+	atomic.StoreInt32(status, http.StatusServiceUnavailable)
+	step(http.StatusServiceUnavailable, false, true)
+	step(http.StatusServiceUnavailable, false, true)
+	atomic.StoreInt32(status, http.StatusOK)
+	step(http.StatusOK, false, true)
+	atomic.StoreInt32(status, http.StatusServiceUnavailable)
+	step(http.StatusServiceUnavailable, false, true)
+	step(http.StatusServiceUnavailable, false, true)
+	step(http.StatusServiceUnavailable, true, false)
+
+	// redirects are healthy, they aren't followed
+	atomic.StoreInt32(status, http.StatusFound)
+	step(http.StatusFound, false, false)
+	step(http.StatusFound, true, true)
+
+	// the history only keeps the latest checks
+	for i := 0; i < healthHistorySize+50; i++ {
+		monitor.record(&HealthCheck{At: time.Now(), Healthy: true, StatusCode: i})
+	}
+	history := monitor.report().History
+	if len(history) != healthHistorySize || history[len(history)-1].StatusCode != healthHistorySize+49 {
+		t.Errorf("expected the latest %v checks, got %v ending with %+v", healthHistorySize, len(history), history[len(history)-1])
+	}
+}
+
+func TestApplication_HealthChecks(t *testing.T) {
+	server, status := healthBackend(t)
+	app := NewApplication(&InstallConfiguration{Repository: "https://example.com/health", Branch: "master"})
+	app.setStatus(StatusRunning, "Application is running")
+	provision := &Provision{
+		HealthEndpoint:     server.URL + "/health",
+		HealthInterval:     "10ms",
+		UnhealthyThreshold: 2,
+	}
+	if app.startHealthCheck(provision, "web", "") == nil {
+		t.Fatal("expected the health check to start")
+	}
+	defer app.stopHealthChecks()
+
+	waitStatus := func(flag string) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second * 5)
+		for app.GetStatus().Flag != flag {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the application to be %v, got %+v", flag, app.GetStatus())
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	// the monitor has to have turned healthy before it can turn unhealthy
+	deadline := time.Now().Add(time.Second * 5)
+	for !app.healthMonitors()["web"].isHealthy() {
+		if time.Now().After(deadline) {
+			t.Fatal("the monitor never turned healthy")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	atomic.StoreInt32(status, http.StatusInternalServerError)
+	waitStatus(StatusUnhealthy)
+	atomic.StoreInt32(status, http.StatusOK)
+	waitStatus(StatusRunning)
+	// the API serves the reports as they are
+	b, err := json.Marshal(app.GetHealthReports())
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.stopHealthChecks()
+
+	// a single status is appended on each switch, not on every check
+	var flags []string
+	for _, s := range app.GetStatuses() {
+		flags = append(flags, s.Flag)
+	}
+	if strings.Join(flags, ",") != strings.Join([]string{StatusRunning, StatusUnhealthy, StatusRunning}, ",") {
+		t.Errorf("unexpected statuses %v", flags)
+	}
+	if statuses := app.GetStatuses(); !strings.Contains(statuses[1].Reason, "failed 2 health checks: 500") {
+		t.Errorf("unexpected reason %q", statuses[1].Reason)
+	}
+
+	reports := map[string]*HealthReport{}
+	if err := json.Unmarshal(b, &reports); err != nil {
+		t.Fatal(err)
+	}
+	report, exists := reports["web"]
+	if !exists || report.Endpoint != provision.HealthEndpoint || !report.Healthy {
+		t.Fatalf("unexpected reports %s", b)
+	}
+	var failed, passed bool
+	for _, check := range report.History {
+		failed = failed || check.StatusCode == http.StatusInternalServerError && !check.Healthy && check.Error != ""
+		passed = passed || check.StatusCode == http.StatusOK && check.Healthy
+	}
+	if !failed || !passed {
+		t.Errorf("expected the history to hold the failed and passed checks, got %s", b)
+	}
+}
@@ -21,6 +21,8 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 type SystemConfiguration struct {
@@ -31,17 +33,35 @@ type Manager struct {
 	AppDataPath             string
 	HttpReverseProxyManager *proxy_handler.HttpReverseProxyManager
 	CloudflareZoneDir       string
-	applications            map[string]*Application
-	system                  *SystemConfiguration
-	shutdown                chan interface{}
-	installedCf             []*Cloudflare
+	LogPolicy               *LogPolicy
+	// CgroupRoot is the cgroup v2 directory the applications' cgroups are created in,
+	// empty for a kerfuffle cgroup at the top of the hierarchy.
+	CgroupRoot string
+	system     *SystemConfiguration
+	shutdown   chan interface{}
+
+	// mu guards applications and installing, the ids of the applications which
+	// are being installed are reserved so they can't be installed twice.
+	mu           sync.RWMutex
+	applications map[string]*Application
+	installing   map[string]bool
+
+	cfLock      sync.Mutex
+	installedCf []*Cloudflare
+
+	// accessLock serializes the changes to the access overrides
+	accessLock sync.Mutex
 }
 
 func (m *Manager) GetApplication(id string) *Application {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	return m.applications[id]
 }
 
 func (m *Manager) GetAllApplications() []*Application {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	var apps []*Application
 	for _, application := range m.applications {
 		apps = append(apps, application)
@@ -50,14 +70,26 @@ func (m *Manager) GetAllApplications() []*Application {
 }
 
 func (m *Manager) SetAppMaintenanceMode(id string, state bool) error {
-	app, exists := m.applications[id]
-	if !exists {
+	var maintenance *proxy_handler.Maintenance
+	if state {
+		maintenance = &proxy_handler.Maintenance{}
+	}
+	return m.SetAppMaintenance(id, maintenance)
+}
+
+// SetAppMaintenance puts every route of the application on hold, with the reason and
+// ETA shown on its maintenance page. nil takes the application out of maintenance.
+func (m *Manager) SetAppMaintenance(id string, maintenance *proxy_handler.Maintenance) error {
+	app := m.GetApplication(id)
+	if app == nil {
 		return ErrNotFound
 	}
-	app.MaintenanceMode = state
-	for _, proxy := range app.proxies {
+	app.mu.Lock()
+	app.MaintenanceMode, app.maintenance = maintenance != nil, maintenance
+	app.mu.Unlock()
+	for _, proxy := range app.GetAllProxies() {
 		for _, s := range proxy.Host {
-			err := m.HttpReverseProxyManager.SetHold(s, state)
+			err := m.HttpReverseProxyManager.SetMaintenance(s, maintenance)
 			if err != nil {
 				log.Err(err).Str("route", s).Msg("failed to set hold mode on route")
 			}
@@ -68,7 +100,7 @@ func (m *Manager) SetAppMaintenanceMode(id string, state bool) error {
 
 // Shutdown attempts to shutdown all of the running applications peacefully and closes the m.shutdown channel
 func (m *Manager) Shutdown() {
-	for _, application := range m.applications {
+	for _, application := range m.GetAllApplications() {
 		application.Shutdown()
 	}
 	close(m.shutdown)
@@ -91,7 +123,9 @@ func NewManager() *Manager {
 	return &Manager{
 		AppDataPath:       "app_data",
 		applications:      map[string]*Application{},
+		installing:        map[string]bool{},
 		CloudflareZoneDir: ".cf-zones",
+		LogPolicy:         DefaultLogPolicy(),
 		installedCf:       []*Cloudflare{},
 	}
 }
@@ -167,7 +201,7 @@ func _(repository string) *InstallConfiguration {
 	return cfg
 }
 
-func (m *Manager) InstallFromGit(config *InstallConfiguration) (*Application, error) {
+func (m *Manager) InstallFromGit(config *InstallConfiguration) (_ *Application, err error) {
 	if config == nil {
 		return nil, errors.New("config cannot be nil")
 	}
@@ -175,15 +209,29 @@ func (m *Manager) InstallFromGit(config *InstallConfiguration) (*Application, er
 	config.LoadDefaults()
 	app := NewApplication(config)
 	app.SetAppPath(filepath.Join(m.AppDataPath, app.ID))
+	app.logDir, app.logPolicy = m.logDir(app.ID), m.LogPolicy
+	app.cgroupRoot = m.CgroupRoot
 	log.Debug().Str("id", app.ID).Str("repository", config.Repository).Interface("config", config).Msg("installing application")
 
-	a := m.GetApplication(app.ID)
-	if a != nil {
+	m.mu.Lock()
+	if m.applications[app.ID] != nil || m.installing[app.ID] {
+		m.mu.Unlock()
 		return nil, errors.New("application already exists")
 	}
+	m.installing[app.ID] = true
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.installing, app.ID)
+		m.mu.Unlock()
+	}()
+	started := time.Now()
+	defer func() {
+		observeDeploy(app, TriggerInstall, started, err)
+	}()
 
 	log.Debug().Str("app", app.ID).Str("destination", app.AppPath()).Msg("cloning application")
-	err := clone(app)
+	err = clone(app)
 	if err != nil {
 		return nil, err
 	}
@@ -194,6 +242,12 @@ func (m *Manager) InstallFromGit(config *InstallConfiguration) (*Application, er
 		return nil, err
 	}
 
+	log.Debug().Str("app", app.ID).Msg("allocating ports")
+	err = allocatePorts(app)
+	if err != nil {
+		return nil, err
+	}
+
 	log.Debug().Str("app", app.ID).Msg("bootstrapping provisions")
 	err = app.BootstrapProvisions()
 	if err != nil {
@@ -207,7 +261,7 @@ func (m *Manager) InstallFromGit(config *InstallConfiguration) (*Application, er
 	}
 
 	// todo: bootstrap cloudflare
-	for _, cf := range app.cfs {
+	for _, cf := range app.GetAllCfs() {
 		err := m.InstallCloudflareConfiguration(cf)
 		if err != nil {
 			return nil, err
@@ -219,20 +273,30 @@ func (m *Manager) InstallFromGit(config *InstallConfiguration) (*Application, er
 		return nil, err
 	}
 
+	_, err = m.WebhookSecret(app.ID)
+	if err != nil {
+		return nil, err
+	}
+	m.recordRelease(app, TriggerInstall, nil)
+
+	m.mu.Lock()
 	m.applications[app.ID] = app
+	m.mu.Unlock()
 	return app, nil
 }
 
 func (m *Manager) Uninstall(id string) error {
-	app := m.applications[id]
+	app := m.GetApplication(id)
 	if app == nil {
 		return ErrNotFound
 	}
 	app.Shutdown()
-	for _, proxy := range app.proxies {
+	for _, proxy := range app.GetAllProxies() {
 		for _, host := range proxy.Host {
 			err := m.HttpReverseProxyManager.UninstallRoute(host)
-			log.Err(err).Msg("failed to uninstall route")
+			if err != nil {
+				log.Err(err).Str("route", host).Msg("failed to uninstall route")
+			}
 		}
 	}
 	return nil
@@ -244,36 +308,49 @@ func (m *Manager) InstallCloudflareConfiguration(cf *Cloudflare) error {
 		return nil
 	}
 
+	m.cfLock.Lock()
 	for _, c := range m.installedCf {
 		if fmt.Sprintf("%v", c.Host) == fmt.Sprintf("%v", cf.Host) {
 			log.Info().Msg("A duplicate has already been installed, will reinstall anyways")
 		}
 	}
+	m.cfLock.Unlock()
 
-	tokenBytes, err := ioutil.ReadFile(path.Join(m.CloudflareZoneDir, cf.Zone))
-	if os.IsNotExist(err) {
-		return fmt.Errorf("no cloudflare token found for '%v', add it to '%v'", cf.Zone, m.CloudflareZoneDir)
-	}
+	token, err := m.cloudflareToken(cf.Zone)
 	if err != nil {
 		return err
 	}
-	token := strings.TrimSpace(string(tokenBytes))
 	for _, host := range cf.Host {
+		started := time.Now()
 		_, err := cloudflare.
 			AutoCloudflare(token).
 			SetZone(cf.Zone).
 			SetDomain(host).
 			Proxied(cf.Proxied).
 			SendConfiguration()
+		observeCloudflare(CloudflareInstall, started, err)
 		if err != nil {
 			return err
 		}
 	}
 
+	m.cfLock.Lock()
 	m.installedCf = append(m.installedCf, cf)
+	m.cfLock.Unlock()
 	return nil
 }
 
+func (m *Manager) cloudflareToken(zone string) (string, error) {
+	tokenBytes, err := ioutil.ReadFile(path.Join(m.CloudflareZoneDir, zone))
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("no cloudflare token found for '%v', add it to '%v'", zone, m.CloudflareZoneDir)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(tokenBytes)), nil
+}
+
 func (m *Manager) saveConfiguration(config *InstallConfiguration, app *Application) error {
 	{
 		cfgBytes, err := json.Marshal(config)
@@ -288,24 +365,85 @@ func (m *Manager) saveConfiguration(config *InstallConfiguration, app *Applicati
 	return nil
 }
 
+// allocatePorts assigns a port to every replica of the proxied provisions, this
+// has to happen before the provisions are launched since they receive it through APP_PORT.
+func allocatePorts(app *Application) error {
+	provisions := app.GetAllProvisions()
+	for key, proxy := range app.GetAllProxies() {
+		replicas := 1
+		if provision, exists := provisions[key]; exists {
+			replicas = provision.ReplicaCount()
+		}
+
+		ports := []string{}
+		for i := 0; i < replicas; i++ {
+			if i == 0 && proxy.BindPort != "" {
+				ports = append(ports, proxy.BindPort)
+				continue
+			}
+			port, err := freeport.GetFreePort()
+			if err != nil {
+				return err
+			}
+			log.Debug().Int("port", port).Str("proxy", key).Int("replica", i).Msg("using generated port")
+			ports = append(ports, fmt.Sprintf("%v", port))
+		}
+		app.setProxyPorts(key, ports)
+	}
+	return nil
+}
+
 func (m *Manager) bootstrapProxies(app *Application) error {
 	// Abort when there's no HTTPManager installedCf
 	if m.HttpReverseProxyManager == nil {
 		return errors.New("no HttpReverseProxyManager installedCf")
 	}
-	for _, proxy := range app.proxies {
-		if proxy.BindPort == "" {
-			port, err := freeport.GetFreePort()
+	provisions := app.GetAllProvisions()
+	for key, proxy := range app.GetAllProxies() {
+		balancer, err := proxy_handler.NewBalancer(proxy.Balance, proxy.HashHeader, proxy.HashCookie)
+		if err != nil {
+			return err
+		}
+
+		access, _, err := m.proxyAccess(app.ID, key, proxy)
+		if err != nil {
+			return err
+		}
+		for _, origin := range proxy.Host {
+			key := key
+			backends, err := newBackends(proxy.Ports, func(i int) (string, func() bool) {
+				// backends without a provision of their own are managed outside of kerfuffle
+				if _, exists := provisions[key]; !exists {
+					return "", nil
+				}
+				return replicaId(key, i), func() bool {
+					return app.ReplicaAlive(key, i)
+				}
+			})
 			if err != nil {
 				return err
 			}
-			log.Debug().Int("port", port).Msg("using generated port")
-			proxy.BindPort = fmt.Sprintf("%v", port)
-		}
 
-		target := fmt.Sprintf("http://localhost:%v", proxy.BindPort)
-		for _, origin := range proxy.Host {
-			err := m.HttpReverseProxyManager.InstallRoute(origin, target)
+			err = m.HttpReverseProxyManager.InstallRouteWithOptions(origin, &proxy_handler.RouteOptions{
+				Backends:      backends,
+				Balancer:      balancer,
+				StripPrefix:   proxy.StripPrefix,
+				RewritePrefix: proxy.RewritePrefix,
+				Owner:         app.ID,
+				Limits:        proxy.limits(),
+				RateLimit:     proxy.rateLimit(),
+				Access:        access.control(),
+				Pages:         app.errorPages(),
+				OnError:       m.upstreamFailureRecorder(app, key),
+			})
+			if err != nil {
+				return err
+			}
+			err = m.HttpReverseProxyManager.SetRedirectHTTPS(origin, proxy.RedirectHTTPS)
+			if err != nil {
+				return err
+			}
+			err = m.HttpReverseProxyManager.SetAccessLog(origin, !proxy.DisableAccessLog)
 			if err != nil {
 				return err
 			}
@@ -0,0 +1,327 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// segmentTimeFormat is sortable and free of dots, so the process id can be told apart from it.
+const segmentTimeFormat = "20060102T150405.000"
+
+var segmentPattern = regexp.MustCompile(`^(.+)\.(\d{8}T\d{9})\.log(\.gz)?$`)
+
+// LogPolicy decides when process log files are rotated and how long the rotated
+// segments are kept, zero values disable the respective limit.
+type LogPolicy struct {
+	// MaxSize rotates the file once it grows past it, in bytes.
+	MaxSize int64
+	// MaxAge rotates the file once it has been written to for longer.
+	MaxAge time.Duration
+	// Retention removes segments which have been rotated longer ago.
+	Retention time.Duration
+	// MaxSegments is the amount of rotated segments kept per process.
+	MaxSegments int
+}
+
+func DefaultLogPolicy() *LogPolicy {
+	return &LogPolicy{
+		MaxSize:     10 << 20,
+		MaxAge:      time.Hour * 24,
+		Retention:   time.Hour * 24 * 7,
+		MaxSegments: 10,
+	}
+}
+
+// LogSegment is a log file of a process, either the one being written to or a rotated one.
+type LogSegment struct {
+	Name     string    `json:"name"`
+	Process  string    `json:"process"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Current  bool      `json:"current"`
+}
+
+// logFile writes the output of a process to <dir>/<name>.log, rotated segments
+// are gzipped to <dir>/<name>.<time>.log.gz.
+type logFile struct {
+	mu     sync.Mutex
+	dir    string
+	name   string
+	policy *LogPolicy
+	file   *os.File
+	size   int64
+	opened time.Time
+	// rotated is the time of the last rotation, segment names must not collide
+	rotated time.Time
+	// background waits for the compression of rotated segments
+	background sync.WaitGroup
+}
+
+func openLogFile(dir, name string, policy *LogPolicy) (*logFile, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	l := &logFile{dir: dir, name: name, policy: policy}
+	err = l.open()
+	if err != nil {
+		return nil, err
+	}
+	// the file has been around since before kerfuffle started, its age is unknown
+	if stat, err := l.file.Stat(); err == nil && l.size != 0 && l.expired(stat.ModTime()) {
+		err = l.rotate()
+	}
+	return l, err
+}
+
+func (l *logFile) path() string {
+	return filepath.Join(l.dir, l.name+".log")
+}
+
+func (l *logFile) open() error {
+	file, err := os.OpenFile(l.path(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	l.file, l.size, l.opened = file, stat.Size(), time.Now()
+	return nil
+}
+
+func (l *logFile) expired(since time.Time) bool {
+	return l.policy.MaxAge > 0 && time.Since(since) > l.policy.MaxAge
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return 0, os.ErrClosed
+	}
+	if l.size != 0 && ((l.policy.MaxSize > 0 && l.size+int64(len(p)) > l.policy.MaxSize) || l.expired(l.opened)) {
+		err := l.rotate()
+		if err != nil {
+			log.Err(err).Str("file", l.path()).Msg("failed to rotate log file")
+			if l.file == nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and starts a new one, the segment is
+// compressed in the background. It must be called with the lock held.
+func (l *logFile) rotate() error {
+	err := l.file.Close()
+	l.file = nil
+	if err != nil {
+		return err
+	}
+	at := time.Now().UTC().Truncate(time.Millisecond)
+	if !at.After(l.rotated) {
+		at = l.rotated.Add(time.Millisecond)
+	}
+	l.rotated = at
+	segment := filepath.Join(l.dir, fmt.Sprintf("%v.%v.log", l.name, strings.Replace(at.Format(segmentTimeFormat), ".", "", 1)))
+	err = os.Rename(l.path(), segment)
+	if err != nil {
+		return err
+	}
+	l.background.Add(1)
+	go func() {
+		defer l.background.Done()
+		err := compressSegment(segment)
+		if err != nil {
+			log.Err(err).Str("file", segment).Msg("failed to compress log segment")
+		}
+		l.prune()
+	}()
+	return l.open()
+}
+
+func compressSegment(segment string) error {
+	in, err := os.Open(segment)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(segment + ".gz.tmp")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := gzip.NewWriter(out)
+	_, err = io.Copy(w, in)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		_ = os.Remove(out.Name())
+		return err
+	}
+	err = os.Rename(out.Name(), segment+".gz")
+	if err != nil {
+		return err
+	}
+	return os.Remove(segment)
+}
+
+// prune removes the segments of the process which fall outside of the retention policy.
+func (l *logFile) prune() {
+	segments, err := listLogSegments(l.dir)
+	if err != nil {
+		log.Err(err).Str("dir", l.dir).Msg("failed to list log segments")
+		return
+	}
+	names := map[string]bool{}
+	for _, segment := range segments {
+		names[segment.Name] = true
+	}
+	var rotated []*LogSegment
+	for _, segment := range segments {
+		// a segment that has just been compressed only counts once
+		if segment.Process == l.name && !segment.Current && !names[segment.Name+".gz"] {
+			rotated = append(rotated, segment)
+		}
+	}
+	// newest first
+	sort.Slice(rotated, func(i, j int) bool {
+		return rotated[i].Name > rotated[j].Name
+	})
+	for i, segment := range rotated {
+		tooMany := l.policy.MaxSegments > 0 && i >= l.policy.MaxSegments
+		tooOld := l.policy.Retention > 0 && time.Since(segment.Modified) > l.policy.Retention
+		if !tooMany && !tooOld {
+			continue
+		}
+		err := os.Remove(filepath.Join(l.dir, segment.Name))
+		if err != nil && !os.IsNotExist(err) {
+			log.Err(err).Str("file", segment.Name).Msg("failed to remove log segment")
+		}
+	}
+}
+
+// Close closes the file and waits for the rotated segments to be compressed.
+func (l *logFile) Close() error {
+	l.mu.Lock()
+	var err error
+	if l.file != nil {
+		err = l.file.Close()
+		l.file = nil
+	}
+	l.mu.Unlock()
+	l.background.Wait()
+	return err
+}
+
+// listLogSegments returns the log files in the directory, a missing directory has none.
+func listLogSegments(dir string) ([]*LogSegment, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []*LogSegment{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	segments := []*LogSegment{}
+	for _, file := range files {
+		segment := &LogSegment{Name: file.Name(), Size: file.Size(), Modified: file.ModTime()}
+		if match := segmentPattern.FindStringSubmatch(file.Name()); match != nil {
+			segment.Process = match[1]
+		} else if strings.HasSuffix(file.Name(), ".log") {
+			segment.Process = strings.TrimSuffix(file.Name(), ".log")
+			segment.Current = true
+		} else {
+			// e.g. a segment which is still being compressed
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+func (m *Manager) logDir(id string) string {
+	return filepath.Join(m.AppDataPath, "logs", id)
+}
+
+// GetLogSegments lists the current and rotated log files of every process of the application.
+func (m *Manager) GetLogSegments(id string) ([]*LogSegment, error) {
+	if m.GetApplication(id) == nil {
+		return nil, ErrNotFound
+	}
+	return listLogSegments(m.logDir(id))
+}
+
+// LogSegmentPath returns the path of one of the application's log files.
+func (m *Manager) LogSegmentPath(id, name string) (string, error) {
+	segments, err := m.GetLogSegments(id)
+	if err != nil {
+		return "", err
+	}
+	for _, segment := range segments {
+		if segment.Name == name {
+			return filepath.Join(m.logDir(id), name), nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+// logFile returns the log file of the process, opening it on first use. Processes
+// replacing each other, e.g. while reloading, share the file.
+func (a *Application) logFile(id string) *logFile {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.logDir == "" {
+		return nil
+	}
+	if file, exists := a.logFiles[id]; exists {
+		return file
+	}
+	file, err := openLogFile(a.logDir, id, a.logPolicy)
+	if err != nil {
+		log.Err(err).Str("app", a.ID).Str("id", id).Msg("failed to open log file, output is only kept in memory")
+		return nil
+	}
+	a.logFiles[id] = file
+	return file
+}
+
+func (a *Application) closeLogFiles() {
+	a.mu.Lock()
+	files := a.logFiles
+	a.logFiles = map[string]*logFile{}
+	a.mu.Unlock()
+	for id, file := range files {
+		err := file.Close()
+		if err != nil {
+			log.Err(err).Str("app", a.ID).Str("id", id).Msg("failed to close log file")
+		}
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogFile_Rotation(t *testing.T) {
+	dir := t.TempDir()
+	file, err := openLogFile(dir, "web.1", &LogPolicy{MaxSize: 10, MaxSegments: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := NewLogBuffer(10)
+	buffer.sink = file
+	for i := 0; i < 4; i++ {
+		_, _ = fmt.Fprintf(buffer.Writer(StreamStdout), "line %v\n", i)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := listLogSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, segment := range segments {
+		if segment.Process != "web.1" {
+			t.Errorf("segment %v should belong to web.1, got %v", segment.Name, segment.Process)
+		}
+		names = append(names, segment.Name)
+	}
+	// every line got its own file, only the two newest rotated ones are kept
+	if len(segments) != 3 || !segments[2].Current {
+		t.Fatalf("unexpected segments %v", names)
+	}
+
+	current, err := ioutil.ReadFile(filepath.Join(dir, "web.1.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(current), " stdout line 3\n") {
+		t.Errorf("unexpected current log %q", current)
+	}
+
+	f, err := os.Open(filepath.Join(dir, segments[1].Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(previous), " stdout line 2\n") {
+		t.Errorf("unexpected rotated log %q", previous)
+	}
+}
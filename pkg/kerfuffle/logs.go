@@ -0,0 +1,205 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+
+	defaultLogLines = 1000
+	// maxLogLineLength splits up lines which are longer, so a process printing
+	// without newlines can't grow the buffer.
+	maxLogLineLength = 4096
+	// subscriberBacklog is how many lines a follower can fall behind before it's dropped.
+	subscriberBacklog = 256
+)
+
+type LogLine struct {
+	Seq    uint64    `json:"seq"`
+	At     time.Time `json:"at"`
+	Stream string    `json:"stream"`
+	Text   string    `json:"text"`
+}
+
+// LogQuery selects the lines returned by LogBuffer.Tail, zero values don't filter.
+type LogQuery struct {
+	// After only returns lines with a higher sequence number.
+	After  uint64
+	Since  time.Time
+	Stream string
+	// Lines limits the result to the last n matching lines.
+	Lines int
+}
+
+func (q *LogQuery) matches(line *LogLine) bool {
+	return line.Seq > q.After &&
+		!line.At.Before(q.Since) &&
+		(q.Stream == "" || q.Stream == line.Stream)
+}
+
+// LogBuffer keeps the latest lines a process wrote to stdout and stderr. Both
+// streams share the buffer so their lines stay in the order they were written.
+type LogBuffer struct {
+	mu          sync.Mutex
+	lines       []*LogLine
+	next        int
+	seq         uint64
+	partial     map[string][]byte
+	subscribers map[chan *LogLine]*LogQuery
+	// sink receives every line as well, e.g. to keep it on disk
+	sink io.Writer
+}
+
+func NewLogBuffer(size int) *LogBuffer {
+	if size < 1 {
+		size = defaultLogLines
+	}
+	return &LogBuffer{
+		lines:       make([]*LogLine, 0, size),
+		partial:     map[string][]byte{},
+		subscribers: map[chan *LogLine]*LogQuery{},
+	}
+}
+
+type logWriter struct {
+	buffer *LogBuffer
+	stream string
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buffer.write(w.stream, p)
+	return len(p), nil
+}
+
+// Writer returns a writer which tags every line written to it with the stream.
+func (b *LogBuffer) Writer(stream string) io.Writer {
+	return &logWriter{buffer: b, stream: stream}
+}
+
+func (b *LogBuffer) write(stream string, p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pending := append(b.partial[stream], p...)
+	for {
+		i := bytes.IndexByte(pending, '\n')
+		if i < 0 && len(pending) < maxLogLineLength {
+			break
+		}
+		if i < 0 || i > maxLogLineLength {
+			i = maxLogLineLength
+			b.add(stream, string(pending[:i]))
+			pending = pending[i:]
+			continue
+		}
+		b.add(stream, strings.TrimSuffix(string(pending[:i]), "\r"))
+		pending = pending[i+1:]
+	}
+	b.partial[stream] = append([]byte{}, pending...)
+}
+
+// Flush turns the unterminated output of every stream into a line, it's called once a command exits.
+func (b *LogBuffer) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, stream := range []string{StreamStdout, StreamStderr} {
+		if len(b.partial[stream]) != 0 {
+			b.add(stream, string(b.partial[stream]))
+		}
+		delete(b.partial, stream)
+	}
+}
+
+// add stores the line and hands it to the followers, it must be called with the lock held.
+func (b *LogBuffer) add(stream, text string) {
+	b.seq++
+	line := &LogLine{Seq: b.seq, At: time.Now(), Stream: stream, Text: text}
+	if len(b.lines) < cap(b.lines) {
+		b.lines = append(b.lines, line)
+	} else {
+		b.lines[b.next] = line
+		b.next = (b.next + 1) % len(b.lines)
+	}
+	if b.sink != nil {
+		_, _ = fmt.Fprintf(b.sink, "%v %v %v\n", line.At.UTC().Format(time.RFC3339Nano), stream, text)
+	}
+
+	for subscriber, query := range b.subscribers {
+		if !query.matches(line) {
+			continue
+		}
+		select {
+		case subscriber <- line:
+		default:
+			// a follower that can't keep up would hold up the process, it can
+			// reconnect and catch up from the sequence number it last saw
+			delete(b.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// ordered returns the buffered lines from oldest to newest, it must be called with the lock held.
+func (b *LogBuffer) ordered() []*LogLine {
+	return append(append([]*LogLine{}, b.lines[b.next:]...), b.lines[:b.next]...)
+}
+
+func (b *LogBuffer) Tail(query *LogQuery) []*LogLine {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tail(query)
+}
+
+func (b *LogBuffer) tail(query *LogQuery) []*LogLine {
+	lines := []*LogLine{}
+	for _, line := range b.ordered() {
+		if query.matches(line) {
+			lines = append(lines, line)
+		}
+	}
+	if query.Lines > 0 && len(lines) > query.Lines {
+		lines = lines[len(lines)-query.Lines:]
+	}
+	return lines
+}
+
+// Follow returns the lines matching the query along with a channel receiving
+// every line written from then on. The channel is closed when the follower falls
+// too far behind, cancel has to be called once the follower is done.
+func (b *LogBuffer) Follow(query *LogQuery) ([]*LogLine, <-chan *LogLine, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subscriber := make(chan *LogLine, subscriberBacklog)
+	b.subscribers[subscriber] = query
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, exists := b.subscribers[subscriber]; exists {
+			delete(b.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+	return b.tail(query), subscriber, cancel
+}
+
+// String returns the buffered output of a single stream.
+func (b *LogBuffer) String(stream string) string {
+	var builder strings.Builder
+	for _, line := range b.Tail(&LogQuery{Stream: stream}) {
+		builder.WriteString(line.Text)
+		builder.WriteByte('\n')
+	}
+	return builder.String()
+}
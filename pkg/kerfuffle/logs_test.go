@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func texts(lines []*LogLine) string {
+	var t []string
+	for _, line := range lines {
+		t = append(t, line.Stream[3:]+":"+line.Text)
+	}
+	return strings.Join(t, " ")
+}
+
+func TestLogBuffer(t *testing.T) {
+	buffer := NewLogBuffer(3)
+	stdout, stderr := buffer.Writer(StreamStdout), buffer.Writer(StreamStderr)
+
+	_, _ = fmt.Fprint(stdout, "one\ntw")
+	_, _ = fmt.Fprint(stderr, "oops\r\n")
+	_, _ = fmt.Fprint(stdout, "o\n")
+	if got := texts(buffer.Tail(&LogQuery{})); got != "out:one err:oops out:two" {
+		t.Errorf("unexpected lines %q", got)
+	}
+
+	// the buffer only keeps the latest lines
+	_, _ = fmt.Fprint(stdout, "three\nfour")
+	buffer.Flush()
+	lines := buffer.Tail(&LogQuery{})
+	if got := texts(lines); got != "out:two out:three out:four" {
+		t.Errorf("unexpected lines %q", got)
+	}
+	if lines[0].Seq != 3 || lines[2].Seq != 5 {
+		t.Errorf("unexpected sequence numbers %v %v", lines[0].Seq, lines[2].Seq)
+	}
+	if got := texts(buffer.Tail(&LogQuery{Lines: 1})); got != "out:four" {
+		t.Errorf("unexpected tail %q", got)
+	}
+	if got := texts(buffer.Tail(&LogQuery{After: 4})); got != "out:four" {
+		t.Errorf("unexpected lines after 4 %q", got)
+	}
+
+	_, _ = fmt.Fprint(stdout, strings.Repeat("x", maxLogLineLength+1))
+	if got := buffer.Tail(&LogQuery{Lines: 1}); len(got[0].Text) != maxLogLineLength {
+		t.Errorf("long lines should be split, got %v characters", len(got[0].Text))
+	}
+}
+
+func TestLogBuffer_Follow(t *testing.T) {
+	buffer := NewLogBuffer(10)
+	_, _ = fmt.Fprintln(buffer.Writer(StreamStderr), "before")
+
+	backlog, lines, cancel := buffer.Follow(&LogQuery{Stream: StreamStderr})
+	if got := texts(backlog); got != "err:before" {
+		t.Errorf("unexpected backlog %q", got)
+	}
+	_, _ = fmt.Fprintln(buffer.Writer(StreamStdout), "ignored")
+	_, _ = fmt.Fprintln(buffer.Writer(StreamStderr), "after")
+	if line := <-lines; line.Text != "after" {
+		t.Errorf("unexpected line %q", line.Text)
+	}
+	cancel()
+	if _, ok := <-lines; ok {
+		t.Error("cancelling should close the channel")
+	}
+
+	// followers which fall behind are dropped instead of blocking the process
+	_, lines, cancel = buffer.Follow(&LogQuery{})
+	defer cancel()
+	for i := 0; i <= subscriberBacklog; i++ {
+		_, _ = fmt.Fprintln(buffer.Writer(StreamStdout), i)
+	}
+	received := 0
+	for range lines {
+		received++
+	}
+	if received != subscriberBacklog {
+		t.Errorf("expected %v lines before being dropped, got %v", subscriberBacklog, received)
+	}
+}
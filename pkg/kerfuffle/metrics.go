@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"kerfuffle/pkg/metrics"
+	"time"
+)
+
+const (
+	CloudflareInstall   = "install"
+	CloudflareUninstall = "uninstall"
+)
+
+var (
+	// deploys clone, build and boot applications, they take a lot longer than requests
+	deployBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600}
+
+	deploys = metrics.Default.NewCounter("kerfuffle_deploys_total",
+		"Deploys by trigger and outcome.", "app", "trigger", "outcome")
+	deployDuration = metrics.Default.NewHistogram("kerfuffle_deploy_duration_seconds",
+		"Time taken by deploys.", deployBuckets, "trigger")
+	cloudflareOperations = metrics.Default.NewCounter("kerfuffle_cloudflare_operations_total",
+		"Cloudflare DNS record operations by outcome.", "operation", "outcome")
+	cloudflareDuration = metrics.Default.NewHistogram("kerfuffle_cloudflare_operation_duration_seconds",
+		"Time taken by Cloudflare DNS record operations.", nil, "operation")
+)
+
+func outcome(err error) string {
+	if err != nil {
+		return ReleaseFailed
+	}
+	return ReleaseSucceeded
+}
+
+func observeDeploy(app *Application, trigger string, started time.Time, err error) {
+	deploys.Inc(app.ID, trigger, outcome(err))
+	deployDuration.Observe(time.Since(started).Seconds(), trigger)
+}
+
+func observeCloudflare(operation string, started time.Time, err error) {
+	cloudflareOperations.Inc(operation, outcome(err))
+	cloudflareDuration.Observe(time.Since(started).Seconds(), operation)
+}
+
+// RegisterMetrics exposes the state of the applications and their processes,
+// it's collected from the manager on every scrape.
+func (m *Manager) RegisterMetrics(registry *metrics.Registry) {
+	registry.NewGaugeFunc("kerfuffle_application_status",
+		"The current status of the application, always 1.", []string{"app", "status"},
+		func(set func(float64, ...string)) {
+			for _, app := range m.GetAllApplications() {
+				status := StatusUnknown
+				if current := app.GetStatus(); current != nil {
+					status = current.Flag
+				}
+				set(1, app.ID, status)
+			}
+		})
+
+	processLabels := []string{"app", "provision", "process"}
+	eachProcess := func(collect func(process *Process, set func(float64))) metrics.CollectFunc {
+		return func(set func(float64, ...string)) {
+			for _, app := range m.GetAllApplications() {
+				for id, process := range app.processes() {
+					collect(process, func(value float64) {
+						set(value, app.ID, process.provision.Id, id)
+					})
+				}
+			}
+		}
+	}
+	// the latest sample of the process, processes which aren't running have none
+	eachSample := func(value func(sample *ResourceSample) float64) metrics.CollectFunc {
+		return eachProcess(func(process *Process, set func(float64)) {
+			if process.pid() == 0 {
+				return
+			}
+			if samples := process.GetResources(); len(samples) != 0 {
+				set(value(samples[len(samples)-1]))
+			}
+		})
+	}
+
+	registry.NewGaugeFunc("kerfuffle_process_up",
+		"Whether the process is running.", processLabels,
+		eachProcess(func(process *Process, set func(float64)) {
+			up := 0.0
+			if process.Alive() {
+				up = 1
+			}
+			set(up)
+		}))
+	registry.NewCounterFunc("kerfuffle_process_restarts_total",
+		"Restarts of the process by the supervisor since it was deployed.", processLabels,
+		eachProcess(func(process *Process, set func(float64)) {
+			set(float64(len(process.GetRestarts())))
+		}))
+	registry.NewGaugeFunc("kerfuffle_process_cpu_percent",
+		"CPU usage of the process and its children, 100 being a single core.", processLabels,
+		eachSample(func(sample *ResourceSample) float64 {
+			return sample.CPUPercent
+		}))
+	registry.NewGaugeFunc("kerfuffle_process_resident_memory_bytes",
+		"Resident memory of the process and its children.", processLabels,
+		eachSample(func(sample *ResourceSample) float64 {
+			return float64(sample.RSS)
+		}))
+	registry.NewGaugeFunc("kerfuffle_process_open_fds",
+		"Open file descriptors of the process and its children.", processLabels,
+		eachSample(func(sample *ResourceSample) float64 {
+			return float64(sample.OpenFiles)
+		}))
+	registry.NewGaugeFunc("kerfuffle_process_threads",
+		"Threads of the process and its children.", processLabels,
+		eachSample(func(sample *ResourceSample) float64 {
+			return float64(sample.Threads)
+		}))
+	registry.NewGaugeFunc("kerfuffle_process_children",
+		"Processes spawned by the process.", processLabels,
+		eachSample(func(sample *ResourceSample) float64 {
+			return float64(sample.Children)
+		}))
+}
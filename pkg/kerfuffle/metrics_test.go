@@ -0,0 +1,42 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"bytes"
+	"fmt"
+	"kerfuffle/pkg/metrics"
+	"strings"
+	"testing"
+)
+
+func TestManager_RegisterMetrics(t *testing.T) {
+	m := NewManager()
+	app := NewApplication(&InstallConfiguration{Repository: "https://example.com/metrics", Branch: "master"})
+	app.setStatus(StatusRunning, "Application is running")
+	process := app.newProcess(&Provision{Id: "web"}, "web.0", "")
+	process.addRestart(&RestartRecord{})
+	process.addRestart(&RestartRecord{})
+	m.applications[app.ID] = app
+
+	registry := metrics.NewRegistry()
+	m.RegisterMetrics(registry)
+	buffer := &bytes.Buffer{}
+	registry.Write(buffer)
+
+	labels := fmt.Sprintf(`app="%v",provision="web",process="web.0"`, app.ID)
+	for _, line := range []string{
+		fmt.Sprintf(`kerfuffle_application_status{app="%v",status="running"} 1`, app.ID),
+		"kerfuffle_process_up{" + labels + "} 0",
+		"kerfuffle_process_restarts_total{" + labels + "} 2",
+		"# TYPE kerfuffle_process_resident_memory_bytes gauge",
+	} {
+		if !strings.Contains(buffer.String(), line+"\n") {
+			t.Errorf("missing %q in:\n%v", line, buffer.String())
+		}
+	}
+}
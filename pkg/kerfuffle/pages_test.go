@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"kerfuffle/pkg/proxy_handler"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const pagesKerfuffleConfig = `
+[meta]
+name = "Odi Chat"
+
+[pages]
+maintenance = "%v"
+
+[provision]
+
+[proxy.web]
+host = ["pages.local"]
+
+[cloudflare]
+`
+
+func TestManager_MaintenancePages(t *testing.T) {
+	m := NewManager()
+	m.AppDataPath = t.TempDir()
+	m.HttpReverseProxyManager = proxy_handler.NewHttpReverseProxyManager()
+
+	app := NewApplication(&InstallConfiguration{Repository: "https://example.com/pages", Branch: "master", BootstrapPath: ".kerfuffle"})
+	app.SetAppPath(t.TempDir())
+	write := func(name, content string) {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(app.AppPath(), name)), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(app.AppPath(), name), []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("static/maintenance.html", "{{.App}}: {{.Reason}}")
+	write(".kerfuffle", fmt.Sprintf(pagesKerfuffleConfig, "static/maintenance.html"))
+	if err := app.BootstrapConfigs(); err != nil {
+		t.Fatal(err)
+	}
+	app.proxies["web"].Ports = []string{"1"}
+	m.applications[app.ID] = app
+	if err := m.bootstrapProxies(app); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetAppMaintenance(app.ID, &proxy_handler.Maintenance{Reason: "moving servers"}); err != nil {
+		t.Fatal(err)
+	}
+	// the maintenance is put back on the routes of a redeploy
+	m.uninstallProxies(app.GetAllProxies())
+	if err := m.bootstrapProxies(app); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetAppMaintenance(app.ID, app.GetMaintenance()); err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+	m.HttpReverseProxyManager.Handler(false).ServeHTTP(res, httptest.NewRequest("GET", "http://pages.local/", nil))
+	if res.Code != http.StatusServiceUnavailable || res.Body.String() != "Odi Chat: moving servers" {
+		t.Errorf("expected the application's maintenance page, got %v %q", res.Code, res.Body.String())
+	}
+
+	for _, invalid := range []string{"../maintenance.html", "/etc/passwd", "static/missing.html"} {
+		write(".kerfuffle", fmt.Sprintf(pagesKerfuffleConfig, invalid))
+		if err := app.BootstrapConfigs(); err == nil {
+			t.Errorf("expected %v to be rejected", invalid)
+		}
+	}
+}
@@ -7,74 +7,294 @@
 package kerfuffle
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"github.com/rs/zerolog/log"
-	"github.com/shirou/gopsutil/process"
 	"kerfuffle/pkg/utils"
+	"os"
 	"os/exec"
+	"sync"
+	"time"
 )
 
+// StopRecord describes how a process went down when it was stopped.
+type StopRecord struct {
+	At     time.Time `json:"at"`
+	Signal string    `json:"signal"`
+	// Graceful is false when the process had to be killed after the stop timeout.
+	Graceful bool   `json:"graceful"`
+	Took     string `json:"took"`
+	Error    string `json:"error,omitempty"`
+}
+
 type Process struct {
+	id        string
+	port      string
 	directory string
-	cmd       *exec.Cmd
 	env       []string
-	log       *bytes.Buffer
-	err       *bytes.Buffer
-	Errors    []error
-	done      chan interface{}
+	output    *LogBuffer
 	provision *Provision
 
+	// mu guards the fields below, they're written by the goroutine running the
+	// process and read by everything else.
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	running  bool
+	state    *os.ProcessState
+	done     chan interface{}
+	Errors   []error
+	Restarts []*RestartRecord
+	lastStop *StopRecord
+	// oomKilled is set when the last command was killed for running out of memory
+	oomKilled bool
+
+	// cgroup holds the commands of the process when the provision has resource limits
+	cgroup *utils.Cgroup
+
+	// stop is closed once the process has been killed on purpose, so the
+	// supervisor doesn't bring it back up.
+	stop     chan interface{}
+	stopOnce sync.Once
+	// started is closed once the first command is running, finished once the
+	// supervisor gave up on the process, with its last error kept in result.
+	started     chan interface{}
+	startedOnce sync.Once
+	finished    chan interface{}
+	result      error
+
+	// resources is written by the application's sampler
+	resources resourceHistory
+
 	killFunction context.CancelFunc
 }
 
-func (p *Process) Kill() error {
-	log.Trace().Str("process", p.cmd.String()).Msg("killing process...")
-	proc, err := process.NewProcess(int32(p.cmd.Process.Pid))
+func (p *Process) isStopped() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// run starts the command and waits for it to exit, unless the process has been stopped.
+func (p *Process) run(cmd *exec.Cmd) error {
+	p.mu.Lock()
+	// checked under the lock so Kill can't miss a command that's about to start
+	if p.isStopped() {
+		p.mu.Unlock()
+		return nil
+	}
+	p.cmd = cmd
+	p.state = nil
+	p.oomKilled = false
+	oomKills := p.oomKills()
+	err := cmd.Start()
+	if err == nil && p.cgroup != nil {
+		// go can't start the command inside of the cgroup, whatever it forks before
+		// being moved stays outside of it
+		if err = p.cgroup.Add(cmd.Process.Pid); err != nil {
+			_ = utils.KillProcess(cmd)
+			_ = cmd.Wait()
+			err = fmt.Errorf("failed to apply resource limits: %w", err)
+		}
+	}
+	p.running = err == nil
+	p.mu.Unlock()
 	if err != nil {
 		return err
 	}
-	err = utils.KillAllFamilyTree(proc)
+	p.startedOnce.Do(func() {
+		close(p.started)
+	})
+
+	err = cmd.Wait()
+	p.mu.Lock()
+	p.running = false
+	p.state = cmd.ProcessState
+	p.oomKilled = err != nil && p.oomKills() > oomKills
+	p.mu.Unlock()
+	return err
+}
+
+// oomKills returns the amount of out of memory kills within the cgroup of the process.
+func (p *Process) oomKills() int {
+	if p.cgroup == nil {
+		return 0
+	}
+	kills, err := p.cgroup.OOMKills()
 	if err != nil {
-		return err
+		log.Err(err).Str("id", p.id).Msg("failed to read the out of memory kills")
 	}
-	_, err = p.cmd.Process.Wait()
-	log.Trace().Str("process", p.cmd.String()).Msg("killed")
+	return kills
+}
+
+// wasOOMKilled reports if the last command was killed for running out of memory.
+func (p *Process) wasOOMKilled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.oomKilled
+}
+
+// Kill stops the process with the provision's stop signal and gives it the stop
+// timeout to exit, anything still running in its process group after that is killed.
+func (p *Process) Kill() error {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+	p.mu.Lock()
+	cmd, running, done := p.cmd, p.running, p.done
+	p.mu.Unlock()
+	if !running {
+		return nil
+	}
+
+	signal := p.provision.stopSignal()
+	record := &StopRecord{At: time.Now(), Signal: signal.String()}
+	log.Trace().Str("process", cmd.String()).Str("signal", record.Signal).Msg("stopping process...")
+	err := utils.SignalProcessGroup(cmd, signal)
+	if err == nil {
+		select {
+		case <-done:
+			record.Graceful = true
+		case <-time.After(p.provision.stopTimeout()):
+			log.Warn().Str("id", p.id).Str("signal", record.Signal).Msg("process didn't stop in time, killing it")
+		}
+	}
+	// whatever the command forked can outlive it, even when it stopped gracefully
+	// the rest of its group is killed
+	err = utils.KillProcess(cmd)
+	if err != nil {
+		record.Error = err.Error()
+	}
+	// the goroutine running the command reaps it, waiting on the process here
+	// as well would leave the command without its ProcessState
+	if err == nil {
+		p.Wait()
+	}
+	record.Took = time.Since(record.At).String()
+
+	p.mu.Lock()
+	p.lastStop = record
+	p.mu.Unlock()
+	log.Trace().Str("process", cmd.String()).Bool("graceful", record.Graceful).Msg("stopped")
 	return err
 }
 
-func (p *Process) Log() *bytes.Buffer {
-	return p.log
+// Alive reports if the current command of the process is still running.
+func (p *Process) Alive() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running
 }
 
-func (p *Process) Err() *bytes.Buffer {
-	return p.err
+// hasRun reports if any of the provision's commands have been started.
+func (p *Process) hasRun() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cmd != nil
+}
+
+// exitState returns how the last command exited, nil while it's running.
+func (p *Process) exitState() *os.ProcessState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
+
+// Output returns the latest lines the process wrote to stdout and stderr.
+func (p *Process) Output() *LogBuffer {
+	return p.output
+}
+
+// finish records the outcome of the process once it won't be restarted anymore.
+func (p *Process) finish(err error) {
+	p.mu.Lock()
+	p.result = err
+	p.mu.Unlock()
+	close(p.finished)
+}
+
+func (p *Process) getResult() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.result
+}
+
+func (p *Process) addError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Errors = append(p.Errors, err)
 }
 
 func (p *Process) GetErrors() []error {
-	return p.Errors
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]error{}, p.Errors...)
+}
+
+// addRestart records the restart and returns the amount of restarts so far.
+func (p *Process) addRestart(record *RestartRecord) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Restarts = append(p.Restarts, record)
+	return len(p.Restarts)
+}
+
+func (p *Process) GetRestarts() []*RestartRecord {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*RestartRecord{}, p.Restarts...)
 }
 
 func (p *Process) Wait() {
-	for range p.done {
+	p.mu.Lock()
+	done := p.done
+	p.mu.Unlock()
+	if done == nil {
+		return
+	}
+	for range done {
 	}
 }
 
 func (p *Process) Status() *BasicProcessState {
-	if p.cmd.ProcessState != nil {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd == nil {
+		return &BasicProcessState{
+			Alive:    false,
+			Status:   "waiting",
+			Restarts: len(p.Restarts),
+			LastStop: p.lastStop,
+		}
+	}
+	if !p.running {
+		status := "exited"
+		if p.state != nil {
+			status = p.state.String()
+		}
 		return &BasicProcessState{
-			false,
-			p.cmd.ProcessState.String(),
+			Alive:     false,
+			Status:    status,
+			Restarts:  len(p.Restarts),
+			LastStop:  p.lastStop,
+			OOMKilled: p.oomKilled,
 		}
 	}
 	return &BasicProcessState{
-		true,
-		fmt.Sprintf("running: %v", p.cmd.String()),
+		Alive:    true,
+		Status:   fmt.Sprintf("running: %v", p.cmd.String()),
+		Restarts: len(p.Restarts),
 	}
 }
 
 type BasicProcessState struct {
-	Alive  bool   `json:"alive"`
-	Status string `json:"status,omitempty"`
+	Alive    bool   `json:"alive"`
+	Status   string `json:"status,omitempty"`
+	Restarts int    `json:"restarts"`
+	// LastStop is set once the process has been stopped
+	LastStop *StopRecord `json:"last_stop,omitempty"`
+	// OOMKilled is set when the process exited because it ran out of memory
+	OOMKilled bool `json:"oom_killed,omitempty"`
 }
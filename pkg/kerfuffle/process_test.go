@@ -0,0 +1,121 @@
+// +build linux
+
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcess_Kill(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   string
+		graceful bool
+	}{
+		{"graceful", `trap 'echo bye; exit 0' USR1; echo ready; while true; do sleep 0.1; done`, true},
+		// the children of the shell are part of its group, they have to go as well
+		{"ignores the signal", `trap '' USR1; sleep 60 & echo ready; while true; do sleep 0.1; done`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := NewApplication(&InstallConfiguration{Repository: "https://example.com/stop", Branch: "master"})
+			app.SetAppPath(t.TempDir())
+			provision := &Provision{
+				Id:          "job",
+				Run:         [][]string{{"sh", "-c", tt.script}},
+				StopSignal:  "usr1",
+				StopTimeout: "500ms",
+			}
+			if err := provision.validate(); err != nil {
+				t.Fatal(err)
+			}
+			process := app.newProcess(provision, "job", "")
+			go func() {
+				_ = app.runProcess(process)
+			}()
+
+			deadline := time.Now().Add(time.Second * 5)
+			for !strings.Contains(process.Output().String(StreamStdout), "ready") {
+				if time.Now().After(deadline) {
+					t.Fatal("process never started")
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+
+			if err := process.Kill(); err != nil {
+				t.Fatal(err)
+			}
+			status := process.Status()
+			if status.Alive || status.LastStop == nil {
+				t.Fatalf("unexpected status %+v", status)
+			}
+			if status.LastStop.Graceful != tt.graceful || status.LastStop.Signal != "user defined signal 1" {
+				t.Errorf("unexpected stop %+v", status.LastStop)
+			}
+			if tt.graceful && !strings.Contains(process.Output().String(StreamStdout), "bye") {
+				t.Error("the process should have handled the signal")
+			}
+		})
+	}
+}
+
+func TestProcess_KillOrphans(t *testing.T) {
+	app := NewApplication(&InstallConfiguration{Repository: "https://example.com/stop", Branch: "master"})
+	app.SetAppPath(t.TempDir())
+	// the shell exits on the stop signal right away, the child it spawned ignores it
+	// and doesn't hold on to the output, so nothing waits for it
+	provision := &Provision{
+		Id:          "job",
+		Run:         [][]string{{"sh", "-c", `trap 'exit 0' TERM; (trap '' TERM; exec sleep 60 >/dev/null 2>&1) & echo "ready $!"; while true; do sleep 0.1; done`}},
+		StopTimeout: "5s",
+	}
+	if err := provision.validate(); err != nil {
+		t.Fatal(err)
+	}
+	process := app.newProcess(provision, "job", "")
+	go func() {
+		_ = app.runProcess(process)
+	}()
+
+	var child int
+	deadline := time.Now().Add(time.Second * 5)
+	for child == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("process never started")
+		}
+		time.Sleep(time.Millisecond * 10)
+		output := process.Output().String(StreamStdout)
+		if i := strings.Index(output, "ready "); i >= 0 {
+			child, _ = strconv.Atoi(strings.Fields(output[i+len("ready "):])[0])
+		}
+	}
+
+	if err := process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	if stop := process.Status().LastStop; stop == nil || !stop.Graceful {
+		t.Fatalf("expected the shell to stop gracefully, got %+v", stop)
+	}
+	// the child is gone once it's either reaped or a zombie
+	for deadline := time.Now().Add(time.Second * 5); ; {
+		stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%v/stat", child))
+		if err != nil || strings.Contains(string(stat), ") Z ") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("child %v outlived its process: %s", child, stat)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"kerfuffle/pkg/proxy_handler"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+const raceKerfuffleConfig = `
+[meta]
+name = "race-%v"
+
+[provision.web]
+run = [[%q, "-test.run=^TestHelperServer$"]]
+envs = ["KERFUFFLE_HELPER_SERVER=1", "REVISION=%v"]
+
+[proxy.web]
+host = ["race-%v.local"]
+
+[cloudflare]
+`
+
+// raceRepository creates a repository of an application serving the helper server.
+func raceRepository(t *testing.T, name string) string {
+	repository := t.TempDir()
+	gitIn(t, repository, "init")
+	gitIn(t, repository, "symbolic-ref", "HEAD", "refs/heads/master")
+	commitRaceConfig(t, repository, name, "1")
+	return repository
+}
+
+func commitRaceConfig(t *testing.T, repository, name, revision string) {
+	config := fmt.Sprintf(raceKerfuffleConfig, name, os.Args[0], revision, name)
+	err := ioutil.WriteFile(filepath.Join(repository, ".kerfuffle"), []byte(config), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitIn(t, repository, "add", ".kerfuffle")
+	gitIn(t, repository, "commit", "-m", "revision "+revision)
+}
+
+// TestManager_Concurrency installs, redeploys and reloads applications while
+// their state is being read and their routes are serving, run it with -race.
+func TestManager_Concurrency(t *testing.T) {
+	m := NewManager()
+	m.AppDataPath = t.TempDir()
+	m.HttpReverseProxyManager = proxy_handler.NewHttpReverseProxyManager()
+	handler := m.HttpReverseProxyManager.Handler(false)
+
+	names := []string{"a", "b", "c"}
+	repositories := map[string]string{}
+	for _, name := range names {
+		repositories[name] = raceRepository(t, name)
+	}
+	defer func() {
+		for _, app := range m.GetAllApplications() {
+			app.Shutdown()
+		}
+	}()
+
+	stop := make(chan interface{})
+	var readers sync.WaitGroup
+	for _, name := range names {
+		name := name
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://race-"+name+".local/", nil))
+				for _, app := range m.GetAllApplications() {
+					if _, err := json.Marshal(app); err != nil {
+						t.Error(err)
+					}
+					app.GetAllProcessStatus()
+					app.GetHealthReports()
+					app.GetAllProxies()
+					for _, id := range app.GetAllProcessIds() {
+						if process := app.GetProcess(id); process != nil {
+							_ = process.Output().Tail(&LogQuery{Lines: 10})
+						}
+					}
+				}
+			}
+		}()
+	}
+
+	// installing the same repository twice at once must only succeed once
+	var installs sync.WaitGroup
+	var lock sync.Mutex
+	installed := map[string]int{}
+	for _, name := range append(names, names[0]) {
+		name := name
+		installs.Add(1)
+		go func() {
+			defer installs.Done()
+			_, err := m.InstallFromGit(&InstallConfiguration{Repository: repositories[name]})
+			if err == nil {
+				lock.Lock()
+				installed[name]++
+				lock.Unlock()
+			}
+		}()
+	}
+	installs.Wait()
+	for _, name := range names {
+		if installed[name] != 1 {
+			t.Fatalf("expected %v to be installed once, got %v", name, installed[name])
+		}
+	}
+
+	commitRaceConfig(t, repositories["a"], "a", "2")
+	var changes sync.WaitGroup
+	for _, app := range m.GetAllApplications() {
+		app := app
+		changes.Add(2)
+		go func() {
+			defer changes.Done()
+			var err error
+			if app.InstallConfiguration.Repository == repositories["a"] {
+				err = m.Redeploy(app.ID)
+			} else {
+				err = m.ReloadProvision(app.ID, "web")
+			}
+			if err != nil && err != ErrDeployInProgress {
+				t.Errorf("%v: %v", app.ID, err)
+			}
+		}()
+		go func() {
+			defer changes.Done()
+			for i := 0; i < 10; i++ {
+				_ = m.SetAppMaintenanceMode(app.ID, i%2 == 0)
+			}
+		}()
+	}
+	changes.Wait()
+	close(stop)
+	readers.Wait()
+}
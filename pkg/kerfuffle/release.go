@@ -0,0 +1,195 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ReleaseSucceeded = "succeeded"
+	ReleaseFailed    = "failed"
+
+	TriggerInstall  = "install"
+	TriggerRedeploy = "redeploy"
+	TriggerRollback = "rollback"
+
+	// maxReleases is the amount of releases kept per application
+	maxReleases = 50
+)
+
+var (
+	ErrUnknownRelease = errors.New("commit isn't a release of the application")
+)
+
+// Release records a single deploy of an application.
+type Release struct {
+	Commit      string    `json:"commit"`
+	Message     string    `json:"message"`
+	Author      string    `json:"author"`
+	CommittedAt time.Time `json:"committed_at"`
+	DeployedAt  time.Time `json:"deployed_at"`
+	Trigger     string    `json:"trigger"`
+	// Config is the .kerfuffle file the release was deployed with.
+	Config  string `json:"config"`
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// currentRelease describes what is checked out in the application's working tree.
+func (a *Application) currentRelease() (*Release, error) {
+	out, err := a.git("log", "-n", "1", "--format=%H%x00%s%x00%an <%ae>%x00%cI")
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(out, "\x00")
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("unexpected git log output '%v'", out)
+	}
+	committedAt, err := time.Parse(time.RFC3339, fields[3])
+	if err != nil {
+		return nil, err
+	}
+
+	release := &Release{
+		Commit:      fields[0],
+		Message:     fields[1],
+		Author:      fields[2],
+		CommittedAt: committedAt,
+		DeployedAt:  time.Now(),
+	}
+	config, err := ioutil.ReadFile(filepath.Join(a.AppPath(), a.InstallConfiguration.BootstrapPath))
+	if err == nil {
+		release.Config = string(config)
+	}
+	return release, nil
+}
+
+func (m *Manager) releasesPath(id string) string {
+	return filepath.Join(m.AppDataPath, id+".releases")
+}
+
+// GetReleases returns the recorded releases of the application, oldest first.
+func (m *Manager) GetReleases(id string) ([]*Release, error) {
+	releases := []*Release{}
+	b, err := ioutil.ReadFile(m.releasesPath(id))
+	if os.IsNotExist(err) {
+		return releases, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &releases)
+	return releases, err
+}
+
+// recordRelease appends whatever is checked out in the application's working
+// tree to its release history along with the outcome of the deploy.
+func (m *Manager) recordRelease(app *Application, trigger string, deployErr error) {
+	release, err := app.currentRelease()
+	if err != nil {
+		log.Err(err).Str("app", app.ID).Msg("failed to describe release")
+		return
+	}
+	release.Trigger = trigger
+	release.Outcome = ReleaseSucceeded
+	if deployErr != nil {
+		release.Outcome = ReleaseFailed
+		release.Error = deployErr.Error()
+	}
+
+	releases, err := m.GetReleases(app.ID)
+	if err != nil {
+		log.Err(err).Str("app", app.ID).Msg("failed to read releases, starting over")
+		releases = []*Release{}
+	}
+	releases = append(releases, release)
+	if len(releases) > maxReleases {
+		releases = releases[len(releases)-maxReleases:]
+	}
+
+	b, err := json.MarshalIndent(releases, "", "  ")
+	if err != nil {
+		log.Err(err).Str("app", app.ID).Msg("failed to marshal releases")
+		return
+	}
+	err = ioutil.WriteFile(m.releasesPath(app.ID), b, 0644)
+	if err != nil {
+		log.Err(err).Str("app", app.ID).Msg("failed to save releases")
+	}
+}
+
+// FindRelease looks up a release by its commit, abbreviated commits are accepted.
+func (m *Manager) FindRelease(id, commit string) (*Release, error) {
+	if len(commit) < 4 {
+		return nil, ErrUnknownRelease
+	}
+	releases, err := m.GetReleases(id)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(releases) - 1; i >= 0; i-- {
+		if strings.HasPrefix(releases[i].Commit, commit) {
+			return releases[i], nil
+		}
+	}
+	return nil, ErrUnknownRelease
+}
+
+// Rollback checks out the commit of a previous release and deploys it. The
+// application stays on that commit until it's redeployed, and goes back to the
+// revision it was running when the release fails to boot.
+func (m *Manager) Rollback(id, commit string) error {
+	app := m.GetApplication(id)
+	if app == nil {
+		return ErrNotFound
+	}
+	release, err := m.FindRelease(id, commit)
+	if err != nil {
+		return err
+	}
+	if !atomic.CompareAndSwapInt32(&app.deploying, 0, 1) {
+		return ErrDeployInProgress
+	}
+	defer atomic.StoreInt32(&app.deploying, 0)
+
+	started := time.Now()
+	previous, err := app.git("rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	err = m.rollback(app, release)
+	m.recordRelease(app, TriggerRollback, err)
+	observeDeploy(app, TriggerRollback, started, err)
+	if err != nil {
+		log.Err(err).Str("app", app.ID).Msg("rollback failed")
+		app.setStatus(StatusFailed, fmt.Sprintf("Rollback failed: %v", err))
+		var stopped *stoppedError
+		if errors.As(err, &stopped) {
+			m.restore(app, previous)
+		}
+	}
+	return err
+}
+
+func (m *Manager) rollback(app *Application, release *Release) error {
+	app.setStatus(StatusDeploying, fmt.Sprintf("Rolling back to '%v %v'", release.Commit[:7], release.Message))
+	_, err := app.git("reset", "--hard", release.Commit)
+	if err != nil {
+		return err
+	}
+	return m.deploy(app)
+}
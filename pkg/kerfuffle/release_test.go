@@ -0,0 +1,195 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"kerfuffle/pkg/proxy_handler"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testKerfuffleConfig = `
+[meta]
+name = "release-%v"
+
+[provision.job]
+run = [["git", "--version"]]
+restart = "never"
+
+[proxy]
+
+[cloudflare]
+`
+
+// commitConfig commits a .kerfuffle file of the given version to the repository.
+func commitConfig(t *testing.T, repository, version string) {
+	err := ioutil.WriteFile(filepath.Join(repository, ".kerfuffle"), []byte(fmt.Sprintf(testKerfuffleConfig, version)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitIn(t, repository, "add", ".kerfuffle")
+	gitIn(t, repository, "commit", "-m", "release "+version)
+}
+
+func gitIn(t *testing.T, dir string, args ...string) string {
+	args = append([]string{"-c", "user.name=Kerfuffle", "-c", "user.email=kerfuffle@example.com"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	b, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v %s", args, err, b)
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func TestManager_Rollback(t *testing.T) {
+	repository := t.TempDir()
+	gitIn(t, repository, "init")
+	gitIn(t, repository, "symbolic-ref", "HEAD", "refs/heads/master")
+	commitConfig(t, repository, "1")
+	first := gitIn(t, repository, "rev-parse", "HEAD")
+
+	m := NewManager()
+	m.AppDataPath = t.TempDir()
+	m.HttpReverseProxyManager = proxy_handler.NewHttpReverseProxyManager()
+	app, err := m.InstallFromGit(&InstallConfiguration{Repository: repository})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Shutdown()
+
+	commitConfig(t, repository, "2")
+	if err := m.Redeploy(app.ID); err != nil {
+		t.Fatal(err)
+	}
+	if app.Meta.Name != "release-2" {
+		t.Fatalf("expected release-2 to be deployed, got %v", app.Meta.Name)
+	}
+
+	if err := m.Rollback(app.ID, "0000000"); err != ErrUnknownRelease {
+		t.Errorf("expected %v, got %v", ErrUnknownRelease, err)
+	}
+	if err := m.Rollback(app.ID, first[:7]); err != nil {
+		t.Fatal(err)
+	}
+	if app.Meta.Name != "release-1" {
+		t.Errorf("expected release-1 after the rollback, got %v", app.Meta.Name)
+	}
+
+	releases, err := m.GetReleases(app.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var triggers []string
+	for _, release := range releases {
+		triggers = append(triggers, release.Trigger)
+		if release.Outcome != ReleaseSucceeded || release.Author != "Kerfuffle <kerfuffle@example.com>" {
+			t.Errorf("unexpected release %+v", release)
+		}
+	}
+	if fmt.Sprint(triggers) != "[install redeploy rollback]" {
+		t.Errorf("unexpected releases %v", triggers)
+	}
+	if last := releases[len(releases)-1]; last.Commit != first || !strings.Contains(last.Config, "release-1") {
+		t.Errorf("rollback recorded the wrong release %+v", last)
+	}
+}
+
+func TestManager_RedeployRestoresPreviousRevision(t *testing.T) {
+	repository := t.TempDir()
+	gitIn(t, repository, "init")
+	gitIn(t, repository, "symbolic-ref", "HEAD", "refs/heads/master")
+	commitConfig(t, repository, "1")
+	first := gitIn(t, repository, "rev-parse", "HEAD")
+
+	m := NewManager()
+	m.AppDataPath = t.TempDir()
+	m.HttpReverseProxyManager = proxy_handler.NewHttpReverseProxyManager()
+	app, err := m.InstallFromGit(&InstallConfiguration{Repository: repository})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Shutdown()
+
+	// the init of the new revision fails after the running one was stopped
+	config := fmt.Sprintf(testKerfuffleConfig, "2") + `
+[provision.init]
+run = [["sh", "-c", "exit 1"]]
+restart = "never"
+`
+	err = ioutil.WriteFile(filepath.Join(repository, ".kerfuffle"), []byte(config), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitIn(t, repository, "commit", "-am", "broken init")
+	if err := m.Redeploy(app.ID); err == nil {
+		t.Fatal("expected the redeploy to fail")
+	}
+	if app.Meta.Name != "release-1" {
+		t.Errorf("expected release-1 to be restored, got %v", app.Meta.Name)
+	}
+	if head := gitIn(t, app.AppPath(), "rev-parse", "HEAD"); head != first {
+		t.Errorf("expected the previous revision to be checked out, got %v", head)
+	}
+	if status := app.GetStatus(); status.Flag == StatusFailed {
+		t.Errorf("expected the application to be restored, got %+v", status)
+	}
+}
+
+func TestManager_RollbackRestoresPreviousRevision(t *testing.T) {
+	repository := t.TempDir()
+	gitIn(t, repository, "init")
+	gitIn(t, repository, "symbolic-ref", "HEAD", "refs/heads/master")
+	commitConfig(t, repository, "1")
+
+	m := NewManager()
+	m.AppDataPath = t.TempDir()
+	m.HttpReverseProxyManager = proxy_handler.NewHttpReverseProxyManager()
+	app, err := m.InstallFromGit(&InstallConfiguration{Repository: repository})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Shutdown()
+
+	config := fmt.Sprintf(testKerfuffleConfig, "2") + `
+[provision.init]
+run = [["sh", "-c", "exit 1"]]
+restart = "never"
+`
+	err = ioutil.WriteFile(filepath.Join(repository, ".kerfuffle"), []byte(config), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitIn(t, repository, "commit", "-am", "broken init")
+	broken := gitIn(t, repository, "rev-parse", "HEAD")
+	if err := m.Redeploy(app.ID); err == nil {
+		t.Fatal("expected the redeploy to fail")
+	}
+	commitConfig(t, repository, "3")
+	third := gitIn(t, repository, "rev-parse", "HEAD")
+	if err := m.Redeploy(app.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// the release rolled back to doesn't boot, the running one comes back up
+	if err := m.Rollback(app.ID, broken[:7]); err == nil {
+		t.Fatal("expected the rollback to fail")
+	}
+	if app.Meta.Name != "release-3" {
+		t.Errorf("expected release-3 to be restored, got %v", app.Meta.Name)
+	}
+	if head := gitIn(t, app.AppPath(), "rev-parse", "HEAD"); head != third {
+		t.Errorf("expected the previous revision to be checked out, got %v", head)
+	}
+	if status := app.GetStatus(); status.Flag == StatusFailed {
+		t.Errorf("expected the application to be restored, got %+v", status)
+	}
+}
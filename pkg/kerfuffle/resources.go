@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"kerfuffle/pkg/utils"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// cgroupSequence tells apart the cgroups of processes sharing an id, like the
+// replicas started next to the old ones by a blue/green deployment.
+var cgroupSequence uint64
+
+// cgroupName returns a new cgroup name for the process, <app>/<process>-<n>, with
+// the characters cgroup names can't contain replaced.
+func (a *Application) cgroupName(process *Process) string {
+	name := fmt.Sprintf("%v-%v", process.id, atomic.AddUint64(&cgroupSequence, 1))
+	return filepath.Join(strings.ReplaceAll(a.ID, "/", "_"), strings.ReplaceAll(name, "/", "_"))
+}
+
+// attachCgroup creates the cgroup of the process if its provision has resource limits,
+// the commands of the process are moved into it once they start.
+func (a *Application) attachCgroup(process *Process) error {
+	limits := process.provision.limits()
+	if limits == nil {
+		return nil
+	}
+	process.mu.Lock()
+	defer process.mu.Unlock()
+	if process.cgroup != nil {
+		return nil
+	}
+	cgroup, err := utils.NewCgroup(a.cgroupRoot, a.cgroupName(process), limits)
+	if err != nil {
+		return fmt.Errorf("failed to apply resource limits: %w", err)
+	}
+	log.Debug().Str("id", process.id).Str("cgroup", cgroup.Path).Interface("limits", limits).Msg("created cgroup")
+	process.cgroup = cgroup
+	return nil
+}
+
+// releaseCgroup removes the cgroup of the process once it won't run anymore.
+func (a *Application) releaseCgroup(process *Process) {
+	process.mu.Lock()
+	cgroup := process.cgroup
+	process.cgroup = nil
+	process.mu.Unlock()
+	if cgroup == nil {
+		return
+	}
+	if err := cgroup.Remove(); err != nil {
+		log.Err(err).Str("id", process.id).Str("cgroup", cgroup.Path).Msg("failed to remove cgroup")
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"kerfuffle/pkg/utils"
+	"strings"
+	"testing"
+)
+
+func TestProvision_Limits(t *testing.T) {
+	provision := &Provision{Id: "web", MemoryMax: "1.5G", CPUWeight: 200}
+	if err := provision.validate(); err != nil {
+		t.Fatal(err)
+	}
+	limits := provision.limits()
+	if limits == nil || limits.MemoryMax != 3<<29 || limits.CPUWeight != 200 {
+		t.Errorf("unexpected limits %+v", limits)
+	}
+	if (&Provision{}).limits() != nil {
+		t.Error("provisions without limits shouldn't get a cgroup")
+	}
+
+	for _, invalid := range []*Provision{{MemoryMax: "lots"}, {CPUWeight: 10001}, {IOWeight: -1}, {PidsMax: -1}} {
+		if err := invalid.validate(); err == nil {
+			t.Errorf("%+v should be invalid", invalid)
+		}
+	}
+}
+
+func TestApplication_OOMKilled(t *testing.T) {
+	probe, err := utils.NewCgroup("", "probe", &utils.CgroupLimits{MemoryMax: 1 << 20})
+	if err != nil {
+		t.Skipf("cgroups v2 with the memory controller aren't available: %v", err)
+	}
+	_ = probe.Remove()
+
+	app := NewApplication(&InstallConfiguration{Repository: "https://example.com/limits", Branch: "master"})
+	app.SetAppPath(t.TempDir())
+	provision := &Provision{
+		Id:        "hog",
+		MemoryMax: "16M",
+		// tail keeps the whole line in memory, which never ends
+		Run: [][]string{{"sh", "-c", "head -c 268435456 /dev/zero | tail"}},
+	}
+	process := app.newProcess(provision, "hog", "")
+	if err := app.superviseProcess(process); err == nil {
+		t.Fatal("the process should have been killed")
+	}
+
+	if !process.Status().OOMKilled {
+		t.Errorf("the process should have been reported as out of memory, got %+v", process.Status())
+	}
+	if status := app.GetStatus(); status == nil || status.Flag != StatusOOMKilled || !strings.Contains(status.Reason, "ran out of memory") {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if process.cgroup != nil {
+		t.Error("the cgroup should have been released")
+	}
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const (
+	RestartAlways    = "always"
+	RestartOnFailure = "on-failure"
+	RestartNever     = "never"
+
+	defaultRestartBackoff    = time.Second
+	defaultRestartMaxBackoff = time.Minute
+
+	// a provision restarting crashLoopRestarts times within crashLoopWindow is
+	// considered to be crash looping and won't be restarted anymore.
+	crashLoopRestarts = 5
+	crashLoopWindow   = time.Minute
+)
+
+var (
+	StatusRestarting = "restarting"
+	StatusCrashLoop  = "crash_loop"
+	StatusOOMKilled  = "oom_killed"
+)
+
+// RestartRecord describes how a process exited before being restarted by the supervisor.
+type RestartRecord struct {
+	At       time.Time `json:"at"`
+	ExitCode int       `json:"exit_code"`
+	Signal   string    `json:"signal,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	// OOMKilled is set when the process hit the provision's memory_max
+	OOMKilled bool `json:"oom_killed,omitempty"`
+}
+
+func newRestartRecord(process *Process, err error) *RestartRecord {
+	record := &RestartRecord{At: time.Now(), ExitCode: -1, OOMKilled: process.wasOOMKilled()}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	var exitErr *exec.ExitError
+	state := process.exitState()
+	if errors.As(err, &exitErr) {
+		state = exitErr.ProcessState
+	}
+	if state == nil {
+		return record
+	}
+	record.ExitCode = state.ExitCode()
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		record.Signal = status.Signal().String()
+	}
+	return record
+}
+
+func (r *RestartRecord) String() string {
+	if r.OOMKilled {
+		return "ran out of memory"
+	}
+	if r.Signal != "" {
+		return fmt.Sprintf("killed by %v", r.Signal)
+	}
+	return fmt.Sprintf("exit code %v", r.ExitCode)
+}
+
+func shouldRestart(policy string, err error) bool {
+	switch policy {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return err != nil
+	}
+	return false
+}
+
+// superviseProcess runs the process and keeps reviving it according to the
+// provision's restart policy, backing off exponentially between restarts.
+func (a *Application) superviseProcess(process *Process) (err error) {
+	defer func() {
+		a.releaseCgroup(process)
+		process.finish(err)
+	}()
+	provision := process.provision
+	initialBackoff := durationOr(provision.RestartBackoff, defaultRestartBackoff)
+	maxBackoff := durationOr(provision.RestartMaxBackoff, defaultRestartMaxBackoff)
+	backoff := initialBackoff
+	var recent []time.Time
+
+	for {
+		started := time.Now()
+		err = a.runProcess(process)
+		if process.isStopped() || !process.hasRun() || !shouldRestart(provision.Restart, err) {
+			return err
+		}
+
+		record := newRestartRecord(process, err)
+		if restarts := len(process.GetRestarts()); provision.MaxRetries > 0 && restarts >= provision.MaxRetries {
+			flag := StatusCrashed
+			if record.OOMKilled {
+				flag = StatusOOMKilled
+			}
+			a.setStatus(flag, fmt.Sprintf("Provision '%v' exited (%v), giving up after %v restarts", process.id, record, restarts))
+			return err
+		}
+
+		// a process which stayed up for a while starts over with the initial backoff
+		if time.Since(started) > crashLoopWindow {
+			backoff = initialBackoff
+		}
+
+		var inWindow []time.Time
+		for _, at := range recent {
+			if time.Since(at) < crashLoopWindow {
+				inWindow = append(inWindow, at)
+			}
+		}
+		recent = append(inWindow, record.At)
+		if len(recent) > crashLoopRestarts {
+			a.setStatus(StatusCrashLoop, fmt.Sprintf("Provision '%v' is crash looping, restarted %v times within %v", process.id, crashLoopRestarts, crashLoopWindow))
+			return err
+		}
+
+		restarts := process.addRestart(record)
+		log.Warn().Str("id", process.id).Interface("exit", record).Dur("backoff", backoff).Msg("restarting provision")
+		a.setStatus(StatusRestarting, fmt.Sprintf("Provision '%v' exited (%v), restarting in %v (restart #%v)", process.id, record, backoff, restarts))
+
+		select {
+		case <-process.stop:
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
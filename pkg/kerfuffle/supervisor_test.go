@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHelperExit isn't a real test, it's the provision supervised by the tests
+// below. It exits right away with the EXIT_CODE environment variable.
+func TestHelperExit(t *testing.T) {
+	if os.Getenv("KERFUFFLE_HELPER_EXIT") != "1" {
+		t.Skip("helper process")
+	}
+	code, _ := strconv.Atoi(os.Getenv("EXIT_CODE"))
+	os.Exit(code)
+}
+
+func exitingProvision(code int, restart string, maxRetries int, backoff string) *Provision {
+	return &Provision{
+		Id:  "worker",
+		Run: [][]string{{os.Args[0], "-test.run=^TestHelperExit$"}},
+		EnvironmentVariables: []string{
+			"KERFUFFLE_HELPER_EXIT=1",
+			fmt.Sprintf("EXIT_CODE=%v", code),
+		},
+		Restart:           restart,
+		MaxRetries:        maxRetries,
+		RestartBackoff:    backoff,
+		RestartMaxBackoff: "1s",
+	}
+}
+
+func TestApplication_SuperviseProcess(t *testing.T) {
+	supervise := func(provision *Provision) (*Application, *Process, error) {
+		app := NewApplication(&InstallConfiguration{Repository: "https://example.com/supervisor", Branch: "master"})
+		app.SetAppPath(t.TempDir())
+		process := app.newProcess(provision, "worker", "")
+		done := make(chan error, 1)
+		go func() {
+			done <- app.superviseProcess(process)
+		}()
+		select {
+		case err := <-done:
+			return app, process, err
+		case <-time.After(time.Second * 30):
+			_ = process.Kill()
+			t.Fatal("the supervisor didn't give up")
+		}
+		return nil, nil, nil
+	}
+
+	t.Run("policies", func(t *testing.T) {
+		for _, test := range []struct {
+			name     string
+			code     int
+			restart  string
+			restarts int
+		}{
+			{"on-failure after a success", 0, RestartOnFailure, 0},
+			{"never after a failure", 1, RestartNever, 0},
+			{"default after a failure", 1, "", 0},
+			{"always after a success", 0, RestartAlways, 2},
+			{"on-failure after a failure", 1, RestartOnFailure, 2},
+		} {
+			_, process, err := supervise(exitingProvision(test.code, test.restart, 2, "10ms"))
+			if restarts := len(process.GetRestarts()); restarts != test.restarts {
+				t.Errorf("%v: expected %v restarts, got %v", test.name, test.restarts, restarts)
+			}
+			if (err != nil) != (test.code != 0) {
+				t.Errorf("%v: unexpected error %v", test.name, err)
+			}
+		}
+	})
+
+	t.Run("backoff", func(t *testing.T) {
+		app, process, err := supervise(exitingProvision(3, RestartOnFailure, 3, "50ms"))
+		if err == nil {
+			t.Fatal("expected the exit to be returned")
+		}
+		restarts := process.GetRestarts()
+		if len(restarts) != 3 {
+			t.Fatalf("expected 3 restarts, got %v", len(restarts))
+		}
+		for i, record := range restarts {
+			if record.ExitCode != 3 || record.Signal != "" || record.String() != "exit code 3" {
+				t.Errorf("unexpected restart %+v", record)
+			}
+			// every restart waits twice as long as the previous one
+			if i > 0 {
+				if waited, backoff := record.At.Sub(restarts[i-1].At), time.Millisecond*50<<(i-1); waited < backoff {
+					t.Errorf("restart #%v came after %v, expected at least %v", i+1, waited, backoff)
+				}
+			}
+		}
+
+		var reasons []string
+		for _, status := range app.GetStatuses() {
+			reasons = append(reasons, status.Reason)
+		}
+		for _, expected := range []string{"restarting in 50ms (restart #1)", "restarting in 100ms (restart #2)", "restarting in 200ms (restart #3)"} {
+			if !strings.Contains(strings.Join(reasons, "\n"), expected) {
+				t.Errorf("expected a status %q, got %v", expected, reasons)
+			}
+		}
+		if status := app.GetStatus(); status.Flag != StatusCrashed || !strings.Contains(status.Reason, "giving up after 3 restarts") {
+			t.Errorf("expected the supervisor to give up, got %+v", status)
+		}
+	})
+
+	t.Run("crash loop", func(t *testing.T) {
+		provision := exitingProvision(1, RestartAlways, 0, "1ms")
+		provision.RestartMaxBackoff = "1ms"
+		app, process, _ := supervise(provision)
+		if restarts := len(process.GetRestarts()); restarts != crashLoopRestarts {
+			t.Errorf("expected %v restarts, got %v", crashLoopRestarts, restarts)
+		}
+		if status := app.GetStatus(); status.Flag != StatusCrashLoop {
+			t.Errorf("expected a crash loop, got %+v", status)
+		}
+	})
+}
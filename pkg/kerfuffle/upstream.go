@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"kerfuffle/pkg/metrics"
+	"kerfuffle/pkg/proxy_handler"
+	"time"
+)
+
+// maxUpstreamFailures is how many of the latest failures are kept per application.
+const maxUpstreamFailures = 100
+
+var upstreamFailures = metrics.Default.NewCounter("kerfuffle_upstream_failures_total",
+	"Requests the processes of an application failed to answer, by why they failed.", "app", "proxy", "kind")
+
+// UpstreamFailure is a request the proxy couldn't get answered by the application.
+type UpstreamFailure struct {
+	At     time.Time `json:"at"`
+	Proxy  string    `json:"proxy"`
+	Route  string    `json:"route"`
+	Kind   string    `json:"kind"`
+	Status int       `json:"status"`
+	// Retried is set when the request was sent on to another replica
+	Retried bool   `json:"retried"`
+	Error   string `json:"error"`
+	// Process is the replica which failed, empty for backends kerfuffle doesn't manage
+	Process string `json:"process,omitempty"`
+	// ProcessState is the state of the replica when it failed, e.g. how it exited
+	ProcessState *BasicProcessState `json:"process_state,omitempty"`
+}
+
+func (a *Application) recordUpstreamFailure(failure *UpstreamFailure) {
+	a.failureLock.Lock()
+	defer a.failureLock.Unlock()
+	a.failures = append(a.failures, failure)
+	if len(a.failures) > maxUpstreamFailures {
+		a.failures = append([]*UpstreamFailure{}, a.failures[len(a.failures)-maxUpstreamFailures:]...)
+	}
+}
+
+// GetUpstreamFailures returns the latest requests the application failed to answer, oldest first.
+func (a *Application) GetUpstreamFailures() []*UpstreamFailure {
+	a.failureLock.Lock()
+	defer a.failureLock.Unlock()
+	return append([]*UpstreamFailure{}, a.failures...)
+}
+
+// upstreamFailureRecorder records the failures of a proxy's routes against the application.
+func (m *Manager) upstreamFailureRecorder(app *Application, proxyID string) func(*proxy_handler.UpstreamError) {
+	return func(failure *proxy_handler.UpstreamError) {
+		record := &UpstreamFailure{
+			At:      time.Now(),
+			Proxy:   proxyID,
+			Route:   failure.Route,
+			Kind:    failure.Kind,
+			Status:  failure.Status,
+			Retried: failure.Retried,
+			Error:   failure.Err.Error(),
+		}
+		if failure.Backend != nil && failure.Backend.Name != "" {
+			record.Process = failure.Backend.Name
+			if process := app.GetProcess(record.Process); process != nil {
+				record.ProcessState = process.Status()
+			}
+		}
+		app.recordUpstreamFailure(record)
+		upstreamFailures.Inc(app.ID, proxyID, failure.Kind)
+	}
+}
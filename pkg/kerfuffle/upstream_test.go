@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"kerfuffle/pkg/proxy_handler"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestManager_UpstreamFailures(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	target, err := url.Parse(closed.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewManager()
+	m.AppDataPath = t.TempDir()
+	m.HttpReverseProxyManager = proxy_handler.NewHttpReverseProxyManager()
+	app := NewApplication(&InstallConfiguration{Repository: "https://example.com/upstream", Branch: "master"})
+	app.proxies = map[string]*Proxy{"web": {Host: []string{"upstream.local"}, Ports: []string{target.Port()}}}
+	m.applications[app.ID] = app
+	if err := m.bootstrapProxies(app); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := m.HttpReverseProxyManager.Handler(false)
+	for i := 0; i < maxUpstreamFailures+1; i++ {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest("GET", "http://upstream.local/", nil))
+		if res.Code != http.StatusBadGateway {
+			t.Fatalf("expected a bad gateway, got %v", res.Code)
+		}
+	}
+
+	failures := app.GetUpstreamFailures()
+	if len(failures) != maxUpstreamFailures {
+		t.Fatalf("expected the latest %v failures to be kept, got %v", maxUpstreamFailures, len(failures))
+	}
+	failure := failures[len(failures)-1]
+	if failure.Proxy != "web" || failure.Route != "upstream.local" || failure.Kind != proxy_handler.FailureRefused || failure.Process != "" {
+		t.Errorf("unexpected failure %+v", failure)
+	}
+	if value := upstreamFailures.Value(app.ID, "web", proxy_handler.FailureRefused); value != maxUpstreamFailures+1 {
+		t.Errorf("expected every failure to be counted, got %v", value)
+	}
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"github.com/rs/zerolog/log"
+	"github.com/shirou/gopsutil/process"
+	"kerfuffle/pkg/utils"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	sampleInterval = time.Second * 5
+	// sampleHistorySize is the amount of samples kept per process, 10 minutes worth
+	sampleHistorySize = 120
+)
+
+// ResourceSample is the resource usage of a process along with everything it spawned.
+type ResourceSample struct {
+	At         time.Time `json:"at"`
+	CPUPercent float64   `json:"cpu_percent"`
+	RSS        uint64    `json:"rss"`
+	OpenFiles  int32     `json:"open_files"`
+	Threads    int32     `json:"threads"`
+	Children   int       `json:"children"`
+}
+
+// ProcessResources is the status of a process and its recent resource usage.
+type ProcessResources struct {
+	Id      string             `json:"id"`
+	Status  *BasicProcessState `json:"status"`
+	Samples []*ResourceSample  `json:"samples"`
+}
+
+// resourceHistory keeps the latest samples of a process, along with the cpu
+// time of every process in the tree to work out the usage since the last sample.
+type resourceHistory struct {
+	sync.Mutex
+	samples  []*ResourceSample
+	cpuTimes map[int32]float64
+	at       time.Time
+}
+
+func (h *resourceHistory) get() []*ResourceSample {
+	h.Lock()
+	defer h.Unlock()
+	return append([]*ResourceSample{}, h.samples...)
+}
+
+// sample measures the process tree rooted at pid and records it.
+func (h *resourceHistory) sample(pid int32, children map[int32][]int32) *ResourceSample {
+	h.Lock()
+	defer h.Unlock()
+	descendants := utils.Descendants(children, pid)
+	sample := &ResourceSample{At: time.Now(), Children: len(descendants)}
+	cpuTimes := map[int32]float64{}
+	var cpuTime float64
+	for _, id := range append([]int32{pid}, descendants...) {
+		proc, err := process.NewProcess(id)
+		if err != nil {
+			continue
+		}
+		// the metrics which aren't available on the platform are left at zero
+		if times, err := proc.Times(); err == nil {
+			cpuTimes[id] = times.User + times.System
+			// processes which weren't there last time spent all of it since then
+			cpuTime += cpuTimes[id] - h.cpuTimes[id]
+		}
+		if memory, err := proc.MemoryInfo(); err == nil {
+			sample.RSS += memory.RSS
+		}
+		if fds, err := proc.NumFDs(); err == nil {
+			sample.OpenFiles += fds
+		}
+		if threads, err := proc.NumThreads(); err == nil {
+			sample.Threads += threads
+		}
+	}
+
+	since := h.at
+	if since.IsZero() {
+		if proc, err := process.NewProcess(pid); err == nil {
+			if created, err := proc.CreateTime(); err == nil {
+				since = time.Unix(0, created*int64(time.Millisecond))
+			}
+		}
+	}
+	if elapsed := sample.At.Sub(since).Seconds(); !since.IsZero() && elapsed > 0 && cpuTime > 0 {
+		sample.CPUPercent = cpuTime / elapsed * 100
+	}
+
+	h.cpuTimes, h.at = cpuTimes, sample.At
+	h.samples = append(h.samples, sample)
+	if len(h.samples) > sampleHistorySize {
+		h.samples = h.samples[len(h.samples)-sampleHistorySize:]
+	}
+	return sample
+}
+
+// reset forgets the cpu times once the command exited, the next one starts over.
+func (h *resourceHistory) reset() {
+	h.Lock()
+	defer h.Unlock()
+	h.cpuTimes, h.at = nil, time.Time{}
+}
+
+// pid returns the id of the running command, 0 when there's none.
+func (p *Process) pid() int32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.running || p.cmd.Process == nil {
+		return 0
+	}
+	return int32(p.cmd.Process.Pid)
+}
+
+// GetResources returns the recent resource usage of the process.
+func (p *Process) GetResources() []*ResourceSample {
+	return p.resources.get()
+}
+
+// sampleResources records the resource usage of every running process.
+func (a *Application) sampleResources() {
+	processes := a.processes()
+	if len(processes) == 0 {
+		return
+	}
+	children, err := utils.ProcessChildren()
+	if err != nil {
+		log.Err(err).Str("app", a.ID).Msg("failed to list processes")
+		return
+	}
+	for _, process := range processes {
+		pid := process.pid()
+		if pid == 0 {
+			process.resources.reset()
+			continue
+		}
+		process.resources.sample(pid, children)
+	}
+}
+
+// startSampler periodically samples the resource usage of the processes until Shutdown.
+func (a *Application) startSampler() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.samplerStop != nil {
+		return
+	}
+	stop := make(chan interface{})
+	a.samplerStop = stop
+	go func() {
+		ticker := time.NewTicker(sampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				a.sampleResources()
+			}
+		}
+	}()
+}
+
+func (a *Application) stopSampler() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.samplerStop != nil {
+		close(a.samplerStop)
+		a.samplerStop = nil
+	}
+}
+
+// GetProcessResources returns the status and recent resource usage of every process, ordered by id.
+func (a *Application) GetProcessResources() []*ProcessResources {
+	var resources []*ProcessResources
+	for id, process := range a.processes() {
+		resources = append(resources, &ProcessResources{
+			Id:      id,
+			Status:  process.Status(),
+			Samples: process.GetResources(),
+		})
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i].Id < resources[j].Id
+	})
+	return resources
+}
@@ -0,0 +1,54 @@
+// +build linux
+
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplication_SampleResources(t *testing.T) {
+	app := NewApplication(&InstallConfiguration{Repository: "https://example.com/usage", Branch: "master"})
+	app.SetAppPath(t.TempDir())
+	provision := &Provision{
+		Id:  "busy",
+		Run: [][]string{{"sh", "-c", "sleep 60 & sleep 60 & echo ready; while true; do :; done"}},
+	}
+	process := app.newProcess(provision, "busy", "")
+	go func() {
+		_ = app.runProcess(process)
+	}()
+	defer app.Shutdown()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for !strings.Contains(process.Output().String(StreamStdout), "ready") {
+		if time.Now().After(deadline) {
+			t.Fatal("process never started")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	app.sampleResources()
+	time.Sleep(time.Millisecond * 500)
+	app.sampleResources()
+
+	resources := app.GetProcessResources()
+	if len(resources) != 1 || len(resources[0].Samples) != 2 {
+		t.Fatalf("unexpected resources %+v", resources)
+	}
+	sample := resources[0].Samples[1]
+	if sample.Children != 2 || sample.Threads < 3 || sample.RSS == 0 || sample.OpenFiles == 0 {
+		t.Errorf("unexpected sample %+v", sample)
+	}
+	// the shell spins on a core the whole time
+	if sample.CPUPercent < 20 {
+		t.Errorf("expected the cpu usage of the loop, got %v%%", sample.CPUPercent)
+	}
+}
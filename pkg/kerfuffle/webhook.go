@@ -0,0 +1,340 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package kerfuffle
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// deployPollInterval is how often a queued redeploy checks whether the running deploy is done.
+const deployPollInterval = time.Millisecond * 500
+
+const (
+	ProviderGitHub = "github"
+	ProviderGitLab = "gitlab"
+	ProviderGitea  = "gitea"
+)
+
+var (
+	ErrUnknownProvider       = errors.New("unknown webhook provider")
+	ErrNotPushEvent          = errors.New("not a push event")
+	ErrInvalidSignature      = errors.New("invalid webhook signature")
+	ErrNoMatchingApplication = errors.New("no application matches the pushed repository and branch")
+)
+
+// PushEvent is the provider agnostic representation of a push webhook.
+type PushEvent struct {
+	Provider string `json:"provider"`
+	// Repositories holds every URL of the repository found in the payload.
+	Repositories []string `json:"repositories"`
+	Branch       string   `json:"branch"`
+	Commit       string   `json:"commit"`
+}
+
+type pushPayloadRepository struct {
+	CloneURL   string `json:"clone_url"`
+	SshURL     string `json:"ssh_url"`
+	HtmlURL    string `json:"html_url"`
+	GitURL     string `json:"git_url"`
+	GitHttpURL string `json:"git_http_url"`
+	GitSshURL  string `json:"git_ssh_url"`
+	WebURL     string `json:"web_url"`
+	URL        string `json:"url"`
+	Homepage   string `json:"homepage"`
+}
+
+func (r *pushPayloadRepository) urls() []string {
+	var urls []string
+	for _, u := range []string{r.CloneURL, r.SshURL, r.HtmlURL, r.GitURL, r.GitHttpURL, r.GitSshURL, r.WebURL, r.URL, r.Homepage} {
+		if u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// pushPayload covers the fields used from GitHub, GitLab and Gitea push payloads.
+type pushPayload struct {
+	Ref         string                 `json:"ref"`
+	After       string                 `json:"after"`
+	CheckoutSha string                 `json:"checkout_sha"`
+	Repository  *pushPayloadRepository `json:"repository"`
+	Project     *pushPayloadRepository `json:"project"`
+}
+
+// DetectWebhookProvider figures out who sent the webhook from its headers.
+func DetectWebhookProvider(header http.Header) string {
+	// Gitea also sends the GitHub headers for compatibility, so it has to be checked first
+	switch {
+	case header.Get("X-Gitea-Event") != "":
+		return ProviderGitea
+	case header.Get("X-Gitlab-Event") != "":
+		return ProviderGitLab
+	case header.Get("X-GitHub-Event") != "":
+		return ProviderGitHub
+	}
+	return ""
+}
+
+// ParsePushEvent decodes a push webhook, other events return ErrNotPushEvent.
+func ParsePushEvent(header http.Header, body []byte) (*PushEvent, error) {
+	provider := DetectWebhookProvider(header)
+	var event string
+	switch provider {
+	case ProviderGitea:
+		event = header.Get("X-Gitea-Event")
+	case ProviderGitLab:
+		event = header.Get("X-Gitlab-Event")
+	case ProviderGitHub:
+		event = header.Get("X-GitHub-Event")
+	default:
+		return nil, ErrUnknownProvider
+	}
+	if event != "push" && event != "Push Hook" {
+		return nil, ErrNotPushEvent
+	}
+
+	payload := &pushPayload{}
+	err := json.Unmarshal(body, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// tag pushes can't be deployed
+	if !strings.HasPrefix(payload.Ref, "refs/heads/") {
+		return nil, ErrNotPushEvent
+	}
+
+	push := &PushEvent{
+		Provider: provider,
+		Branch:   strings.TrimPrefix(payload.Ref, "refs/heads/"),
+		Commit:   payload.After,
+	}
+	if payload.CheckoutSha != "" {
+		push.Commit = payload.CheckoutSha
+	}
+	for _, repository := range []*pushPayloadRepository{payload.Repository, payload.Project} {
+		if repository != nil {
+			push.Repositories = append(push.Repositories, repository.urls()...)
+		}
+	}
+	if len(push.Repositories) == 0 {
+		return nil, errors.New("payload doesn't contain a repository")
+	}
+	return push, nil
+}
+
+// VerifyWebhookSignature checks the webhook against the application's secret.
+// GitHub and Gitea sign the body with HMAC-SHA256 while GitLab sends the secret as is.
+func VerifyWebhookSignature(header http.Header, body []byte, secret string) error {
+	switch DetectWebhookProvider(header) {
+	case ProviderGitLab:
+		token := header.Get("X-Gitlab-Token")
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			return ErrInvalidSignature
+		}
+		return nil
+	case ProviderGitea:
+		return verifyHMAC(header.Get("X-Gitea-Signature"), body, secret)
+	case ProviderGitHub:
+		return verifyHMAC(strings.TrimPrefix(header.Get("X-Hub-Signature-256"), "sha256="), body, secret)
+	}
+	return ErrUnknownProvider
+}
+
+func verifyHMAC(signature string, body []byte, secret string) error {
+	expected, err := hex.DecodeString(signature)
+	if err != nil || len(expected) == 0 {
+		return ErrInvalidSignature
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// normalizeRepository reduces the different forms of a repository URL
+// (https, ssh, scp-like, with or without .git) to "host/owner/name".
+func normalizeRepository(repository string) string {
+	r := strings.ToLower(strings.TrimSpace(repository))
+	if i := strings.Index(r, "://"); i != -1 {
+		r = r[i+3:]
+	} else if i := strings.Index(r, ":"); i != -1 && !strings.Contains(r[:i], "/") {
+		// scp-like syntax, git@host:owner/name
+		r = r[:i] + "/" + r[i+1:]
+	}
+	if i := strings.Index(r, "@"); i != -1 && i < strings.Index(r+"/", "/") {
+		r = r[i+1:]
+	}
+	// drop the port from the host
+	if slash := strings.Index(r, "/"); slash != -1 {
+		if colon := strings.Index(r[:slash], ":"); colon != -1 {
+			r = r[:colon] + r[slash:]
+		}
+	}
+	r = strings.TrimSuffix(r, "/")
+	return strings.TrimSuffix(r, ".git")
+}
+
+func (e *PushEvent) matches(config *InstallConfiguration) bool {
+	if config.Branch != e.Branch {
+		return false
+	}
+	repository := normalizeRepository(config.Repository)
+	for _, r := range e.Repositories {
+		if normalizeRepository(r) == repository {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) webhookSecretPath(id string) string {
+	return filepath.Join(m.AppDataPath, id+".webhook-secret")
+}
+
+func (m *Manager) readWebhookSecret(id string) (string, error) {
+	b, err := ioutil.ReadFile(m.webhookSecretPath(id))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// WebhookSecret returns the application's webhook secret, generating one if it doesn't exist yet.
+func (m *Manager) WebhookSecret(id string) (string, error) {
+	secret, err := m.readWebhookSecret(id)
+	if err == nil {
+		return secret, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	return m.RegenerateWebhookSecret(id)
+}
+
+// RegenerateWebhookSecret replaces the application's webhook secret with a new random one.
+func (m *Manager) RegenerateWebhookSecret(id string) (string, error) {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(b)
+	err = ioutil.WriteFile(m.webhookSecretPath(id), []byte(secret), 0600)
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// verifiedApplications returns the applications whose secret verifies the webhook.
+// Nothing else about the webhook is answered before it's verified, so senders can't
+// probe which repositories and branches are deployed.
+func (m *Manager) verifiedApplications(header http.Header, body []byte) ([]*Application, error) {
+	if DetectWebhookProvider(header) == "" {
+		return nil, ErrUnknownProvider
+	}
+	var verified []*Application
+	for _, app := range m.GetAllApplications() {
+		// applications which never had a secret can't be sent webhooks
+		secret, err := m.readWebhookSecret(app.ID)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Err(err).Str("app", app.ID).Msg("failed to read webhook secret")
+			}
+			continue
+		}
+		if VerifyWebhookSignature(header, body, secret) == nil {
+			verified = append(verified, app)
+		}
+	}
+	if len(verified) == 0 {
+		return nil, ErrInvalidSignature
+	}
+	return verified, nil
+}
+
+// matchPushEvent returns the applications tracking the pushed branch.
+func matchPushEvent(event *PushEvent, apps []*Application) ([]*Application, error) {
+	var matched []*Application
+	for _, app := range apps {
+		if event.matches(app.InstallConfiguration) {
+			matched = append(matched, app)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, ErrNoMatchingApplication
+	}
+	return matched, nil
+}
+
+// HandlePushEvent verifies a push webhook and redeploys every matching application.
+func (m *Manager) HandlePushEvent(header http.Header, body []byte) ([]*Application, error) {
+	verified, err := m.verifiedApplications(header, body)
+	if err != nil {
+		return nil, err
+	}
+	event, err := ParsePushEvent(header, body)
+	if err != nil {
+		return nil, err
+	}
+	apps, err := matchPushEvent(event, verified)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, app := range apps {
+		log.Info().Str("app", app.ID).Str("provider", event.Provider).Str("branch", event.Branch).Str("commit", event.Commit).Msg("redeploying from webhook")
+		go m.redeployPushed(app)
+	}
+	return apps, nil
+}
+
+// redeployPushed redeploys the application for a push. Pushes arriving while the
+// application is deploying queue a single redeploy which runs once the deploy is
+// done, it fetches every commit pushed in the meantime.
+func (m *Manager) redeployPushed(app *Application) {
+	if !atomic.CompareAndSwapInt32(&app.pushQueued, 0, 1) {
+		log.Debug().Str("app", app.ID).Msg("a redeploy is already queued")
+		return
+	}
+	for {
+		if !app.IsDeploying() {
+			// pushes arriving from now on may not be fetched by this redeploy, they queue another one
+			atomic.StoreInt32(&app.pushQueued, 0)
+			err := m.Redeploy(app.ID)
+			if err != ErrDeployInProgress {
+				if err != nil {
+					log.Err(err).Str("app", app.ID).Msg("pushed redeploy failed")
+				}
+				return
+			}
+			// another deploy started first
+			if !atomic.CompareAndSwapInt32(&app.pushQueued, 0, 1) {
+				return
+			}
+		}
+		time.Sleep(deployPollInterval)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+// Package metrics keeps counters, gauges and histograms and exposes them in the
+// Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the histogram buckets for latencies, in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry the metrics of kerfuffle are registered on.
+var Default = NewRegistry()
+
+// Metric is anything that can be written out by a registry.
+type Metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+type Registry struct {
+	mu      sync.RWMutex
+	metrics []Metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds the metric to the registry, metrics are written in the order
+// they're registered. Registering a name twice panics.
+func (r *Registry) Register(metric Metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.metrics {
+		if m.name() == metric.name() {
+			panic(fmt.Sprintf("metric '%v' is already registered", metric.name()))
+		}
+	}
+	r.metrics = append(r.metrics, metric)
+}
+
+// Write writes every metric in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) {
+	r.mu.RLock()
+	metrics := append([]Metric{}, r.metrics...)
+	r.mu.RUnlock()
+	for _, metric := range metrics {
+		metric.write(w)
+	}
+}
+
+// Handler serves the metrics of the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w := bufio.NewWriter(res)
+		r.Write(w)
+		_ = w.Flush()
+	})
+}
+
+// family holds the series of a metric, keyed by their label values.
+type family struct {
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+}
+
+func (f *family) name() string {
+	return f.metricName
+}
+
+func (f *family) writeHeader(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", f.metricName, escapeHelp(f.help), f.metricName, f.kind)
+}
+
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric '%v' has %v labels, got %v values", f.metricName, len(f.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats the labels and values as {a="1",b="2"}, extra is appended as is.
+func labelPairs(labels []string, values []string, extra string) string {
+	var pairs []string
+	for i, label := range labels {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, label, labelEscaper.Replace(values[i])))
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRegistry_Write(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("requests_total", "Requests served.", "route", "code")
+	latency := r.NewHistogram("latency_seconds", "Request latency.", []float64{0.1, 1}, "route")
+	r.NewGaugeFunc("up", "Whether the process is running.", []string{"process"}, func(set func(float64, ...string)) {
+		set(1, `web "1"`)
+		set(0, "worker\n1")
+	})
+
+	requests.Inc("b.example.com", "500")
+	requests.Add(2, "a.example.com", "200")
+	latency.Observe(0.05, "a.example.com")
+	latency.Observe(0.5, "a.example.com")
+
+	expected := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{route="a.example.com",code="200"} 2
+requests_total{route="b.example.com",code="500"} 1
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="a.example.com",le="0.1"} 1
+latency_seconds_bucket{route="a.example.com",le="1"} 2
+latency_seconds_bucket{route="a.example.com",le="+Inf"} 2
+latency_seconds_sum{route="a.example.com"} 0.55
+latency_seconds_count{route="a.example.com"} 2
+# HELP up Whether the process is running.
+# TYPE up gauge
+up{process="web \"1\""} 1
+up{process="worker\n1"} 0
+`
+	buffer := &bytes.Buffer{}
+	r.Write(buffer)
+	if buffer.String() != expected {
+		t.Errorf("unexpected output:\n%v", buffer.String())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a name twice should panic")
+		}
+	}()
+	r.NewCounter("requests_total", "Requests served again.")
+}
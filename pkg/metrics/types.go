@@ -0,0 +1,210 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+)
+
+type series struct {
+	values []string
+	value  float64
+}
+
+// Counter is a value which only goes up, one per combination of label values.
+type Counter struct {
+	family
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// NewCounter creates and registers a counter with the given labels.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	counter := &Counter{
+		family: family{metricName: name, help: help, kind: "counter", labels: labels},
+		series: map[string]*series{},
+	}
+	r.Register(counter)
+	return counter
+}
+
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add increases the counter of the label values, negative values are ignored.
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		return
+	}
+	key := c.key(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, exists := c.series[key]
+	if !exists {
+		s = &series{values: append([]string{}, values...)}
+		c.series[key] = s
+	}
+	s.value += v
+}
+
+// Value returns the current value of the label values.
+func (c *Counter) Value(values ...string) float64 {
+	key := c.key(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, exists := c.series[key]; exists {
+		return s.value
+	}
+	return 0
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	var all []*series
+	for _, s := range c.series {
+		all = append(all, &series{values: s.values, value: s.value})
+	}
+	c.mu.Unlock()
+	writeSeries(w, &c.family, all)
+}
+
+func writeSeries(w io.Writer, f *family, all []*series) {
+	f.writeHeader(w)
+	sort.Slice(all, func(i, j int) bool {
+		return f.key(all[i].values) < f.key(all[j].values)
+	})
+	for _, s := range all {
+		_, _ = fmt.Fprintf(w, "%v%v %v\n", f.metricName, labelPairs(f.labels, s.values, ""), formatValue(s.value))
+	}
+}
+
+// CollectFunc reports the current values of a metric through set, it's called on every scrape.
+type CollectFunc func(set func(value float64, values ...string))
+
+// collected is a metric whose values are gathered when it's written.
+type collected struct {
+	family
+	collect CollectFunc
+}
+
+// NewGaugeFunc registers a gauge whose values are collected on every scrape.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect CollectFunc) {
+	r.Register(&collected{family: family{metricName: name, help: help, kind: "gauge", labels: labels}, collect: collect})
+}
+
+// NewCounterFunc registers a counter whose values are collected on every scrape,
+// for counts which are already being kept elsewhere.
+func (r *Registry) NewCounterFunc(name, help string, labels []string, collect CollectFunc) {
+	r.Register(&collected{family: family{metricName: name, help: help, kind: "counter", labels: labels}, collect: collect})
+}
+
+func (c *collected) write(w io.Writer) {
+	gathered := map[string]*series{}
+	c.collect(func(value float64, values ...string) {
+		// reporting the same series twice adds them up
+		key := c.key(values)
+		if s, exists := gathered[key]; exists {
+			s.value += value
+			return
+		}
+		gathered[key] = &series{values: append([]string{}, values...), value: value}
+	})
+	var all []*series
+	for _, s := range gathered {
+		all = append(all, s)
+	}
+	writeSeries(w, &c.family, all)
+}
+
+type histogramSeries struct {
+	values []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Histogram counts observations into buckets, one per combination of label values.
+type Histogram struct {
+	family
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+// NewHistogram creates and registers a histogram, nil buckets use DefaultBuckets.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	histogram := &Histogram{
+		family:  family{metricName: name, help: help, kind: "histogram", labels: labels},
+		buckets: buckets,
+		series:  map[string]*histogramSeries{},
+	}
+	r.Register(histogram)
+	return histogram
+}
+
+func (h *Histogram) Observe(v float64, values ...string) {
+	key := h.key(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, exists := h.series[key]
+	if !exists {
+		s = &histogramSeries{values: append([]string{}, values...), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// Count returns the amount of observations of the label values.
+func (h *Histogram) Count(values ...string) uint64 {
+	key := h.key(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, exists := h.series[key]; exists {
+		return s.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	var all []*histogramSeries
+	for _, s := range h.series {
+		all = append(all, &histogramSeries{values: s.values, counts: append([]uint64{}, s.counts...), sum: s.sum, count: s.count})
+	}
+	h.mu.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		return h.key(all[i].values) < h.key(all[j].values)
+	})
+
+	h.writeHeader(w)
+	for _, s := range all {
+		for i, bound := range h.buckets {
+			le := fmt.Sprintf(`le="%v"`, formatValue(bound))
+			_, _ = fmt.Fprintf(w, "%v_bucket%v %v\n", h.metricName, labelPairs(h.labels, s.values, le), s.counts[i])
+		}
+		le := fmt.Sprintf(`le="%v"`, formatValue(math.Inf(1)))
+		_, _ = fmt.Fprintf(w, "%v_bucket%v %v\n", h.metricName, labelPairs(h.labels, s.values, le), s.count)
+		_, _ = fmt.Fprintf(w, "%v_sum%v %v\n", h.metricName, labelPairs(h.labels, s.values, ""), formatValue(s.sum))
+		_, _ = fmt.Fprintf(w, "%v_count%v %v\n", h.metricName, labelPairs(h.labels, s.values, ""), s.count)
+	}
+}
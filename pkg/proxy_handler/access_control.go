@@ -0,0 +1,255 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRealm       = "kerfuffle"
+	forwardAuthTimeout = time.Second * 10
+)
+
+// AccessControl restricts who can reach a route, every check that's set has to pass.
+type AccessControl struct {
+	// Allow only lets the listed IPs or CIDRs through, Deny keeps them out
+	Allow []string
+	Deny  []string
+	// BasicAuth holds the allowed credentials as "user:bcrypt hash"
+	BasicAuth []string
+	Realm     string
+	// ForwardAuth is asked whether a request is allowed, a 2xx response lets it through and
+	// any other response is returned to the client. ForwardAuthHeaders are copied from the
+	// answer into the forwarded request.
+	ForwardAuth        string
+	ForwardAuthHeaders []string
+}
+
+// Validate checks the addresses, credentials and forward auth URL of the access control.
+func (c *AccessControl) Validate() error {
+	_, err := newAccessGuard(c)
+	return err
+}
+
+// accessGuard is the parsed form of an AccessControl.
+type accessGuard struct {
+	allow, deny []*net.IPNet
+	credentials map[string][]byte
+	realm       string
+	forwardAuth *url.URL
+	forwardWith []string
+	// verified caches the credentials which passed, bcrypt is too slow to run on every request
+	verified sync.Map
+	client   *http.Client
+}
+
+// newAccessGuard parses the access control, it returns nil when nothing is restricted.
+func newAccessGuard(c *AccessControl) (*accessGuard, error) {
+	if c == nil || len(c.Allow)+len(c.Deny)+len(c.BasicAuth) == 0 && c.ForwardAuth == "" {
+		return nil, nil
+	}
+	g := &accessGuard{realm: c.Realm, forwardWith: c.ForwardAuthHeaders}
+	if g.realm == "" {
+		g.realm = defaultRealm
+	}
+	var err error
+	if g.allow, err = parseNetworks(c.Allow); err != nil {
+		return nil, err
+	}
+	if g.deny, err = parseNetworks(c.Deny); err != nil {
+		return nil, err
+	}
+	if len(c.BasicAuth) > 0 {
+		g.credentials = map[string][]byte{}
+		for i, credential := range c.BasicAuth {
+			parts := strings.SplitN(credential, ":", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				// without a separator the entry could be a plain password, it's left out of the error
+				return nil, fmt.Errorf("invalid basic auth credential #%v, use user:hash", i+1)
+			}
+			if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+				return nil, fmt.Errorf("the password of '%v' isn't a bcrypt hash: %v", parts[0], err)
+			}
+			g.credentials[parts[0]] = []byte(parts[1])
+		}
+	}
+	if c.ForwardAuth != "" {
+		g.forwardAuth, err = url.Parse(c.ForwardAuth)
+		if err != nil || g.forwardAuth.Host == "" || (g.forwardAuth.Scheme != "http" && g.forwardAuth.Scheme != "https") {
+			return nil, fmt.Errorf("invalid forward auth URL '%v'", c.ForwardAuth)
+		}
+		g.client = &http.Client{
+			Timeout: forwardAuthTimeout,
+			// redirects (e.g. to a login page) are meant for the client
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+	return g, nil
+}
+
+func parseNetworks(addresses []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, address := range addresses {
+		if !strings.Contains(address, "/") {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address '%v'", address)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address '%v': %v", address, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admit checks the request against the access control, requests which aren't allowed
+// are answered and false is returned.
+func (g *accessGuard) admit(res http.ResponseWriter, req *http.Request, secure bool) bool {
+	if len(g.allow) > 0 || len(g.deny) > 0 {
+		ip := net.ParseIP(ClientIP(req))
+		if ip == nil || containsIP(g.deny, ip) || len(g.allow) > 0 && !containsIP(g.allow, ip) {
+			http.Error(res, "forbidden", http.StatusForbidden)
+			return false
+		}
+	}
+
+	if g.credentials != nil {
+		user, password, ok := req.BasicAuth()
+		if !ok || !g.authenticate(user, password) {
+			res.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", g.realm))
+			http.Error(res, "unauthorized", http.StatusUnauthorized)
+			return false
+		}
+		// the credentials are meant for the proxy, not the application
+		req.Header.Del("Authorization")
+	}
+
+	if g.forwardAuth != nil {
+		return g.askForwardAuth(res, req, secure)
+	}
+	return true
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHashed   []byte
+)
+
+func (g *accessGuard) authenticate(user, password string) bool {
+	key := sha256.Sum256([]byte(user + "\x00" + password))
+	if _, verified := g.verified.Load(key); verified {
+		return true
+	}
+	hash, exists := g.credentials[user]
+	if !exists {
+		// spend the same time as a wrong password so users can't be probed
+		dummyHashOnce.Do(func() {
+			dummyHashed, _ = bcrypt.GenerateFromPassword([]byte("kerfuffle"), bcrypt.DefaultCost)
+		})
+		_ = bcrypt.CompareHashAndPassword(dummyHashed, []byte(password))
+		return false
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	g.verified.Store(key, true)
+	return true
+}
+
+// askForwardAuth sends the request's headers to the forward auth URL, along with
+// where the request was going.
+func (g *accessGuard) askForwardAuth(res http.ResponseWriter, req *http.Request, secure bool) bool {
+	authReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, g.forwardAuth.String(), nil)
+	if err != nil {
+		http.Error(res, "forward auth failed", http.StatusInternalServerError)
+		return false
+	}
+	authReq.Header = req.Header.Clone()
+	for _, header := range []string{"Connection", "Upgrade", "Content-Length", "Content-Type", "Transfer-Encoding"} {
+		authReq.Header.Del(header)
+	}
+	proto := "http"
+	if secure {
+		proto = "https"
+	}
+	authReq.Header.Set("X-Forwarded-Method", req.Method)
+	authReq.Header.Set("X-Forwarded-Proto", proto)
+	authReq.Header.Set("X-Forwarded-Host", req.Host)
+	authReq.Header.Set("X-Forwarded-Uri", req.URL.RequestURI())
+	authReq.Header.Set("X-Forwarded-For", ClientIP(req))
+
+	authRes, err := g.client.Do(authReq)
+	if err != nil {
+		log.Err(err).Str("url", g.forwardAuth.String()).Msg("forward auth failed")
+		http.Error(res, "forward auth failed", http.StatusBadGateway)
+		return false
+	}
+	defer authRes.Body.Close()
+
+	if authRes.StatusCode >= 200 && authRes.StatusCode < 300 {
+		for _, header := range g.forwardWith {
+			// headers the auth server doesn't set are dropped so clients can't forge them
+			req.Header.Del(header)
+			for _, value := range authRes.Header.Values(header) {
+				req.Header.Add(header, value)
+			}
+		}
+		return true
+	}
+
+	for key, values := range authRes.Header {
+		if key == "Content-Length" || key == "Connection" || key == "Transfer-Encoding" {
+			continue
+		}
+		res.Header()[key] = values
+	}
+	res.WriteHeader(authRes.StatusCode)
+	_, _ = io.Copy(res, authRes.Body)
+	return false
+}
+
+// SetAccessControl replaces the access control of a route, nil lifts every restriction.
+func (m *HttpReverseProxyManager) SetAccessControl(originAddr string, access *AccessControl) error {
+	guard, err := newAccessGuard(access)
+	if err != nil {
+		return err
+	}
+	return m.modifyRoute(originAddr, func(route *Route) {
+		route.access = guard
+	})
+}
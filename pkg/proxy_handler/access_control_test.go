@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHttpReverseProxyManager_AccessControl(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "user=%v auth=%v", r.Header.Get("X-User"), r.Header.Get("Authorization"))
+	}))
+	defer upstream.Close()
+	var authRequests int32
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&authRequests, 1)
+		if r.Header.Get("Cookie") != "session=valid" {
+			http.Redirect(w, r, "https://login.local/?next="+r.Header.Get("X-Forwarded-Uri"), http.StatusFound)
+			return
+		}
+		w.Header().Set("X-User", "ada")
+	}))
+	defer authServer.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyManager := NewHttpReverseProxyManager()
+	install := func(host string, access *AccessControl) {
+		backend, err := NewBackend(upstream.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := proxyManager.InstallRouteWithOptions(host, &RouteOptions{Backends: []*Backend{backend}, Access: access}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	install("office.local", &AccessControl{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.13"}})
+	install("staging.local", &AccessControl{BasicAuth: []string{"qa:" + string(hash)}, Realm: "staging"})
+	install("sso.local", &AccessControl{ForwardAuth: authServer.URL, ForwardAuthHeaders: []string{"X-User"}})
+	install("open.local", nil)
+
+	handler := proxyManager.Handler(false)
+	request := func(host, remote string, prepare func(req *http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/reports?page=2", nil)
+		req.Host = host
+		req.RemoteAddr = remote + ":4000"
+		if prepare != nil {
+			prepare(req)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	for _, test := range []struct {
+		remote string
+		status int
+	}{{"10.1.2.3", http.StatusOK}, {"10.0.0.13", http.StatusForbidden}, {"203.0.113.7", http.StatusForbidden}} {
+		if res := request("office.local", test.remote, nil); res.Code != test.status {
+			t.Errorf("expected %v from %v, got %v", test.status, test.remote, res.Code)
+		}
+	}
+
+	res := request("staging.local", "203.0.113.7", nil)
+	if res.Code != http.StatusUnauthorized || res.Header().Get("WWW-Authenticate") != `Basic realm="staging"` {
+		t.Errorf("expected a basic auth challenge, got %v %v", res.Code, res.Header())
+	}
+	res = request("staging.local", "203.0.113.7", func(req *http.Request) { req.SetBasicAuth("qa", "wrong") })
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("expected wrong passwords to be rejected, got %v", res.Code)
+	}
+	for i := 0; i < 2; i++ {
+		res = request("staging.local", "203.0.113.7", func(req *http.Request) { req.SetBasicAuth("qa", "hunter2") })
+		if res.Code != http.StatusOK || res.Body.String() != "user= auth=" {
+			t.Errorf("expected the credentials to be accepted and stripped, got %v %q", res.Code, res.Body.String())
+		}
+	}
+
+	res = request("sso.local", "203.0.113.7", func(req *http.Request) { req.Header.Set("X-User", "forged") })
+	if res.Code != http.StatusFound || res.Header().Get("Location") != "https://login.local/?next=/reports?page=2" {
+		t.Errorf("expected the auth server's redirect, got %v %v", res.Code, res.Header())
+	}
+	res = request("sso.local", "203.0.113.7", func(req *http.Request) {
+		req.Header.Set("Cookie", "session=valid")
+		req.Header.Set("X-User", "forged")
+	})
+	if res.Code != http.StatusOK || res.Body.String() != "user=ada auth=" {
+		t.Errorf("expected the auth server's headers to be forwarded, got %v %q", res.Code, res.Body.String())
+	}
+
+	// rate limited requests never reach the auth server
+	backend, err := NewBackend(upstream.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = proxyManager.InstallRouteWithOptions("limited.local", &RouteOptions{
+		Backends:  []*Backend{backend},
+		Access:    &AccessControl{ForwardAuth: authServer.URL},
+		RateLimit: RateLimit{Rate: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&authRequests, 0)
+	for i := 0; i < 5; i++ {
+		request("limited.local", "203.0.113.7", nil)
+	}
+	if res := request("limited.local", "203.0.113.7", nil); res.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the client to be rate limited, got %v", res.Code)
+	}
+	if requests := atomic.LoadInt32(&authRequests); requests != 1 {
+		t.Errorf("expected a single request to be authenticated, got %v", requests)
+	}
+
+	// restrictions can be changed on a live route
+	if err := proxyManager.SetAccessControl("open.local", &AccessControl{Deny: []string{"203.0.113.0/24"}}); err != nil {
+		t.Fatal(err)
+	}
+	if res := request("open.local", "203.0.113.7", nil); res.Code != http.StatusForbidden {
+		t.Errorf("expected the new deny list to apply, got %v", res.Code)
+	}
+	if err := proxyManager.SetAccessControl("open.local", nil); err != nil {
+		t.Fatal(err)
+	}
+	if res := request("open.local", "203.0.113.7", nil); res.Code != http.StatusOK {
+		t.Errorf("expected the restrictions to be lifted, got %v", res.Code)
+	}
+
+	for _, invalid := range []*AccessControl{
+		{Allow: []string{"10.0.0.0/40"}},
+		{BasicAuth: []string{"qa:hunter2"}},
+		{ForwardAuth: "auth.local/verify"},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("%+v should be invalid", invalid)
+		}
+	}
+	// a credential missing its separator could be a plain password
+	err = (&AccessControl{BasicAuth: []string{"qa:" + string(hash), "hunter2"}}).Validate()
+	if err == nil || strings.Contains(err.Error(), "hunter2") || !strings.Contains(err.Error(), "#2") {
+		t.Errorf("expected the entry to be reported by its position, got %v", err)
+	}
+}
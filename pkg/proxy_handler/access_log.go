@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"fmt"
+	"github.com/rs/zerolog"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	AccessLogJSON     = "json"
+	AccessLogCombined = "combined"
+
+	combinedTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+// AccessLogEntry is the outcome of a request that went through the proxy.
+type AccessLogEntry struct {
+	At        time.Time
+	RemoteIP  string
+	User      string
+	Method    string
+	Host      string
+	URI       string
+	Proto     string
+	Status    int
+	Bytes     int64
+	Duration  time.Duration
+	Referer   string
+	UserAgent string
+	// Route is empty when the host has no route, Backend when the request wasn't forwarded
+	Route   string
+	Backend string
+	Secure  bool
+}
+
+// AccessLogger writes an entry for every request handled by the proxy.
+type AccessLogger struct {
+	format string
+	// sampleRate is the share of the requests which are logged, server errors are always logged
+	sampleRate float64
+
+	mu     sync.Mutex
+	out    io.Writer
+	logger zerolog.Logger
+}
+
+// NewAccessLogger creates a logger writing entries to out in the json or combined
+// format, sampleRate between 0 and 1 is the share of requests that get logged.
+func NewAccessLogger(out io.Writer, format string, sampleRate float64) (*AccessLogger, error) {
+	switch format {
+	case AccessLogJSON, AccessLogCombined:
+	default:
+		return nil, fmt.Errorf("invalid access log format '%v', use json or combined", format)
+	}
+	if sampleRate <= 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("invalid access log sample rate %v, it has to be above 0 and at most 1", sampleRate)
+	}
+	return &AccessLogger{
+		format:     format,
+		sampleRate: sampleRate,
+		out:        out,
+		logger:     zerolog.New(out),
+	}, nil
+}
+
+func (l *AccessLogger) sampled(entry *AccessLogEntry) bool {
+	return l.sampleRate >= 1 || entry.Status >= 500 || rand.Float64() < l.sampleRate
+}
+
+// Log writes the entry, unless it's been sampled out.
+func (l *AccessLogger) Log(entry *AccessLogEntry) {
+	if !l.sampled(entry) {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.format == AccessLogCombined {
+		_, _ = io.WriteString(l.out, entry.combined())
+		return
+	}
+	l.logger.Log().
+		Str("time", entry.At.Format(time.RFC3339Nano)).
+		Str("remote_ip", entry.RemoteIP).
+		Str("user", entry.User).
+		Str("method", entry.Method).
+		Str("host", entry.Host).
+		Str("uri", entry.URI).
+		Str("proto", entry.Proto).
+		Int("status", entry.Status).
+		Int64("bytes", entry.Bytes).
+		Float64("duration_ms", float64(entry.Duration.Microseconds())/1000).
+		Str("referer", entry.Referer).
+		Str("user_agent", entry.UserAgent).
+		Str("route", entry.Route).
+		Str("backend", entry.Backend).
+		Bool("secure", entry.Secure).
+		Send()
+}
+
+// combined formats the entry in the Combined Log Format.
+func (e *AccessLogEntry) combined() string {
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+	return fmt.Sprintf("%v - %v [%v] %v %v %v %v %v\n",
+		orDash(e.RemoteIP), orDash(e.User), e.At.Format(combinedTimeFormat),
+		strconv.Quote(fmt.Sprintf("%v %v %v", e.Method, e.URI, e.Proto)),
+		e.Status, bytes, strconv.Quote(orDash(e.Referer)), strconv.Quote(orDash(e.UserAgent)))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// newAccessLogEntry captures the request before the proxy rewrites it for the backend.
+func newAccessLogEntry(req *http.Request, secure bool) *AccessLogEntry {
+	entry := &AccessLogEntry{
+		At:        time.Now(),
+		RemoteIP:  ClientIP(req),
+		Method:    req.Method,
+		Host:      req.Host,
+		URI:       req.RequestURI,
+		Proto:     req.Proto,
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+		Secure:    secure,
+	}
+	if user, _, ok := req.BasicAuth(); ok {
+		entry.User = user
+	}
+	return entry
+}
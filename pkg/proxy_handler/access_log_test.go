@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestHttpReverseProxyManager_AccessLog(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		_, _ = fmt.Fprint(w, "hello")
+	}))
+	defer upstream.Close()
+
+	proxyManager := NewHttpReverseProxyManager()
+	for _, host := range []string{"logged.local", "quiet.local"} {
+		if err := proxyManager.InstallRoute(host, upstream.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := proxyManager.SetAccessLog("quiet.local", false); err != nil {
+		t.Fatal(err)
+	}
+	handler := proxyManager.Handler(false)
+	request := func(host, path string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = host
+		req.RemoteAddr = "203.0.113.7:51234"
+		req.Header.Set("User-Agent", "test/1.0")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	t.Run("json", func(t *testing.T) {
+		out := &bytes.Buffer{}
+		logger, err := NewAccessLogger(out, AccessLogJSON, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxyManager.SetAccessLogger(logger)
+		request("logged.local", "/?q=1")
+		request("quiet.local", "/")
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != 1 {
+			t.Fatalf("expected a single entry, got %q", out.String())
+		}
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range map[string]interface{}{
+			"remote_ip": "203.0.113.7", "method": "GET", "host": "logged.local", "uri": "/?q=1",
+			"status": 200.0, "bytes": 5.0, "route": "logged.local", "user_agent": "test/1.0",
+		} {
+			if entry[key] != value {
+				t.Errorf("expected %v to be %v, got %v", key, value, entry[key])
+			}
+		}
+		if !strings.HasPrefix(entry["backend"].(string), "127.0.0.1:") {
+			t.Errorf("unexpected backend %v", entry["backend"])
+		}
+	})
+
+	t.Run("combined", func(t *testing.T) {
+		out := &bytes.Buffer{}
+		logger, err := NewAccessLogger(out, AccessLogCombined, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxyManager.SetAccessLogger(logger)
+		request("logged.local", "/fail")
+
+		pattern := `^203\.0\.113\.7 - - \[[^\]]+\] "GET /fail HTTP/1\.1" 500 5 "-" "test/1\.0"\n$`
+		if !regexp.MustCompile(pattern).MatchString(out.String()) {
+			t.Errorf("unexpected entry %q", out.String())
+		}
+	})
+
+	t.Run("sampling", func(t *testing.T) {
+		out := &bytes.Buffer{}
+		logger, err := NewAccessLogger(out, AccessLogCombined, 0.000001)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxyManager.SetAccessLogger(logger)
+		for i := 0; i < 20; i++ {
+			request("logged.local", "/")
+		}
+		request("logged.local", "/fail")
+		// server errors are always logged, the rest is sampled out
+		if lines := strings.Count(out.String(), "\n"); lines != 1 || !strings.Contains(out.String(), " 500 ") {
+			t.Errorf("unexpected entries %q", out.String())
+		}
+	})
+
+	if _, err := NewAccessLogger(&bytes.Buffer{}, "apache", 1); err == nil {
+		t.Error("unknown formats should be rejected")
+	}
+}
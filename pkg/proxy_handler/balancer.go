@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"hash/fnv"
+	"kerfuffle"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BalanceRoundRobin       = "round_robin"
+	BalanceLeastConnections = "least_connections"
+	BalanceConsistentHash   = "hash"
+
+	drainPollInterval = time.Millisecond * 100
+)
+
+// Backend is a single upstream a route can forward requests to.
+type Backend struct {
+	Target *url.URL
+	Proxy  *httputil.ReverseProxy
+	// Alive reports if the process behind the backend is still running,
+	// dead backends are skipped by the balancers. A nil Alive is always alive.
+	Alive func() bool
+	// Name identifies the backend to whoever installed it, e.g. the process behind it
+	Name string
+
+	active int64
+	// route is the name of the route the backend was configured for, the proxy
+	// is only written to before it serves any request
+	route string
+}
+
+func NewBackend(targetAddr string, alive func() bool) (*Backend, error) {
+	target, err := url.Parse(targetAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if target.Host == "" {
+		return nil, errors.New("target host cannot be empty")
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ModifyResponse = func(response *http.Response) error {
+		response.Header.Set("X-Kerfuffle-Version", kerfuffle.Version)
+		return replaceNotFound(response)
+	}
+	backend := &Backend{Target: target, Proxy: proxy, Alive: alive}
+	proxy.ErrorHandler = func(res http.ResponseWriter, req *http.Request, err error) {
+		if routed := routeOf(req); routed != nil {
+			routed.fail(res, req, backend, err)
+			return
+		}
+		status := errorStatus(req, err)
+		log.Err(err).Str("target", target.Host).Int("status", status).Msg("failed to proxy request")
+		res.WriteHeader(status)
+	}
+	return backend, nil
+}
+
+func (b *Backend) IsAlive() bool {
+	return b.Alive == nil || b.Alive()
+}
+
+// Active returns the amount of requests currently being served by the backend.
+func (b *Backend) Active() int64 {
+	return atomic.LoadInt64(&b.active)
+}
+
+// Drain waits until the backend has finished serving its in-flight requests,
+// returning false if they're still running once the timeout passes.
+func (b *Backend) Drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	// requests which picked the backend right before it was swapped out might
+	// not have been counted yet, so it's always given one tick.
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if b.Active() == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+	}
+	return false
+}
+
+// Balancer picks which of the route's backends serves a request.
+// Implementations return nil when there's no live backend.
+type Balancer interface {
+	Next(req *http.Request, backends []*Backend) *Backend
+}
+
+// NewBalancer creates a balancer for the given strategy, the hash header and
+// cookie are only used by the consistent hashing strategy.
+func NewBalancer(strategy, hashHeader, hashCookie string) (Balancer, error) {
+	switch strategy {
+	case "", BalanceRoundRobin:
+		return &roundRobin{}, nil
+	case BalanceLeastConnections:
+		return &leastConnections{}, nil
+	case BalanceConsistentHash:
+		return &consistentHash{header: hashHeader, cookie: hashCookie}, nil
+	}
+	return nil, fmt.Errorf("unknown balancing strategy '%v'", strategy)
+}
+
+type roundRobin struct {
+	counter uint64
+}
+
+func (r *roundRobin) Next(_ *http.Request, backends []*Backend) *Backend {
+	for range backends {
+		n := atomic.AddUint64(&r.counter, 1)
+		backend := backends[(n-1)%uint64(len(backends))]
+		if backend.IsAlive() {
+			return backend
+		}
+	}
+	return nil
+}
+
+type leastConnections struct{}
+
+func (l *leastConnections) Next(_ *http.Request, backends []*Backend) *Backend {
+	var best *Backend
+	for _, backend := range backends {
+		if !backend.IsAlive() {
+			continue
+		}
+		if best == nil || backend.Active() < best.Active() {
+			best = backend
+		}
+	}
+	return best
+}
+
+// consistentHash uses rendezvous hashing so that only the requests of a removed
+// backend get moved around when the set of live backends changes.
+type consistentHash struct {
+	header string
+	cookie string
+}
+
+func (c *consistentHash) key(req *http.Request) string {
+	if c.header != "" {
+		if v := req.Header.Get(c.header); v != "" {
+			return v
+		}
+	}
+	if c.cookie != "" {
+		if cookie, err := req.Cookie(c.cookie); err == nil {
+			return cookie.Value
+		}
+	}
+	return ClientIP(req)
+}
+
+func (c *consistentHash) Next(req *http.Request, backends []*Backend) *Backend {
+	key := c.key(req)
+	var best *Backend
+	var bestScore uint64
+	for _, backend := range backends {
+		if !backend.IsAlive() {
+			continue
+		}
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		_, _ = h.Write([]byte(backend.Target.Host))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = backend, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testBackends(t *testing.T, alive ...bool) []*Backend {
+	var backends []*Backend
+	for i, a := range alive {
+		a := a
+		backend, err := NewBackend(fmt.Sprintf("http://localhost:%v", 9000+i), func() bool { return a })
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends = append(backends, backend)
+	}
+	return backends
+}
+
+func TestBalancers(t *testing.T) {
+	t.Run("round robin skips dead backends", func(t *testing.T) {
+		backends := testBackends(t, true, false, true)
+		balancer, _ := NewBalancer(BalanceRoundRobin, "", "")
+		seen := map[*Backend]int{}
+		for i := 0; i < 10; i++ {
+			seen[balancer.Next(nil, backends)]++
+		}
+		if seen[backends[1]] != 0 || seen[backends[0]] != 5 || seen[backends[2]] != 5 {
+			t.Errorf("unexpected distribution %v", seen)
+		}
+	})
+
+	t.Run("least connections", func(t *testing.T) {
+		backends := testBackends(t, true, true, true)
+		backends[0].active = 3
+		backends[1].active = 1
+		backends[2].active = 2
+		balancer, _ := NewBalancer(BalanceLeastConnections, "", "")
+		if balancer.Next(nil, backends) != backends[1] {
+			t.Error("expected the least busy backend")
+		}
+	})
+
+	t.Run("consistent hash", func(t *testing.T) {
+		backends := testBackends(t, true, true, true)
+		balancer, _ := NewBalancer(BalanceConsistentHash, "X-Session", "")
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Session", "user-42")
+
+		first := balancer.Next(req, backends)
+		for i := 0; i < 5; i++ {
+			if balancer.Next(req, backends) != first {
+				t.Fatal("expected the same backend for the same key")
+			}
+		}
+
+		// only the requests of the dead backend should move
+		for _, backend := range backends {
+			if backend != first {
+				backend.Alive = func() bool { return false }
+			}
+		}
+		if balancer.Next(req, backends) != first {
+			t.Error("key moved even though its backend is still alive")
+		}
+	})
+
+	t.Run("no live backend", func(t *testing.T) {
+		backends := testBackends(t, false, false)
+		for _, strategy := range []string{BalanceRoundRobin, BalanceLeastConnections, BalanceConsistentHash} {
+			balancer, _ := NewBalancer(strategy, "", "")
+			if balancer.Next(httptest.NewRequest("GET", "/", nil), backends) != nil {
+				t.Errorf("%v returned a dead backend", strategy)
+			}
+		}
+	})
+
+	t.Run("unknown strategy", func(t *testing.T) {
+		if _, err := NewBalancer("random", "", ""); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestHttpReverseProxyManager_Balancing(t *testing.T) {
+	var backends []*Backend
+	for i := 0; i < 2; i++ {
+		i := i
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprint(w, i)
+		}))
+		defer srv.Close()
+		backend, err := NewBackend(srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends = append(backends, backend)
+	}
+
+	proxyManager := NewHttpReverseProxyManager()
+	err := proxyManager.InstallRouteWithOptions("balanced.local", &RouteOptions{Backends: backends})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := proxyManager.Handler(false)
+	var bodies []string
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://balanced.local/", nil))
+		bodies = append(bodies, rec.Body.String())
+	}
+	if fmt.Sprint(bodies) != "[0 1 0 1]" {
+		t.Errorf("unexpected responses %v", bodies)
+	}
+
+	backends[0].Alive = func() bool { return false }
+	backends[1].Alive = func() bool { return false }
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://balanced.local/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected %v when every backend is dead, got %v", http.StatusBadGateway, rec.Code)
+	}
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// SetTrustedProxies sets the addresses (IPs or CIDRs) of the proxies in front of kerfuffle,
+// like a load balancer or Cloudflare. Requests coming from them are attributed to the
+// client in their CF-Connecting-IP or X-Forwarded-For header.
+func (m *HttpReverseProxyManager) SetTrustedProxies(addresses []string) error {
+	networks, err := parseNetworks(addresses)
+	if err != nil {
+		return fmt.Errorf("invalid trusted proxies: %v", err)
+	}
+	m.trustedProxies.Store(networks)
+	return nil
+}
+
+func (m *HttpReverseProxyManager) trusted(address string) bool {
+	ip := net.ParseIP(address)
+	return ip != nil && containsIP(m.trustedProxies.Load().([]*net.IPNet), ip)
+}
+
+// resolveClientIP finds the address of the client which made the request, looking past
+// the trusted proxies. X-Forwarded-For is read from the right, the first address which
+// isn't a trusted proxy is the client's.
+func (m *HttpReverseProxyManager) resolveClientIP(req *http.Request) string {
+	ip := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		ip = host
+	}
+	if !m.trusted(ip) {
+		return ip
+	}
+	if connecting := strings.TrimSpace(req.Header.Get("CF-Connecting-IP")); net.ParseIP(connecting) != nil {
+		return connecting
+	}
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !m.trusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// withClientIP resolves the client of the request once, for everyone handling it afterwards.
+func (m *HttpReverseProxyManager) withClientIP(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), clientIPKey{}, m.resolveClientIP(req)))
+}
+
+// ClientIP returns the address of the client which made the request, past the trusted proxies.
+func ClientIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultReadHeaderTimeout = time.Second * 10
+	defaultIdleTimeout       = time.Minute * 2
+)
+
+// ServerTimeouts apply to every connection of the proxy's listeners, before requests
+// are routed. Zero disables a timeout.
+type ServerTimeouts struct {
+	// ReadHeader is how long a client gets to send the request headers
+	ReadHeader time.Duration
+	// Idle is how long a keep-alive connection is kept open between requests
+	Idle time.Duration
+}
+
+// RouteLimits bound the requests of a route, zero values leave them unbounded.
+type RouteLimits struct {
+	// DialTimeout is how long connecting to a backend may take
+	DialTimeout time.Duration
+	// ReadTimeout is how long the client gets to send the request body
+	ReadTimeout time.Duration
+	// WriteTimeout is how long the whole request may take once it's routed, upgraded
+	// connections included. Streams and websockets are better bounded by IdleTimeout.
+	WriteTimeout time.Duration
+	// IdleTimeout closes requests and upgraded connections which see no traffic in either direction
+	IdleTimeout time.Duration
+	// MaxBodySize is the maximum size of a request body in bytes
+	MaxBodySize int64
+	// FlushInterval is how often responses are flushed to the client while they're
+	// copied, a negative interval flushes after every write. Event streams are always
+	// flushed right away.
+	FlushInterval time.Duration
+}
+
+// transport returns the transport the route's backends use, nil for the default one.
+func (l *RouteLimits) transport() http.RoundTripper {
+	if l.DialTimeout <= 0 {
+		return nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   l.DialTimeout,
+		KeepAlive: time.Second * 30,
+	}).DialContext
+	return transport
+}
+
+type contextKey int
+
+const connContextKey contextKey = iota
+
+// newServer creates a server for the proxy's listeners, the connection is kept in the
+// request context so the read timeouts of the routes can be applied to it.
+func (m *HttpReverseProxyManager) newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: m.serverTimeouts.ReadHeader,
+		IdleTimeout:       m.serverTimeouts.Idle,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey, conn)
+		},
+	}
+}
+
+// SetServerTimeouts replaces the timeouts of the listeners launched afterwards.
+func (m *HttpReverseProxyManager) SetServerTimeouts(timeouts ServerTimeouts) {
+	m.serverTimeouts = timeouts
+}
+
+// limitState records why a limited request was cut short, it's read by the
+// error handler of the backend to pick the status code.
+type limitState struct {
+	status int32
+}
+
+func (s *limitState) fail(status int) {
+	atomic.CompareAndSwapInt32(&s.status, 0, int32(status))
+}
+
+func (s *limitState) failure() int {
+	return int(atomic.LoadInt32(&s.status))
+}
+
+type limitStateKey struct{}
+
+// errorStatus returns the status a failed request is answered with.
+func errorStatus(req *http.Request, err error) int {
+	if state, ok := req.Context().Value(limitStateKey{}).(*limitState); ok && state.failure() != 0 {
+		return state.failure()
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// apply bounds the request with the limits, it returns false when the request has
+// already been rejected. release has to be called once the request is served.
+func (l *RouteLimits) apply(res http.ResponseWriter, req *http.Request) (_ http.ResponseWriter, _ *http.Request, release func(), ok bool) {
+	if l.MaxBodySize > 0 && req.ContentLength > l.MaxBodySize {
+		http.Error(res, "request body too large", http.StatusRequestEntityTooLarge)
+		return res, req, func() {}, false
+	}
+
+	state := &limitState{}
+	ctx, cancel := context.WithCancel(context.WithValue(req.Context(), limitStateKey{}, state))
+	release = cancel
+	if l.WriteTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, l.WriteTimeout)
+		release = func() {
+			cancelTimeout()
+			cancel()
+		}
+	}
+
+	body := &limitedBody{ReadCloser: req.Body, state: state}
+	if l.MaxBodySize > 0 {
+		body.ReadCloser = http.MaxBytesReader(res, req.Body, l.MaxBodySize)
+	}
+
+	if l.IdleTimeout > 0 {
+		idle := time.AfterFunc(l.IdleTimeout, func() {
+			state.fail(http.StatusGatewayTimeout)
+			cancel()
+		})
+		active := func() {
+			idle.Reset(l.IdleTimeout)
+		}
+		body.onRead = active
+		res = &idleWriter{ResponseWriter: res, active: active}
+		previous := release
+		release = func() {
+			idle.Stop()
+			previous()
+		}
+	}
+
+	// requests without a body are left alone, the server reads from the connection in
+	// the background once there's nothing left to read and the deadline would apply to it
+	conn, exists := req.Context().Value(connContextKey).(net.Conn)
+	if l.ReadTimeout > 0 && req.ContentLength != 0 && req.ProtoMajor == 2 {
+		// the streams of an HTTP/2 connection share it, so only the request is timed out,
+		// closing the body unblocks the backend's transport which is reading from it
+		reader := body.ReadCloser
+		deadline := time.AfterFunc(l.ReadTimeout, func() {
+			state.fail(http.StatusRequestTimeout)
+			_ = reader.Close()
+			cancel()
+		})
+		stop := func() {
+			deadline.Stop()
+		}
+		body.onEOF, body.onClose = stop, stop
+		previous := release
+		release = func() {
+			stop()
+			previous()
+		}
+	} else if exists && l.ReadTimeout > 0 && req.ContentLength != 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(l.ReadTimeout))
+		reset := func() {
+			_ = conn.SetReadDeadline(time.Time{})
+		}
+		body.onEOF = reset
+		previous := release
+		release = func() {
+			reset()
+			previous()
+		}
+	}
+
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = body
+	}
+	return res, req.WithContext(ctx), release, true
+}
+
+// limitedBody tracks the reads of a request body for the limits of its route.
+type limitedBody struct {
+	io.ReadCloser
+	state   *limitState
+	onRead  func()
+	onEOF   func()
+	onClose func()
+}
+
+func (b *limitedBody) Close() error {
+	if b.onClose != nil {
+		b.onClose()
+	}
+	return b.ReadCloser.Close()
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.onRead != nil {
+		b.onRead()
+	}
+	var netErr net.Error
+	switch {
+	case err == io.EOF:
+		if b.onEOF != nil {
+			b.onEOF()
+		}
+	case err == nil:
+	case errors.As(err, &netErr) && netErr.Timeout():
+		b.state.fail(http.StatusRequestTimeout)
+	case err.Error() == "http: request body too large":
+		b.state.fail(http.StatusRequestEntityTooLarge)
+	}
+	return n, err
+}
+
+// idleWriter marks the request as active whenever the response is written to,
+// upgraded connections are watched the same way.
+type idleWriter struct {
+	http.ResponseWriter
+	active func()
+}
+
+func (w *idleWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	if n > 0 {
+		w.active()
+	}
+	return n, err
+}
+
+func (w *idleWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *idleWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn = &idleConn{Conn: conn, active: w.active}
+	// whatever the client sent ahead is already buffered in the reader
+	return conn, bufio.NewReadWriter(rw.Reader, bufio.NewWriter(conn)), nil
+}
+
+type idleConn struct {
+	net.Conn
+	active func()
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.active()
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.active()
+	}
+	return n, err
+}
@@ -0,0 +1,266 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHttpReverseProxyManager_Streaming(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
+		_, _ = io.Copy(conn, conn)
+	}))
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		// the stream stays open until the client is gone
+		<-r.Context().Done()
+	})
+	mux.HandleFunc("/poll", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Millisecond * 300):
+			_, _ = fmt.Fprint(w, "update")
+		case <-r.Context().Done():
+		}
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(ioutil.Discard, r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = fmt.Fprint(w, n)
+	})
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+
+	proxyManager := NewHttpReverseProxyManager()
+	install := func(host string, limits RouteLimits) {
+		backend, err := NewBackend(upstream.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := proxyManager.InstallRouteWithOptions(host, &RouteOptions{Backends: []*Backend{backend}, Limits: limits}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	install("open.local", RouteLimits{DialTimeout: time.Second})
+	install("strict.local", RouteLimits{
+		ReadTimeout:  time.Millisecond * 200,
+		WriteTimeout: time.Millisecond * 150,
+		MaxBodySize:  1024,
+	})
+	install("idle.local", RouteLimits{IdleTimeout: time.Millisecond * 200})
+
+	proxy := httptest.NewUnstartedServer(nil)
+	proxy.Config = proxyManager.newServer("", proxyManager.Handler(false))
+	proxy.Start()
+	defer proxy.Close()
+	address, _ := url.Parse(proxy.URL)
+
+	do := func(host, method, path string, body io.Reader) (int, string) {
+		req, _ := http.NewRequest(method, proxy.URL+path, body)
+		req.Host = host
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(data)
+	}
+
+	t.Run("websocket", func(t *testing.T) {
+		config, _ := websocket.NewConfig("ws://open.local/ws", "http://open.local")
+		tcp, err := net.Dial("tcp", address.Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := websocket.NewClient(config, tcp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		for _, message := range []string{"hello", "again"} {
+			if err := websocket.Message.Send(conn, message); err != nil {
+				t.Fatal(err)
+			}
+			var echo string
+			if err := websocket.Message.Receive(conn, &echo); err != nil || echo != message {
+				t.Errorf("expected the echo of %q, got %q (%v)", message, echo, err)
+			}
+		}
+	})
+
+	t.Run("events", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", proxy.URL+"/events", nil)
+		req.Host = "open.local"
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		line := make(chan string)
+		go func() {
+			l, _ := bufio.NewReader(res.Body).ReadString('\n')
+			line <- l
+		}()
+		select {
+		case l := <-line:
+			if l != "data: first\n" {
+				t.Errorf("unexpected event %q", l)
+			}
+		case <-time.After(time.Second * 2):
+			t.Error("the event wasn't flushed")
+		}
+	})
+
+	t.Run("long polling", func(t *testing.T) {
+		if status, body := do("open.local", "GET", "/poll", nil); status != http.StatusOK || body != "update" {
+			t.Errorf("unexpected response %v %q", status, body)
+		}
+		if status, _ := do("strict.local", "GET", "/poll", nil); status != http.StatusGatewayTimeout {
+			t.Errorf("expected the write timeout to hit, got %v", status)
+		}
+	})
+
+	t.Run("uploads", func(t *testing.T) {
+		large := bytes.Repeat([]byte("k"), 8<<20)
+		if status, body := do("open.local", "POST", "/upload", bytes.NewReader(large)); status != http.StatusOK || body != fmt.Sprint(len(large)) {
+			t.Errorf("unexpected response %v %q", status, body)
+		}
+		if status, _ := do("strict.local", "POST", "/upload", bytes.NewReader(large)); status != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected the body to be rejected, got %v", status)
+		}
+		// without a content length the body is cut off while it's read
+		chunked := io.MultiReader(bytes.NewReader(large[:2048]))
+		if status, _ := do("strict.local", "POST", "/upload", chunked); status != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected the chunked body to be rejected, got %v", status)
+		}
+	})
+
+	t.Run("slow body", func(t *testing.T) {
+		conn, err := net.Dial("tcp", address.Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, _ = fmt.Fprint(conn, "POST /upload HTTP/1.1\r\nHost: strict.local\r\nContent-Length: 10\r\n\r\nabc")
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusRequestTimeout {
+			t.Errorf("expected the read timeout to hit, got %v", res.Status)
+		}
+	})
+
+	t.Run("slow body over http2", func(t *testing.T) {
+		secure := httptest.NewUnstartedServer(nil)
+		secure.Config = proxyManager.newServer("", proxyManager.Handler(false))
+		secure.EnableHTTP2 = true
+		secure.StartTLS()
+		defer secure.Close()
+		client := secure.Client()
+
+		// the read timeout of one stream mustn't cut the others of the connection off
+		polled := make(chan error, 1)
+		go func() {
+			req, _ := http.NewRequest("GET", secure.URL+"/poll", nil)
+			req.Host = "open.local"
+			res, err := client.Do(req)
+			if err == nil {
+				body, _ := ioutil.ReadAll(res.Body)
+				_ = res.Body.Close()
+				if res.ProtoMajor != 2 || string(body) != "update" {
+					err = fmt.Errorf("unexpected response %v %q", res.Proto, body)
+				}
+			}
+			polled <- err
+		}()
+		time.Sleep(time.Millisecond * 50)
+
+		reader, writer := io.Pipe()
+		defer writer.Close()
+		go func() {
+			_, _ = writer.Write([]byte("abc"))
+		}()
+		req, _ := http.NewRequest("POST", secure.URL+"/upload", reader)
+		req.Host = "strict.local"
+		req.ContentLength = 10
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+		if res.StatusCode != http.StatusRequestTimeout && res.StatusCode != http.StatusGatewayTimeout {
+			t.Errorf("expected the request to time out, got %v", res.Status)
+		}
+		if err := <-polled; err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("shared backends", func(t *testing.T) {
+		backend, err := NewBackend(upstream.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := proxyManager.InstallRouteWithOptions("first.local", &RouteOptions{Backends: []*Backend{backend}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := proxyManager.InstallRouteWithOptions("second.local", &RouteOptions{Backends: []*Backend{backend}}); err == nil {
+			t.Error("expected a backend serving another route to be rejected")
+		}
+		if _, err := proxyManager.SwapBackends("open.local", []*Backend{backend}); err == nil {
+			t.Error("expected a backend serving another route to be rejected")
+		}
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		config, _ := websocket.NewConfig("ws://idle.local/ws", "http://idle.local")
+		tcp, err := net.Dial("tcp", address.Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := websocket.NewClient(config, tcp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// traffic keeps the connection open past the idle timeout
+		for i := 0; i < 3; i++ {
+			time.Sleep(time.Millisecond * 100)
+			if err := websocket.Message.Send(conn, "ping"); err != nil {
+				t.Fatal(err)
+			}
+			var echo string
+			if err := websocket.Message.Receive(conn, &echo); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+		var echo string
+		if err := websocket.Message.Receive(conn, &echo); err == nil || strings.Contains(err.Error(), "timeout") {
+			t.Errorf("expected the idle connection to be closed, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"bufio"
+	"errors"
+	"kerfuffle/pkg/metrics"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// unroutedLabel is the route label of requests for hosts without a route, the
+// hosts themselves aren't used so clients can't blow up the amount of series.
+const unroutedLabel = "none"
+
+var (
+	proxyRequests = metrics.Default.NewCounter("kerfuffle_proxy_requests_total",
+		"Requests handled by the reverse proxy.", "route", "code")
+	proxyLatency = metrics.Default.NewHistogram("kerfuffle_proxy_request_duration_seconds",
+		"Time taken to respond to requests through the reverse proxy.", nil, "route")
+)
+
+// statusRecorder captures the status code of a response. It passes flushes and
+// hijacks on to the underlying writer so streaming responses and websockets keep working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func newStatusRecorder(res http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: res, status: http.StatusOK}
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.written += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response doesn't support hijacking")
+	}
+	// the connection is switching protocols once it's hijacked
+	r.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// observeRequest records a request in the proxy metrics.
+func observeRequest(route string, status int, took time.Duration) {
+	if route == "" {
+		route = unroutedLabel
+	}
+	proxyRequests.Inc(route, strconv.Itoa(status))
+	proxyLatency.Observe(took.Seconds(), route)
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHttpReverseProxyManager_Metrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "echo" {
+			w.Header().Set("Connection", "Upgrade")
+			w.Header().Set("Upgrade", "echo")
+			w.WriteHeader(http.StatusSwitchingProtocols)
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			line, _ := rw.ReadString('\n')
+			_, _ = rw.WriteString(line)
+			_ = rw.Flush()
+			return
+		}
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer upstream.Close()
+
+	const host = "metrics.local"
+	proxyManager := NewHttpReverseProxyManager()
+	if err := proxyManager.InstallRoute(host, upstream.URL); err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(proxyManager.Handler(false))
+	defer proxy.Close()
+
+	teapots, unrouted := proxyRequests.Value(host, "418"), proxyRequests.Value(unroutedLabel, "200")
+	observed := proxyLatency.Count(host)
+	for _, requestHost := range []string{host, host, "unknown.local"} {
+		req, _ := http.NewRequest("GET", proxy.URL, nil)
+		req.Host = requestHost
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+	}
+	if proxyRequests.Value(host, "418")-teapots != 2 || proxyRequests.Value(unroutedLabel, "200")-unrouted != 1 {
+		t.Errorf("requests weren't counted by route and status")
+	}
+
+	// upgraded connections are hijacked through the status recorder
+	switched := proxyRequests.Value(host, "101")
+	address, _ := url.Parse(proxy.URL)
+	conn, err := net.Dial("tcp", address.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %v\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n", host)
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status %v", res.Status)
+	}
+	_, _ = fmt.Fprint(conn, "hello\n")
+	if line, _ := reader.ReadString('\n'); line != "hello\n" {
+		t.Errorf("unexpected echo %q", line)
+	}
+	_ = conn.Close()
+
+	// the request is observed once the hijacked connection is done
+	deadline := time.Now().Add(time.Second * 2)
+	for proxyRequests.Value(host, "101")-switched != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if proxyRequests.Value(host, "101")-switched != 1 || proxyLatency.Count(host)-observed != 3 {
+		t.Errorf("the upgraded request wasn't counted")
+	}
+}
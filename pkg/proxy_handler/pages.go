@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"bytes"
+	"context"
+	"github.com/rs/zerolog/log"
+	"html/template"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultRetryAfter is sent with maintenance responses when the route has no ETA.
+const defaultRetryAfter = time.Minute * 2
+
+// Maintenance describes why a route is on hold.
+type Maintenance struct {
+	Reason string
+	// Until is when the route is expected back, zero when it's unknown
+	Until time.Time
+}
+
+// ErrorPages replace the responses a route sends when it can't serve a request,
+// the pages which aren't set fall back to the built in ones.
+type ErrorPages struct {
+	// App is the name of the application, as shown on the pages
+	App         string
+	Maintenance *template.Template
+	// NotFound replaces the 404s of the backends, for requests of HTML pages
+	NotFound *template.Template
+	// BadGateway is shown when no backend could answer the request
+	BadGateway *template.Template
+}
+
+// PageData is what the error pages are executed with.
+type PageData struct {
+	App    string
+	Status int
+	Reason string
+	// ETA is when the route is expected back, zero when it's unknown
+	ETA  time.Time
+	Host string
+	Path string
+}
+
+type routeKey struct{}
+
+// routedRequest is what the client asked for, before the request was rewritten for the backend.
+type routedRequest struct {
+	route      *Route
+	host, path string
+	// retries is how many other backends the request can still be sent to
+	retries int
+	// failure is set when the last backend the request was sent to failed
+	failure *UpstreamError
+}
+
+// withRoute lets the backends find the route they're serving the request for.
+func withRoute(req *http.Request, route *Route) *http.Request {
+	routed := &routedRequest{route: route, host: req.Host, path: req.URL.Path}
+	return req.WithContext(context.WithValue(req.Context(), routeKey{}, routed))
+}
+
+func routeOf(req *http.Request) *routedRequest {
+	routed, _ := req.Context().Value(routeKey{}).(*routedRequest)
+	return routed
+}
+
+func (p *ErrorPages) data(req *http.Request, status int, reason string) *PageData {
+	data := &PageData{Status: status, Reason: reason, Host: req.Host, Path: req.URL.Path}
+	if p != nil {
+		data.App = p.App
+	}
+	return data
+}
+
+// render executes the page, nil is returned when there's no page or it failed.
+func render(page *template.Template, data *PageData) []byte {
+	if page == nil {
+		return nil
+	}
+	var b bytes.Buffer
+	err := page.Execute(&b, data)
+	if err != nil {
+		log.Err(err).Str("page", page.Name()).Msg("failed to render error page")
+		return nil
+	}
+	return b.Bytes()
+}
+
+func writePage(res http.ResponseWriter, status int, body []byte) {
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(status)
+	_, err := res.Write(body)
+	if err != nil {
+		log.Err(err).Stack().Msg("failed to write")
+	}
+}
+
+// retryAfter returns the seconds clients should wait before retrying.
+func (h *Maintenance) retryAfter(now time.Time) int {
+	if h.Until.After(now) {
+		return int(math.Ceil(h.Until.Sub(now).Seconds()))
+	}
+	return int(defaultRetryAfter.Seconds())
+}
+
+// writeMaintenance answers a request to a route on hold with a 503.
+func (r *Route) writeMaintenance(res http.ResponseWriter, req *http.Request) {
+	data := r.pages.data(req, http.StatusServiceUnavailable, r.hold.Reason)
+	data.ETA = r.hold.Until
+	var page *template.Template
+	if r.pages != nil {
+		page = r.pages.Maintenance
+	}
+	body := render(page, data)
+	if body == nil {
+		body = SiteMaintenance
+	}
+	res.Header().Set("Retry-After", strconv.Itoa(r.hold.retryAfter(time.Now())))
+	writePage(res, http.StatusServiceUnavailable, body)
+}
+
+// writeError answers a request which no backend could serve, with the bad gateway
+// page of the route or the built in one for 502s and 504s.
+func (r *Route) writeError(res http.ResponseWriter, req *http.Request, status int, reason string) {
+	if status != http.StatusBadGateway && status != http.StatusGatewayTimeout {
+		res.WriteHeader(status)
+		return
+	}
+	page := errorPage
+	if r.pages != nil && r.pages.BadGateway != nil {
+		page = r.pages.BadGateway
+	}
+	body := render(page, r.pages.data(req, status, reason))
+	if body == nil {
+		http.Error(res, reason, status)
+		return
+	}
+	writePage(res, status, body)
+}
+
+// replaceNotFound swaps a backend's 404 for the route's not found page, only for
+// requests of HTML pages so APIs keep their own answers.
+func replaceNotFound(res *http.Response) error {
+	routed := routeOf(res.Request)
+	if res.StatusCode != http.StatusNotFound || routed == nil || routed.route.pages == nil || routed.route.pages.NotFound == nil {
+		return nil
+	}
+	pages := routed.route.pages
+	req := res.Request
+	if req.Method != http.MethodGet && req.Method != http.MethodHead || !strings.Contains(req.Header.Get("Accept"), "text/html") {
+		return nil
+	}
+	data := pages.data(req, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	data.Host, data.Path = routed.host, routed.path
+	body := render(pages.NotFound, data)
+	if body == nil {
+		return nil
+	}
+	_ = res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	for _, header := range []string{"Content-Encoding", "ETag", "Last-Modified", "Transfer-Encoding"} {
+		res.Header.Del(header)
+	}
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	res.Header.Set("Content-Type", "text/html; charset=utf-8")
+	res.Header.Set("Cache-Control", "no-store")
+	return nil
+}
+
+// SetMaintenance puts a route on hold, requests are answered with its maintenance
+// page until it's lifted with nil.
+func (m *HttpReverseProxyManager) SetMaintenance(originAddr string, maintenance *Maintenance) error {
+	return m.modifyRoute(originAddr, func(route *Route) {
+		route.hold = maintenance
+	})
+}
+
+// SetErrorPages replaces the error pages of a route, nil restores the built in ones.
+func (m *HttpReverseProxyManager) SetErrorPages(originAddr string, pages *ErrorPages) error {
+	return m.modifyRoute(originAddr, func(route *Route) {
+		route.pages = pages
+	})
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHttpReverseProxyManager_ErrorPages(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"not found"}`))
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	pages := &ErrorPages{
+		App:         "Odi Chat",
+		Maintenance: template.Must(template.New("maintenance").Parse(`{{.App}} is down: {{.Reason}}{{if not .ETA.IsZero}} until {{.ETA.Format "15:04"}}{{end}}`)),
+		NotFound:    template.Must(template.New("not_found").Parse(`{{.Status}} {{.Path}} isn't on {{.App}}`)),
+		BadGateway:  template.Must(template.New("bad_gateway").Parse(`{{.App}} answered {{.Status}}`)),
+	}
+	proxyManager := NewHttpReverseProxyManager()
+	install := func(origin, target string, options *RouteOptions) {
+		backend, err := NewBackend(target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		options.Backends = []*Backend{backend}
+		if err := proxyManager.InstallRouteWithOptions(origin, options); err != nil {
+			t.Fatal(err)
+		}
+	}
+	install("chat.local/app", upstream.URL, &RouteOptions{Pages: pages, StripPrefix: true})
+	install("down.local", closed.URL, &RouteOptions{Pages: pages})
+	install("plain.local", upstream.URL, &RouteOptions{})
+
+	handler := proxyManager.Handler(false)
+	request := func(url, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	res := request("http://chat.local/app/missing", "text/html,*/*")
+	if res.Code != http.StatusNotFound || res.Body.String() != "404 /app/missing isn't on Odi Chat" {
+		t.Errorf("expected the not found page, got %v %q", res.Code, res.Body.String())
+	}
+	if res.Header().Get("Content-Length") != strconv.Itoa(res.Body.Len()) {
+		t.Errorf("expected the length of the page, got %v", res.Header().Get("Content-Length"))
+	}
+	if res := request("http://chat.local/app/missing", "application/json"); res.Body.String() != `{"error":"not found"}` {
+		t.Errorf("expected API 404s to be left alone, got %q", res.Body.String())
+	}
+	if res := request("http://down.local/", ""); res.Code != http.StatusBadGateway || res.Body.String() != "Odi Chat answered 502" {
+		t.Errorf("expected the bad gateway page, got %v %q", res.Code, res.Body.String())
+	}
+
+	until := time.Now().Add(time.Minute * 10)
+	if err := proxyManager.SetMaintenance("chat.local/app", &Maintenance{Reason: "upgrading the database", Until: until}); err != nil {
+		t.Fatal(err)
+	}
+	res = request("http://chat.local/app/", "")
+	if res.Code != http.StatusServiceUnavailable || res.Body.String() != "Odi Chat is down: upgrading the database until "+until.Format("15:04") {
+		t.Errorf("expected the maintenance page, got %v %q", res.Code, res.Body.String())
+	}
+	if retry, _ := strconv.Atoi(res.Header().Get("Retry-After")); retry < 590 || retry > 600 {
+		t.Errorf("expected to be retried at the ETA, got %v", res.Header().Get("Retry-After"))
+	}
+
+	// routes without pages of their own use the built in ones
+	if err := proxyManager.SetHold("plain.local", true); err != nil {
+		t.Fatal(err)
+	}
+	res = request("http://plain.local/", "")
+	if res.Code != http.StatusServiceUnavailable || res.Body.String() != string(SiteMaintenance) {
+		t.Errorf("expected the built in maintenance page, got %v", res.Code)
+	}
+	if res.Header().Get("Retry-After") != strconv.Itoa(int(defaultRetryAfter.Seconds())) {
+		t.Errorf("expected the default Retry-After, got %v", res.Header().Get("Retry-After"))
+	}
+	if err := proxyManager.SetHold("plain.local", false); err != nil {
+		t.Fatal(err)
+	}
+	if res := request("http://plain.local/", ""); res.Code != http.StatusOK || res.Body.String() != "ok" {
+		t.Errorf("expected the route to be back, got %v %q", res.Code, res.Body.String())
+	}
+}
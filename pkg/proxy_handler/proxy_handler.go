@@ -10,12 +10,16 @@ import (
 	"context"
 	_ "embed"
 	"errors"
+	"fmt"
 	"github.com/rs/zerolog/log"
-	"kerfuffle"
+	"golang.org/x/crypto/acme/autocert"
 	_ "kerfuffle/pkg/logging"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Host = string
@@ -27,147 +31,425 @@ var (
 	SiteMaintenance []byte
 )
 
+// Route is never modified once it's in the route table, except for its backends.
+// Changes are made to a clone which then replaces it.
 type Route struct {
-	Origin *url.URL
-	Target *url.URL
-	Proxy  *httputil.ReverseProxy
+	// Origin holds the host of the route and its path prefix, if any
+	Origin   *url.URL
+	Balancer Balancer
+
+	// owner is whoever installed the route, wildcards of different owners can't overlap
+	owner string
+
+	// backends holds a []*Backend, it's swapped as a whole so requests never
+	// observe a half updated set of backends.
+	backends atomic.Value
+
+	// hold is nil unless the route is in maintenance
+	hold          *Maintenance
+	redirectHTTPS bool
+	accessLog     bool
+
+	limits RouteLimits
+	// limiter is nil when the route isn't rate limited
+	limiter *rateLimiter
+	// access is nil when anyone can reach the route
+	access *accessGuard
+	// transport is shared by the backends of the route, nil for the default one
+	transport http.RoundTripper
+	// pages is nil when the route uses the built in pages
+	pages *ErrorPages
+	// onError is told about the requests the backends failed to answer, it can be nil
+	onError func(failure *UpstreamError)
+
+	// stripPrefix removes the prefix from the path before it's forwarded,
+	// replacing it with rewritePrefix
+	stripPrefix   bool
+	rewritePrefix string
+}
 
-	hold bool
+func (r *Route) clone() *Route {
+	route := &Route{
+		Origin:        r.Origin,
+		Balancer:      r.Balancer,
+		owner:         r.owner,
+		limits:        r.limits,
+		limiter:       r.limiter,
+		access:        r.access,
+		transport:     r.transport,
+		pages:         r.pages,
+		onError:       r.onError,
+		hold:          r.hold,
+		redirectHTTPS: r.redirectHTTPS,
+		accessLog:     r.accessLog,
+		stripPrefix:   r.stripPrefix,
+		rewritePrefix: r.rewritePrefix,
+	}
+	route.backends.Store(r.Backends())
+	return route
 }
 
 type HttpReverseProxyManager struct {
-	routes map[Host]*Route
+	// routes holds a routeTable which is replaced on every change, so the proxy
+	// can look up routes without locking. routesLock serializes the writers.
+	routes     atomic.Value
+	routesLock sync.Mutex
+
+	certManager *autocert.Manager
+	// tlsAddr holds the address of the TLS listener once it's launched
+	tlsAddr atomic.Value
+	// accessLogger holds the *AccessLogger, nil when access logs are disabled
+	accessLogger atomic.Value
+
+	serverTimeouts ServerTimeouts
+	// trustedProxies holds the []*net.IPNet of the proxies whose forwarding headers are trusted
+	trustedProxies atomic.Value
 
 	stop chan interface{}
 }
 
 func NewHttpReverseProxyManager() *HttpReverseProxyManager {
-	return &HttpReverseProxyManager{routes: make(map[Host]*Route), stop: make(chan interface{})}
+	m := &HttpReverseProxyManager{
+		stop:           make(chan interface{}),
+		serverTimeouts: ServerTimeouts{ReadHeader: defaultReadHeaderTimeout, Idle: defaultIdleTimeout},
+	}
+	m.routes.Store(newRouteTable())
+	m.tlsAddr.Store("")
+	m.accessLogger.Store((*AccessLogger)(nil))
+	m.trustedProxies.Store([]*net.IPNet(nil))
+	return m
 }
 
-func (m *HttpReverseProxyManager) UninstallRoute(originAddr string) error {
-	origin, err := url.Parse(originAddr)
+// getRoute looks up the route of a request path on a host in the current route table.
+func (m *HttpReverseProxyManager) getRoute(host Host, urlPath string) (*Route, bool) {
+	return m.routes.Load().(*routeTable).lookup(host, urlPath)
+}
+
+// hasHost reports whether a route is installed on exactly the host.
+func (m *HttpReverseProxyManager) hasHost(host Host) bool {
+	return m.routes.Load().(*routeTable).serves(host)
+}
+
+// updateRoutes applies the update to a copy of the route table and publishes it,
+// the table is left untouched if the update fails.
+func (m *HttpReverseProxyManager) updateRoutes(update func(routes *routeTable) error) error {
+	m.routesLock.Lock()
+	defer m.routesLock.Unlock()
+	routes := m.routes.Load().(*routeTable).copy()
+	err := update(routes)
 	if err != nil {
 		return err
 	}
+	m.routes.Store(routes)
+	return nil
+}
 
-	if origin.Host == "" && originAddr != "" {
-		origin.Host = originAddr
-	} else {
-		return errors.New("origin host cannot be empty")
+func (m *HttpReverseProxyManager) UninstallRoute(originAddr string) error {
+	origin, err := parseOrigin(originAddr)
+	if err != nil {
+		return err
 	}
 
-	if _, exists := m.routes[origin.Host]; !exists {
-		return errors.New("origin host isn't installed")
-	}
+	return m.updateRoutes(func(routes *routeTable) error {
+		if _, exists := routes.get(origin); !exists {
+			return errors.New("origin host isn't installed")
+		}
+		routes.remove(origin)
+		return nil
+	})
+}
 
-	delete(m.routes, origin.Host)
-	return nil
+// RouteOptions describe how a route forwards its requests.
+type RouteOptions struct {
+	Backends []*Backend
+	// Balancer defaults to round robin when nil.
+	Balancer Balancer
+	// StripPrefix removes the origin's path prefix from the requests before they're forwarded.
+	StripPrefix bool
+	// RewritePrefix replaces the origin's path prefix, it implies StripPrefix.
+	RewritePrefix string
+	// Owner identifies who the route belongs to, it's checked for overlapping wildcards.
+	Owner     string
+	Limits    RouteLimits
+	RateLimit RateLimit
+	// Access restricts who can reach the route, nil lets everyone through.
+	Access *AccessControl
+	// Pages replace the built in maintenance and error pages.
+	Pages *ErrorPages
+	// OnError is called with every request the backends failed to answer.
+	OnError func(failure *UpstreamError)
 }
 
 func (m *HttpReverseProxyManager) InstallRoute(originAddr string, targetAddr string) error {
-	origin, err := url.Parse(originAddr)
+	backend, err := NewBackend(targetAddr, nil)
 	if err != nil {
 		return err
 	}
+	return m.InstallRouteWithOptions(originAddr, &RouteOptions{Backends: []*Backend{backend}})
+}
 
-	if origin.Host == "" && originAddr != "" {
-		origin.Host = originAddr
-	} else {
-		return errors.New("origin host cannot be empty")
+func (m *HttpReverseProxyManager) InstallRouteWithOptions(originAddr string, options *RouteOptions) error {
+	if options == nil || len(options.Backends) == 0 {
+		return errors.New("route needs at least one backend")
 	}
 
-	if _, exists := m.routes[origin.Host]; exists {
-		return errors.New("origin host already exists")
+	origin, err := parseOrigin(originAddr)
+	if err != nil {
+		return err
 	}
 
-	target, err := url.Parse(targetAddr)
+	access, err := newAccessGuard(options.Access)
 	if err != nil {
 		return err
 	}
 
-	if target.Host == "" {
-		return errors.New("target host cannot be empty")
+	balancer := options.Balancer
+	if balancer == nil {
+		balancer = &roundRobin{}
 	}
 
-	log.Debug().Str("origin", origin.Host).Str("target", target.Host).Msg("registering route")
-	proxy := httputil.NewSingleHostReverseProxy(target)
-	proxy.ModifyResponse = func(response *http.Response) error {
-		response.Header.Set("X-Kerfuffle-Version", kerfuffle.Version)
-		return nil
+	for _, backend := range options.Backends {
+		log.Debug().Str("origin", originAddr).Str("target", backend.Target.Host).Msg("registering route")
 	}
 
-	m.routes[origin.Host] = &Route{
-		Origin: origin,
-		Target: target,
-		Proxy:  proxy,
+	route := &Route{
+		Origin:        origin,
+		Balancer:      balancer,
+		owner:         options.Owner,
+		accessLog:     true,
+		stripPrefix:   options.StripPrefix || options.RewritePrefix != "",
+		rewritePrefix: cleanPrefix(options.RewritePrefix),
+		limits:        options.Limits,
+		limiter:       newRateLimiter(options.RateLimit),
+		access:        access,
+		transport:     options.Limits.transport(),
+		pages:         options.Pages,
+		onError:       options.OnError,
 	}
+	route.backends.Store(options.Backends)
 
+	return m.updateRoutes(func(routes *routeTable) error {
+		if _, exists := routes.get(origin); exists {
+			return errors.New("origin host already exists")
+		}
+		if conflict := routes.conflict(route); conflict != nil {
+			return fmt.Errorf("%w: '%v' is claimed by %v", ErrRouteConflict, conflict.Name(), conflict.owner)
+		}
+		err := route.configure(options.Backends)
+		if err != nil {
+			return err
+		}
+		routes.put(route)
+		return nil
+	})
+}
+
+// configure applies the route's transport settings to the backends which haven't
+// served yet. Backends can't be shared between routes, their settings would be
+// rewritten while they serve the other route. It's only called by the writers of
+// the route table.
+func (r *Route) configure(backends []*Backend) error {
+	for _, backend := range backends {
+		if backend.route != "" && backend.route != r.Name() {
+			return fmt.Errorf("backend '%v' already serves '%v'", backend.Target.Host, backend.route)
+		}
+	}
+	for _, backend := range backends {
+		if backend.route == "" {
+			backend.route = r.Name()
+			backend.Proxy.Transport = r.transport
+			backend.Proxy.FlushInterval = r.limits.FlushInterval
+		}
+	}
 	return nil
 }
 
-func (m *HttpReverseProxyManager) SetHold(originAddr string, value bool) error {
-	origin, err := url.Parse(originAddr)
+// Backends returns the backends the route is currently forwarding to.
+func (r *Route) Backends() []*Backend {
+	return r.backends.Load().([]*Backend)
+}
+
+// SwapBackends atomically replaces the backends of a route and returns the previous
+// ones, requests already being served by them are left to finish.
+func (m *HttpReverseProxyManager) SwapBackends(originAddr string, backends []*Backend) ([]*Backend, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("route needs at least one backend")
+	}
+
+	origin, err := parseOrigin(originAddr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if origin.Host == "" && originAddr != "" {
-		origin.Host = originAddr
-	} else {
-		return errors.New("origin host cannot be empty")
+	for _, backend := range backends {
+		log.Debug().Str("origin", originAddr).Str("target", backend.Target.Host).Msg("swapping route backend")
 	}
+	var previous []*Backend
+	// the route isn't replaced, updateRoutes only serializes the swap with the other writers
+	err = m.updateRoutes(func(routes *routeTable) error {
+		route, exists := routes.get(origin)
+		if !exists {
+			return errors.New("origin host isn't installed")
+		}
+		err := route.configure(backends)
+		if err != nil {
+			return err
+		}
+		previous = route.Backends()
+		route.backends.Store(backends)
+		return nil
+	})
+	return previous, err
+}
 
-	if route, exists := m.routes[origin.Host]; !exists {
-		return errors.New("origin host isn't installed")
-	} else {
-		route.hold = value
+// SetHold toggles the maintenance of a route, without a reason or an ETA.
+func (m *HttpReverseProxyManager) SetHold(originAddr string, value bool) error {
+	var maintenance *Maintenance
+	if value {
+		maintenance = &Maintenance{}
 	}
-	return nil
+	return m.SetMaintenance(originAddr, maintenance)
+}
+
+// SetRedirectHTTPS toggles redirecting plain HTTP requests on a route to HTTPS.
+// Redirects only happen when the TLS listener has been launched.
+func (m *HttpReverseProxyManager) SetRedirectHTTPS(originAddr string, value bool) error {
+	return m.modifyRoute(originAddr, func(route *Route) {
+		route.redirectHTTPS = value
+	})
+}
+
+// SetAccessLog toggles the access logs of a route, they're enabled by default.
+func (m *HttpReverseProxyManager) SetAccessLog(originAddr string, value bool) error {
+	return m.modifyRoute(originAddr, func(route *Route) {
+		route.accessLog = value
+	})
+}
+
+// SetAccessLogger sets where the requests are logged to, nil disables the access logs.
+func (m *HttpReverseProxyManager) SetAccessLogger(logger *AccessLogger) {
+	m.accessLogger.Store(logger)
+}
+
+// modifyRoute replaces the route with a modified clone.
+func (m *HttpReverseProxyManager) modifyRoute(originAddr string, modify func(route *Route)) error {
+	origin, err := parseOrigin(originAddr)
+	if err != nil {
+		return err
+	}
+
+	return m.updateRoutes(func(routes *routeTable) error {
+		route, exists := routes.get(origin)
+		if !exists {
+			return errors.New("origin host isn't installed")
+		}
+		route = route.clone()
+		modify(route)
+		routes.put(route)
+		return nil
+	})
 }
 
+// Stop shuts down every server launched by the manager.
 func (m *HttpReverseProxyManager) Stop() {
-	m.stop <- struct{}{}
+	close(m.stop)
 }
 
-func (m *HttpReverseProxyManager) Launch(addr string) chan error {
+// Handler returns the http.Handler which routes requests to the installed routes.
+// secure marks requests which arrived through the TLS listener.
+func (m *HttpReverseProxyManager) Handler(secure bool) http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(res http.ResponseWriter, req *http.Request) {
-		route, exists := m.routes[req.Host]
-		if !exists {
-			log.Error().Str("path", req.Host).Msgf("host not found")
-			_, err := res.Write(SiteIndex)
-			if err != nil {
-				log.Err(err).Stack().Msg("failed to write")
-			}
-			return
-		}
-
-		if route.hold {
-			_, err := res.Write(SiteMaintenance)
-			if err != nil {
-				log.Err(err).Stack().Msg("failed to write")
-			}
-			return
-		}
-
-		log.Info().
-			Str("method", req.Method).
-			Str("origin", req.Host).
-			Str("target", route.Target.String()).
-			Str("path", req.URL.String()).
-			Msg("proxy")
-
-		req.URL.Host = route.Target.Host
-		req.URL.Scheme = route.Target.Scheme
-		req.Header.Set("X-Forwarded-Host", req.Host)
-		req.Host = route.Target.Host
-		route.Proxy.ServeHTTP(res, req)
+		req = m.withClientIP(req)
+		entry := newAccessLogEntry(req, secure)
+		recorder := newStatusRecorder(res)
+		route, backend := m.serve(recorder, req, secure)
+		entry.Duration = time.Since(entry.At)
+		entry.Status, entry.Bytes = recorder.status, recorder.written
+		if route != nil {
+			entry.Route = route.Name()
+		}
+		if backend != nil {
+			entry.Backend = backend.Target.Host
+		}
+
+		observeRequest(entry.Route, entry.Status, entry.Duration)
+		if logger := m.accessLogger.Load().(*AccessLogger); logger != nil && (route == nil || route.accessLog) {
+			logger.Log(entry)
+		}
 	})
 
+	// the ACME HTTP-01 challenges are served from the plain HTTP listener
+	if !secure && m.certManager != nil {
+		return m.certManager.HTTPHandler(mux)
+	}
+	return mux
+}
+
+// serve forwards the request to its route, it returns the route and the backend
+// which handled the request, either is nil when the request didn't get that far.
+func (m *HttpReverseProxyManager) serve(res http.ResponseWriter, req *http.Request, secure bool) (*Route, *Backend) {
+	route, exists := m.getRoute(req.Host, req.URL.Path)
+	if !exists {
+		log.Error().Str("path", req.Host).Msgf("host not found")
+		_, err := res.Write(SiteIndex)
+		if err != nil {
+			log.Err(err).Stack().Msg("failed to write")
+		}
+		return nil, nil
+	}
+
+	if !secure && route.redirectHTTPS && m.tlsAddr.Load().(string) != "" {
+		http.Redirect(res, req, m.httpsURL(req), http.StatusPermanentRedirect)
+		return route, nil
+	}
+
+	// the rate limit comes first, clients can't flood the forward auth service
+	if route.limiter != nil {
+		client := ClientIP(req)
+		admitted, wait := route.limiter.acquire(client, time.Now())
+		if !admitted {
+			route.limiter.reject(res, wait)
+			return route, nil
+		}
+		defer route.limiter.release(client)
+	}
+
+	if route.access != nil && !route.access.admit(res, req, secure) {
+		return route, nil
+	}
+
+	if route.hold != nil {
+		route.writeMaintenance(res, req)
+		return route, nil
+	}
+
+	res, req, release, ok := route.limits.apply(res, req)
+	defer release()
+	if !ok {
+		return route, nil
+	}
+
+	req = withRoute(req, route)
+	req.Header.Set("X-Forwarded-Host", req.Host)
+	if secure {
+		req.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		req.Header.Set("X-Forwarded-Proto", "http")
+	}
+	if route.stripPrefix {
+		if route.Origin.Path != "" {
+			req.Header.Set("X-Forwarded-Prefix", route.Origin.Path)
+		}
+		route.rewritePath(req.URL)
+	}
+	return route, route.forward(res, req, secure)
+}
+
+func (m *HttpReverseProxyManager) Launch(addr string) chan error {
 	errChan := make(chan error)
 
-	srv := &http.Server{Addr: addr, Handler: mux}
+	srv := m.newServer(addr, m.Handler(false))
 	go func(srv *http.Server) {
 		err := srv.ListenAndServe()
 		if err != nil {
@@ -14,6 +14,8 @@ import (
 	"io/ioutil"
 	_ "kerfuffle/pkg/logging"
 	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 )
@@ -215,3 +217,53 @@ func TestHttpReverseProxyManager_Launch(t *testing.T) {
 		close(done)
 	})
 }
+
+// TestHttpReverseProxyManager_Concurrency changes the route table while it's
+// serving, run it with -race.
+func TestHttpReverseProxyManager_Concurrency(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	newBackends := func() []*Backend {
+		backend, err := NewBackend(srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []*Backend{backend}
+	}
+
+	proxyManager := NewHttpReverseProxyManager()
+	handler := proxyManager.Handler(false)
+	hosts := []string{"a.local", "b.local", "c.local"}
+
+	var wg sync.WaitGroup
+	for _, host := range hosts {
+		host := host
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				_ = proxyManager.InstallRouteWithOptions(host, &RouteOptions{Backends: newBackends()})
+				_ = proxyManager.SetHold(host, i%2 == 0)
+				_ = proxyManager.SetRedirectHTTPS(host, false)
+				_, _ = proxyManager.SwapBackends(host, newBackends())
+				_ = proxyManager.UninstallRoute(host)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://"+host+"/", nil))
+				switch rec.Code {
+				case http.StatusOK, http.StatusNotFound, http.StatusServiceUnavailable:
+				default:
+					t.Errorf("unexpected status %v for %v", rec.Code, host)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRateLimitMessage = "too many requests"
+	bucketSweepInterval     = time.Minute
+)
+
+// RateLimit throttles the clients of a route, zero values disable a limit.
+type RateLimit struct {
+	// Rate is the amount of requests per second a client can sustain
+	Rate float64
+	// Burst is the amount of requests a client can make at once, defaults to Rate
+	Burst int
+	// MaxConcurrent caps the requests being served by the route at once
+	MaxConcurrent int
+	// MaxConcurrentPerClient caps the requests of a single client being served at once
+	MaxConcurrentPerClient int
+	// Message is the body of the 429 responses
+	Message string
+}
+
+func (r *RateLimit) empty() bool {
+	return r.Rate <= 0 && r.MaxConcurrent <= 0 && r.MaxConcurrentPerClient <= 0
+}
+
+// rateLimiter holds the state of a route's rate limit, it's shared by the clones of the route.
+type rateLimiter struct {
+	limit RateLimit
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	active    int
+	perClient map[string]int
+	swept     time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.empty() {
+		return nil
+	}
+	burst := float64(limit.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(limit.Rate))
+	}
+	if limit.Message == "" {
+		limit.Message = defaultRateLimitMessage
+	}
+	return &rateLimiter{
+		limit:     limit,
+		burst:     burst,
+		buckets:   map[string]*tokenBucket{},
+		perClient: map[string]int{},
+		swept:     time.Now(),
+	}
+}
+
+// acquire admits a request of the client, it returns how long the client should wait
+// when it's over its limits. Admitted requests have to be released once they're done.
+func (l *rateLimiter) acquire(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limit.MaxConcurrent > 0 && l.active >= l.limit.MaxConcurrent {
+		return false, time.Second
+	}
+	if l.limit.MaxConcurrentPerClient > 0 && l.perClient[client] >= l.limit.MaxConcurrentPerClient {
+		return false, time.Second
+	}
+
+	if l.limit.Rate > 0 {
+		l.sweep(now)
+		bucket, exists := l.buckets[client]
+		if !exists {
+			bucket = &tokenBucket{tokens: l.burst, at: now}
+			l.buckets[client] = bucket
+		}
+		bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.at).Seconds()*l.limit.Rate)
+		bucket.at = now
+		if bucket.tokens < 1 {
+			wait := time.Duration((1 - bucket.tokens) / l.limit.Rate * float64(time.Second))
+			return false, wait
+		}
+		bucket.tokens--
+	}
+
+	l.active++
+	l.perClient[client]++
+	return true, 0
+}
+
+func (l *rateLimiter) release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if l.perClient[client]--; l.perClient[client] <= 0 {
+		delete(l.perClient, client)
+	}
+}
+
+// sweep forgets the buckets which have refilled, they're no different from new ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < bucketSweepInterval {
+		return
+	}
+	l.swept = now
+	full := time.Duration(l.burst / l.limit.Rate * float64(time.Second))
+	for client, bucket := range l.buckets {
+		if now.Sub(bucket.at) > full {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// reject answers a request which is over the limits.
+func (l *rateLimiter) reject(res http.ResponseWriter, wait time.Duration) {
+	res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(res, l.limit.Message, http.StatusTooManyRequests)
+}
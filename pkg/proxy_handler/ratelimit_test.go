@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHttpReverseProxyManager_ClientIP(t *testing.T) {
+	proxyManager := NewHttpReverseProxyManager()
+	if err := proxyManager.SetTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ remote, forwarded, connecting, client string }{
+		{"203.0.113.7:1000", "198.51.100.1", "", "203.0.113.7"},
+		{"10.0.0.1:1000", "198.51.100.1, 10.0.0.2", "", "198.51.100.1"},
+		{"10.0.0.1:1000", "198.51.100.9, 198.51.100.1, 192.0.2.1", "", "198.51.100.1"},
+		{"10.0.0.1:1000", "", "198.51.100.2", "198.51.100.2"},
+		{"10.0.0.1:1000", "", "", "10.0.0.1"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if test.connecting != "" {
+			req.Header.Set("CF-Connecting-IP", test.connecting)
+		}
+		if client := ClientIP(proxyManager.withClientIP(req)); client != test.client {
+			t.Errorf("expected %+v to come from %v, got %v", test, test.client, client)
+		}
+	}
+	if err := proxyManager.SetTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("invalid networks should be rejected")
+	}
+}
+
+func TestHttpReverseProxyManager_RateLimit(t *testing.T) {
+	arrived, release := make(chan struct{}), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(arrived)
+			<-release
+		}
+	}))
+	defer upstream.Close()
+
+	proxyManager := NewHttpReverseProxyManager()
+	if err := proxyManager.SetTrustedProxies([]string{"10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	install := func(host string, limit RateLimit) {
+		backend, err := NewBackend(upstream.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := proxyManager.InstallRouteWithOptions(host, &RouteOptions{Backends: []*Backend{backend}, RateLimit: limit}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	install("rate.local", RateLimit{Rate: 1, Burst: 2, Message: "slow down"})
+	install("busy.local", RateLimit{MaxConcurrent: 1})
+	handler := proxyManager.Handler(false)
+	request := func(host, path, client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = host
+		req.RemoteAddr = "10.0.0.1:4000"
+		req.Header.Set("X-Forwarded-For", client)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if res := request("rate.local", "/", "198.51.100.1"); res.Code != expected {
+			t.Errorf("request %v: expected %v, got %v", i, expected, res.Code)
+		}
+	}
+	res := request("rate.local", "/", "198.51.100.1")
+	if res.Header().Get("Retry-After") != "1" || !strings.Contains(res.Body.String(), "slow down") {
+		t.Errorf("unexpected rejection %v %q", res.Header(), res.Body.String())
+	}
+	// every client has its own bucket
+	if res := request("rate.local", "/", "198.51.100.2"); res.Code != http.StatusOK {
+		t.Errorf("expected another client to be let through, got %v", res.Code)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		request("busy.local", "/slow", "198.51.100.1")
+	}()
+	select {
+	case <-arrived:
+	case <-time.After(time.Second * 2):
+		t.Fatal("the slow request didn't arrive")
+	}
+	if res := request("busy.local", "/", "198.51.100.2"); res.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the concurrent request to be capped, got %v", res.Code)
+	}
+	close(release)
+	wg.Wait()
+	if res := request("busy.local", "/", "198.51.100.2"); res.Code != http.StatusOK {
+		t.Errorf("expected the request to go through once the slot is free, got %v", res.Code)
+	}
+}
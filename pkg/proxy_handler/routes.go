@@ -0,0 +1,325 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// DefaultHost is the origin host of the route taking the requests no other route matches.
+	DefaultHost = "*"
+	// RegexpPrefix marks origin hosts which are regular expressions, like "~pr-[0-9]+\.example\.com".
+	RegexpPrefix = "~"
+)
+
+var ErrRouteConflict = errors.New("route overlaps with a route of another owner")
+
+// routeTable holds the routes of every host, ordered from the longest prefix to the shortest.
+// The slices are shared between tables, so they're replaced instead of being modified.
+type routeTable struct {
+	hosts map[Host][]*Route
+	// wildcards holds the wildcard hosts, the most specific one first
+	wildcards []Host
+	// regexps holds the regular expression hosts, in alphabetical order
+	regexps []hostRegexp
+}
+
+type hostRegexp struct {
+	host Host
+	re   *regexp.Regexp
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{hosts: map[Host][]*Route{}}
+}
+
+func (t *routeTable) copy() *routeTable {
+	table := &routeTable{
+		hosts:     make(map[Host][]*Route, len(t.hosts)+1),
+		wildcards: t.wildcards,
+		regexps:   t.regexps,
+	}
+	for host, routes := range t.hosts {
+		table.hosts[host] = routes
+	}
+	return table
+}
+
+// lookup returns the route a request is served by. The routes of the exact host come
+// first, then the ones of the matching wildcards and regular expressions and at last
+// the default route, within a host the route with the longest matching prefix wins.
+func (t *routeTable) lookup(host Host, urlPath string) (*Route, bool) {
+	host = strings.ToLower(host)
+	if route, exists := matchPath(t.hosts[host], urlPath); exists {
+		return route, true
+	}
+	hostname := stripPort(host)
+	if hostname != host {
+		if route, exists := matchPath(t.hosts[hostname], urlPath); exists {
+			return route, true
+		}
+	}
+	for _, pattern := range t.wildcards {
+		if !matchWildcard(pattern, hostname) {
+			continue
+		}
+		if route, exists := matchPath(t.hosts[pattern], urlPath); exists {
+			return route, true
+		}
+	}
+	for _, pattern := range t.regexps {
+		if !pattern.re.MatchString(hostname) {
+			continue
+		}
+		if route, exists := matchPath(t.hosts[pattern.host], urlPath); exists {
+			return route, true
+		}
+	}
+	return matchPath(t.hosts[DefaultHost], urlPath)
+}
+
+func matchPath(routes []*Route, urlPath string) (*Route, bool) {
+	for _, route := range routes {
+		if route.matches(urlPath) {
+			return route, true
+		}
+	}
+	return nil, false
+}
+
+// serves reports whether a route is installed on exactly the host, the hosts which
+// are only matched by a pattern or the default route don't count.
+func (t *routeTable) serves(host Host) bool {
+	host = strings.ToLower(host)
+	return !isPattern(host) && len(t.hosts[host]) > 0
+}
+
+// get returns the route installed on exactly the origin.
+func (t *routeTable) get(origin *url.URL) (*Route, bool) {
+	for _, route := range t.hosts[origin.Host] {
+		if route.Origin.Path == origin.Path {
+			return route, true
+		}
+	}
+	return nil, false
+}
+
+// conflict returns a route of another owner whose wildcard overlaps with the route's
+// wildcard, the precedence between them would depend on the request. Regular expressions
+// can't be compared, their hosts belong to a single owner.
+func (t *routeTable) conflict(route *Route) *Route {
+	if route.owner == "" {
+		return nil
+	}
+	if isRegexp(route.Origin.Host) {
+		for _, pattern := range t.regexps {
+			for _, r := range t.hosts[pattern.host] {
+				if r.owner != "" && r.owner != route.owner {
+					return r
+				}
+			}
+		}
+		return nil
+	}
+	if !isWildcard(route.Origin.Host) {
+		return nil
+	}
+	for _, pattern := range t.wildcards {
+		if pattern == route.Origin.Host || !(covers(pattern, route.Origin.Host) || covers(route.Origin.Host, pattern)) {
+			continue
+		}
+		for _, r := range t.hosts[pattern] {
+			if r.owner != "" && r.owner != route.owner {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// put installs the route, replacing the one already installed on its origin.
+func (t *routeTable) put(route *Route) {
+	host := route.Origin.Host
+	routes := []*Route{route}
+	for _, r := range t.hosts[host] {
+		if r.Origin.Path != route.Origin.Path {
+			routes = append(routes, r)
+		}
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].Origin.Path) > len(routes[j].Origin.Path)
+	})
+	if _, exists := t.hosts[host]; !exists && isWildcard(host) {
+		wildcards := append(append([]Host{}, t.wildcards...), host)
+		// longer patterns are more specific, ties are broken alphabetically to stay deterministic
+		sort.Slice(wildcards, func(i, j int) bool {
+			if len(wildcards[i]) != len(wildcards[j]) {
+				return len(wildcards[i]) > len(wildcards[j])
+			}
+			return wildcards[i] < wildcards[j]
+		})
+		t.wildcards = wildcards
+	}
+	if _, exists := t.hosts[host]; !exists && isRegexp(host) {
+		// the origin was validated by parseOrigin
+		regexps := append(append([]hostRegexp{}, t.regexps...), hostRegexp{host, regexp.MustCompile(hostExpression(host))})
+		sort.Slice(regexps, func(i, j int) bool {
+			return regexps[i].host < regexps[j].host
+		})
+		t.regexps = regexps
+	}
+	t.hosts[host] = routes
+}
+
+// remove uninstalls the route of the origin.
+func (t *routeTable) remove(origin *url.URL) {
+	var routes []*Route
+	for _, r := range t.hosts[origin.Host] {
+		if r.Origin.Path != origin.Path {
+			routes = append(routes, r)
+		}
+	}
+	if len(routes) > 0 {
+		t.hosts[origin.Host] = routes
+		return
+	}
+	delete(t.hosts, origin.Host)
+	var wildcards []Host
+	for _, pattern := range t.wildcards {
+		if pattern != origin.Host {
+			wildcards = append(wildcards, pattern)
+		}
+	}
+	t.wildcards = wildcards
+	var regexps []hostRegexp
+	for _, pattern := range t.regexps {
+		if pattern.host != origin.Host {
+			regexps = append(regexps, pattern)
+		}
+	}
+	t.regexps = regexps
+}
+
+// isPattern reports whether the host matches other hosts than itself.
+func isPattern(host Host) bool {
+	return host == DefaultHost || isWildcard(host) || isRegexp(host)
+}
+
+// isWildcard reports whether the host is a pattern like "*.example.com".
+func isWildcard(host Host) bool {
+	return strings.HasPrefix(host, "*.")
+}
+
+// matchWildcard reports whether the hostname falls under the pattern, "*.example.com"
+// takes "a.example.com" and "a.b.example.com" but not "example.com".
+func matchWildcard(pattern Host, hostname string) bool {
+	suffix := pattern[1:]
+	return len(hostname) > len(suffix) && strings.HasSuffix(hostname, suffix)
+}
+
+func isRegexp(host Host) bool {
+	return strings.HasPrefix(host, RegexpPrefix)
+}
+
+// hostExpression turns a regular expression host into an expression matching whole
+// hostnames, whatever their case.
+func hostExpression(host Host) string {
+	return "(?i)^(?:" + strings.TrimPrefix(host, RegexpPrefix) + ")$"
+}
+
+// covers reports whether every host matched by the wildcard b is matched by a.
+func covers(a, b Host) bool {
+	return strings.HasSuffix(b[1:], a[1:])
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// parseOrigin splits an origin like "example.com/api" into the host and the path
+// prefix of the route, which is empty when the route takes the whole host.
+// The host can also be a wildcard like "*.example.com", a regular expression or DefaultHost.
+func parseOrigin(originAddr string) (*url.URL, error) {
+	if strings.Contains(originAddr, "://") {
+		return nil, errors.New("origin can't have a scheme")
+	}
+	host, prefix := originAddr, ""
+	if i := strings.Index(originAddr, "/"); i >= 0 {
+		host, prefix = originAddr[:i], cleanPrefix(originAddr[i:])
+	}
+	if isRegexp(host) {
+		// regular expressions keep their case, "\D" isn't "\d"
+		if _, err := regexp.Compile(hostExpression(host)); err != nil || host == RegexpPrefix {
+			return nil, fmt.Errorf("invalid origin host '%v', it isn't a regular expression", host)
+		}
+		return &url.URL{Host: host, Path: prefix}, nil
+	}
+	host = strings.ToLower(host)
+	if host == "" {
+		return nil, errors.New("origin host cannot be empty")
+	}
+	if host != DefaultHost && strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+		return nil, fmt.Errorf("invalid origin host '%v', wildcards only replace the leftmost labels", host)
+	}
+	if isWildcard(host) && strings.Trim(host[len("*."):], ".") == "" {
+		return nil, fmt.Errorf("invalid origin host '%v', wildcards need a domain to replace the labels of", host)
+	}
+	return &url.URL{Host: host, Path: prefix}, nil
+}
+
+// cleanPrefix normalizes a path prefix to "/a/b", the root becomes empty.
+func cleanPrefix(prefix string) string {
+	prefix = path.Clean("/" + prefix)
+	if prefix == "/" {
+		return ""
+	}
+	return prefix
+}
+
+// Name identifies the route by its host and path prefix.
+func (r *Route) Name() string {
+	return r.Origin.Host + r.Origin.Path
+}
+
+// matches reports whether the path falls under the route's prefix, prefixes only
+// match whole segments so "/api" doesn't take "/apiary".
+func (r *Route) matches(urlPath string) bool {
+	prefix := r.Origin.Path
+	return prefix == "" || urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/")
+}
+
+// rewritePath replaces the route's prefix in the request path with the rewrite prefix.
+func (r *Route) rewritePath(u *url.URL) {
+	u.Path = rewritePrefix(u.Path, r.Origin.Path, r.rewritePrefix)
+	if u.RawPath != "" {
+		// the escaped path only keeps its encoding when the prefix is written the same way
+		if strings.HasPrefix(u.RawPath, r.Origin.Path) {
+			u.RawPath = rewritePrefix(u.RawPath, r.Origin.Path, r.rewritePrefix)
+		} else {
+			u.RawPath = ""
+		}
+	}
+}
+
+func rewritePrefix(p, prefix, replacement string) string {
+	p = replacement + strings.TrimPrefix(p, prefix)
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHttpReverseProxyManager_PathPrefix(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprintf(w, "%v %v %v", name, r.URL.Path, r.Header.Get("X-Forwarded-Prefix"))
+		}))
+	}
+	client, api, admin := newUpstream("client"), newUpstream("api"), newUpstream("admin")
+	defer client.Close()
+	defer api.Close()
+	defer admin.Close()
+
+	proxyManager := NewHttpReverseProxyManager()
+	install := func(origin string, target string, options *RouteOptions) {
+		backend, err := NewBackend(target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		options.Backends = []*Backend{backend}
+		if err := proxyManager.InstallRouteWithOptions(origin, options); err != nil {
+			t.Fatal(err)
+		}
+	}
+	install("chat.local", client.URL, &RouteOptions{})
+	install("chat.local/api/", api.URL, &RouteOptions{StripPrefix: true})
+	install("chat.local/api/admin", admin.URL, &RouteOptions{RewritePrefix: "/v2"})
+	if err := proxyManager.InstallRoute("chat.local/api", client.URL); err == nil {
+		t.Error("origins should be compared after being normalized")
+	}
+
+	handler := proxyManager.Handler(false)
+	for path, expected := range map[string]string{
+		"/":                  "client / ",
+		"/apiary":            "client /apiary ",
+		"/api":               "api / /api",
+		"/api/users?id=1":    "api /users /api",
+		"/api/admin/reports": "admin /v2/reports /api/admin",
+	} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = "chat.local"
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		if body, _ := ioutil.ReadAll(res.Body); string(body) != expected {
+			t.Errorf("expected %v to reach %q, got %q", path, expected, body)
+		}
+	}
+
+	// the remaining routes of the host keep working
+	if err := proxyManager.UninstallRoute("chat.local/api"); err != nil {
+		t.Fatal(err)
+	}
+	if route, _ := proxyManager.getRoute("chat.local", "/api/users"); route.Name() != "chat.local" {
+		t.Errorf("expected the host route to take over, got %v", route.Name())
+	}
+	if route, _ := proxyManager.getRoute("chat.local", "/api/admin"); route.Name() != "chat.local/api/admin" {
+		t.Errorf("expected the admin route to be kept, got %v", route.Name())
+	}
+}
+
+func TestHttpReverseProxyManager_WildcardHosts(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	proxyManager := NewHttpReverseProxyManager()
+	install := func(origin, owner string) error {
+		backend, err := NewBackend(upstream.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proxyManager.InstallRouteWithOptions(origin, &RouteOptions{Backends: []*Backend{backend}, Owner: owner})
+	}
+	for _, origin := range []string{"*", "*.example.com", "*.preview.example.com", "app.preview.example.com", "*.preview.example.com/api"} {
+		if err := install(origin, "site"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := install("*.other.com", "blog"); err != nil {
+		t.Fatal(err)
+	}
+	if err := install(`~pr-\d+\.example\.net`, "review"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct{ host, path, route string }{
+		{"app.preview.example.com", "/api", "app.preview.example.com"},
+		{"APP.preview.example.com:8080", "/", "app.preview.example.com"},
+		{"pr-1.preview.example.com", "/", "*.preview.example.com"},
+		{"pr-1.preview.example.com", "/api/users", "*.preview.example.com/api"},
+		{"a.b.preview.example.com", "/", "*.preview.example.com"},
+		{"preview.example.com", "/", "*.example.com"},
+		{"PR-12.example.net", "/", `~pr-\d+\.example\.net`},
+		{"pr-12.example.net.evil.com", "/", "*"},
+		{"example.com", "/", "*"},
+		{"unknown.local", "/", "*"},
+	} {
+		route, exists := proxyManager.getRoute(test.host, test.path)
+		if !exists || route.Name() != test.route {
+			t.Errorf("expected %v%v to be served by %v, got %v", test.host, test.path, test.route, route)
+		}
+	}
+
+	// wildcards of other owners can't overlap, exact hosts always take precedence so they can
+	for _, origin := range []string{"*.example.com/blog", "*.pr-1.preview.example.com", "*.com"} {
+		if err := install(origin, "blog"); !errors.Is(err, ErrRouteConflict) {
+			t.Errorf("expected %v to conflict, got %v", origin, err)
+		}
+	}
+	if err := install("blog.example.com", "blog"); err != nil {
+		t.Error(err)
+	}
+	if err := install("*.example.org", "blog"); err != nil {
+		t.Error(err)
+	}
+	// regular expression hosts can't be compared, they're limited to a single owner
+	if err := install(`~.*`, "blog"); !errors.Is(err, ErrRouteConflict) {
+		t.Errorf("expected a regular expression of another owner to conflict, got %v", err)
+	}
+	if err := install(`~preview-\d+\.example\.net`, "review"); err != nil {
+		t.Error(err)
+	}
+
+	// certificates are only requested for hosts with an exact route
+	if !proxyManager.hasHost("app.preview.example.com") {
+		t.Error("expected exact hosts to get certificates")
+	}
+	for _, host := range []string{"pr-2.preview.example.com", "pr-2.example.net", "unknown.local", "*.example.com"} {
+		if proxyManager.hasHost(host) {
+			t.Errorf("%v shouldn't get certificates", host)
+		}
+	}
+	if _, err := parseOrigin("app.*.example.com"); err == nil {
+		t.Error("wildcards in the middle of a host should be rejected")
+	}
+	for _, origin := range []string{"~", "~pr-(", "*.", "*.."} {
+		if _, err := parseOrigin(origin); err == nil {
+			t.Errorf("expected %q to be rejected", origin)
+		}
+	}
+
+	// the regular expression is removed along with its last route
+	if err := proxyManager.UninstallRoute(`~pr-\d+\.example\.net`); err != nil {
+		t.Fatal(err)
+	}
+	if route, _ := proxyManager.getRoute("pr-12.example.net", "/"); route.Name() != "*" {
+		t.Errorf("expected the default route to take over, got %v", route.Name())
+	}
+}
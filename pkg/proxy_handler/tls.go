@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"net"
+	"net/http"
+)
+
+// ACMEConfig holds the parameters used to obtain certificates for the installed routes.
+type ACMEConfig struct {
+	// CacheDir is where the account key and the issued certificates are persisted.
+	CacheDir string
+	// Email is used by the CA to notify about problems with the issued certificates.
+	Email string
+	// DirectoryURL is the ACME directory endpoint, defaults to Let's Encrypt.
+	DirectoryURL string
+	// HTTPClient is used to talk to the CA, mostly useful for pointing at a test CA.
+	HTTPClient *http.Client
+}
+
+// EnableACME enables automatic certificate management for every installed route.
+// It has to be called before Launch, since the HTTP-01 challenges are answered by the
+// plain HTTP listener.
+func (m *HttpReverseProxyManager) EnableACME(config *ACMEConfig) error {
+	if config == nil {
+		return errors.New("config cannot be nil")
+	}
+	if config.CacheDir == "" {
+		return errors.New("certificate cache directory cannot be empty")
+	}
+
+	directory := config.DirectoryURL
+	if directory == "" {
+		directory = autocert.DefaultACMEDirectory
+	}
+
+	m.certManager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(config.CacheDir),
+		HostPolicy: m.hostPolicy,
+		Email:      config.Email,
+		Client: &acme.Client{
+			DirectoryURL: directory,
+			HTTPClient:   config.HTTPClient,
+		},
+	}
+	return nil
+}
+
+// hostPolicy only allows certificates to be requested for the exact hosts of installed
+// routes. Hosts only taken by a wildcard, a regular expression or the default route
+// aren't, anyone could make up names under them and burn the rate limits of the CA.
+func (m *HttpReverseProxyManager) hostPolicy(_ context.Context, host string) error {
+	if !m.hasHost(host) {
+		return fmt.Errorf("'%v' isn't installed", host)
+	}
+	return nil
+}
+
+// httpsURL builds the address a plain HTTP request gets redirected to.
+func (m *HttpReverseProxyManager) httpsURL(req *http.Request) string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(m.tlsAddr.Load().(string)); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	return "https://" + host + req.URL.RequestURI()
+}
+
+// LaunchTLS exposes the installed routes over HTTPS, certificates are obtained and
+// renewed on demand through ACME. EnableACME has to be called beforehand.
+func (m *HttpReverseProxyManager) LaunchTLS(addr string) chan error {
+	errChan := make(chan error, 1)
+	if m.certManager == nil {
+		errChan <- errors.New("ACME hasn't been enabled")
+		return errChan
+	}
+	m.tlsAddr.Store(addr)
+
+	srv := m.newServer(addr, m.Handler(true))
+	srv.TLSConfig = m.certManager.TLSConfig()
+	go func(srv *http.Server) {
+		err := srv.ListenAndServeTLS("", "")
+		if err != nil {
+			errChan <- err
+		}
+	}(srv)
+
+	go func(srv *http.Server) {
+		<-m.stop
+		log.Debug().Msg("stopping tls server")
+		err := srv.Shutdown(context.Background())
+		if err != nil {
+			errChan <- err
+		}
+	}(srv)
+
+	return errChan
+}
@@ -0,0 +1,360 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/phayes/freeport"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeACME is a minimal RFC 8555 directory in the spirit of Pebble. It skips
+// JWS verification but validates HTTP-01 challenges against the proxy.
+type fakeACME struct {
+	sync.Mutex
+	url      string
+	httpAddr string
+	caKey    *ecdsa.PrivateKey
+	caCert   *x509.Certificate
+	orders   map[string]*fakeOrder
+	nonce    int
+}
+
+type fakeOrder struct {
+	id     string
+	domain string
+	token  string
+	authz  string
+	cert   []byte
+}
+
+func newFakeACME(t *testing.T) *fakeACME {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake acme root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeACME{caKey: key, caCert: cert, orders: map[string]*fakeOrder{}}
+}
+
+func (f *fakeACME) payload(t *testing.T, req *http.Request, v interface{}) {
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&jws); err != nil {
+		t.Error(err)
+		return
+	}
+	b, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if v != nil && len(b) != 0 {
+		if err := json.Unmarshal(b, v); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func (f *fakeACME) orderJSON(o *fakeOrder) map[string]interface{} {
+	status := "pending"
+	if o.authz == "valid" {
+		status = "ready"
+	}
+	if o.cert != nil {
+		status = "valid"
+	}
+	return map[string]interface{}{
+		"status":         status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": o.domain}},
+		"authorizations": []string{f.url + "/authz/" + o.id},
+		"finalize":       f.url + "/finalize/" + o.id,
+		"certificate":    f.url + "/cert/" + o.id,
+	}
+}
+
+func (f *fakeACME) handler(t *testing.T) http.Handler {
+	mux := http.NewServeMux()
+	writeJSON := func(w http.ResponseWriter, code int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(v)
+	}
+
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 200, map[string]string{
+			"newNonce":   f.url + "/nonce",
+			"newAccount": f.url + "/account",
+			"newOrder":   f.url + "/order",
+			"revokeCert": f.url + "/revoke",
+			"keyChange":  f.url + "/key-change",
+		})
+	})
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		f.payload(t, r, nil)
+		w.Header().Set("Location", f.url+"/account/1")
+		writeJSON(w, http.StatusCreated, map[string]string{"status": "valid"})
+	})
+	mux.HandleFunc("/order", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Identifiers []struct{ Value string }
+		}
+		f.payload(t, r, &req)
+		f.Lock()
+		defer f.Unlock()
+		id := fmt.Sprint(len(f.orders) + 1)
+		o := &fakeOrder{id: id, domain: req.Identifiers[0].Value, token: "token-" + id, authz: "pending"}
+		f.orders[id] = o
+		w.Header().Set("Location", f.url+"/order/"+id)
+		writeJSON(w, http.StatusCreated, f.orderJSON(o))
+	})
+	mux.HandleFunc("/order/", func(w http.ResponseWriter, r *http.Request) {
+		f.payload(t, r, nil)
+		f.Lock()
+		defer f.Unlock()
+		o := f.orders[strings.TrimPrefix(r.URL.Path, "/order/")]
+		writeJSON(w, 200, f.orderJSON(o))
+	})
+	mux.HandleFunc("/authz/", func(w http.ResponseWriter, r *http.Request) {
+		f.payload(t, r, nil)
+		f.Lock()
+		defer f.Unlock()
+		o := f.orders[strings.TrimPrefix(r.URL.Path, "/authz/")]
+		writeJSON(w, 200, map[string]interface{}{
+			"status":     o.authz,
+			"identifier": map[string]string{"type": "dns", "value": o.domain},
+			"challenges": []map[string]string{{
+				"type":   "http-01",
+				"url":    f.url + "/chal/" + o.id,
+				"token":  o.token,
+				"status": o.authz,
+			}},
+		})
+	})
+	mux.HandleFunc("/chal/", func(w http.ResponseWriter, r *http.Request) {
+		f.payload(t, r, nil)
+		f.Lock()
+		o := f.orders[strings.TrimPrefix(r.URL.Path, "/chal/")]
+		f.Unlock()
+
+		// validate the challenge the same way a real CA would, through port 80 of the domain
+		req, _ := http.NewRequest("GET", "http://"+f.httpAddr+"/.well-known/acme-challenge/"+o.token, nil)
+		req.Host = o.domain
+		status := "invalid"
+		res, err := http.DefaultClient.Do(req)
+		if err == nil {
+			body, _ := ioutil.ReadAll(res.Body)
+			_ = res.Body.Close()
+			if res.StatusCode == 200 && strings.HasPrefix(string(body), o.token+".") {
+				status = "valid"
+			}
+		}
+
+		f.Lock()
+		o.authz = status
+		f.Unlock()
+		writeJSON(w, 200, map[string]string{"type": "http-01", "url": f.url + r.URL.Path, "token": o.token, "status": status})
+	})
+	mux.HandleFunc("/finalize/", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		f.payload(t, r, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour * 24 * 90),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		cert, err := x509.CreateCertificate(rand.Reader, template, f.caCert, csr.PublicKey, f.caKey)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		f.Lock()
+		defer f.Unlock()
+		o := f.orders[strings.TrimPrefix(r.URL.Path, "/finalize/")]
+		o.cert = cert
+		w.Header().Set("Location", f.url+"/order/"+o.id)
+		writeJSON(w, 200, f.orderJSON(o))
+	})
+	mux.HandleFunc("/cert/", func(w http.ResponseWriter, r *http.Request) {
+		f.payload(t, r, nil)
+		f.Lock()
+		defer f.Unlock()
+		o := f.orders[strings.TrimPrefix(r.URL.Path, "/cert/")]
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: o.cert})
+		_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.Lock()
+		f.nonce++
+		w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%v", f.nonce))
+		f.Unlock()
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func waitForListener(t *testing.T, addr string) {
+	for tries := 0; tries < 50; tries++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			_ = conn.Close()
+			return
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	t.Fatalf("%v never started listening", addr)
+}
+
+func TestHttpReverseProxyManager_LaunchTLS(t *testing.T) {
+	const host = "secure.kerfuffle.test"
+
+	ca := newFakeACME(t)
+	caServer := httptest.NewTLSServer(ca.handler(t))
+	defer caServer.Close()
+	ca.url = caServer.URL
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "%v %v", r.Header.Get("X-Forwarded-Proto"), r.URL.Path)
+	}))
+	defer backend.Close()
+
+	ports, err := freeport.GetFreePorts(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpAddr := fmt.Sprintf("127.0.0.1:%v", ports[0])
+	tlsAddr := fmt.Sprintf("127.0.0.1:%v", ports[1])
+	ca.httpAddr = httpAddr
+
+	cacheDir := t.TempDir()
+	proxyManager := NewHttpReverseProxyManager()
+	if err := proxyManager.InstallRoute(host, backend.URL); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxyManager.SetRedirectHTTPS(host, true); err != nil {
+		t.Fatal(err)
+	}
+	err = proxyManager.EnableACME(&ACMEConfig{
+		CacheDir:     cacheDir,
+		DirectoryURL: caServer.URL + "/directory",
+		HTTPClient:   caServer.Client(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyManager.Launch(httpAddr)
+	proxyManager.LaunchTLS(tlsAddr)
+	defer proxyManager.Stop()
+	waitForListener(t, httpAddr)
+	waitForListener(t, tlsAddr)
+
+	t.Run("redirects plain http", func(t *testing.T) {
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+		req, _ := http.NewRequest("GET", "http://"+httpAddr+"/path?q=1", nil)
+		req.Host = host
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+		expect := fmt.Sprintf("https://%v:%v/path?q=1", host, ports[1])
+		if res.StatusCode != http.StatusPermanentRedirect || res.Header.Get("Location") != expect {
+			t.Errorf("got %v '%v', expected redirect to '%v'", res.StatusCode, res.Header.Get("Location"), expect)
+		}
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.caCert)
+	dial := func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, tlsAddr)
+	}
+
+	t.Run("serves with issued certificate", func(t *testing.T) {
+		client := &http.Client{Timeout: time.Second * 30, Transport: &http.Transport{
+			DialContext:     dial,
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}}
+		res, err := client.Get("https://" + host + "/hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if string(body) != "https /hello" {
+			t.Errorf("unexpected body '%v'", string(body))
+		}
+
+		if _, err := ioutil.ReadFile(filepath.Join(cacheDir, host)); err != nil {
+			t.Errorf("certificate wasn't persisted: %v", err)
+		}
+	})
+
+	t.Run("refuses unknown hosts", func(t *testing.T) {
+		client := &http.Client{Timeout: time.Second * 10, Transport: &http.Transport{
+			DialContext:     dial,
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}}
+		res, err := client.Get("https://unknown.kerfuffle.test/")
+		if err == nil {
+			_ = res.Body.Close()
+			t.Error("expected the handshake to fail")
+		}
+	})
+}
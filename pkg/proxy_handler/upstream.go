@@ -0,0 +1,211 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+)
+
+// Why a backend couldn't answer a request.
+const (
+	// FailureCrashed means the process behind the backend isn't running
+	FailureCrashed = "crashed"
+	// FailureRefused means the backend's port is closed, e.g. the process hasn't bound it yet
+	FailureRefused = "refused"
+	FailureTimeout = "timeout"
+	// FailureReset means the backend dropped the connection before answering
+	FailureReset = "reset"
+	FailureError = "error"
+)
+
+// maxUpstreamRetries bounds how many other backends a failed request is sent to.
+const maxUpstreamRetries = 2
+
+var (
+	//go:embed assets/html/compiled_error.html
+	siteError string
+	// errorPage is shown when a backend fails and the route has no bad gateway page of its own
+	errorPage = template.Must(template.New("error").Parse(siteError))
+
+	errNoBackend = errors.New("no live backend")
+)
+
+var failureReasons = map[string]string{
+	FailureCrashed: "The application isn't running",
+	FailureRefused: "The application isn't accepting connections",
+	FailureTimeout: "The application took too long to respond",
+	FailureReset:   "The application dropped the connection",
+	FailureError:   "The application couldn't be reached",
+}
+
+// UpstreamError describes a request the backends of a route failed to answer.
+type UpstreamError struct {
+	Route string
+	// Backend is nil when the route had no live backend
+	Backend *Backend
+	Kind    string
+	Status  int
+	// Retried is set when the request was sent on to another backend
+	Retried bool
+	Err     error
+}
+
+func (e *UpstreamError) Error() string {
+	return e.Kind + ": " + e.Err.Error()
+}
+
+// classifyFailure tells why the backend couldn't answer, a backend whose process
+// isn't running has crashed whatever the error is.
+func classifyFailure(backend *Backend, err error) string {
+	var netErr net.Error
+	switch {
+	case !backend.IsAlive():
+		return FailureCrashed
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout():
+		return FailureTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return FailureRefused
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return FailureReset
+	}
+	return FailureError
+}
+
+// retryable reports whether the request can safely be sent to another backend,
+// only idempotent requests without a body are.
+func retryable(req *http.Request) bool {
+	if req.ContentLength != 0 {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// otherAlive counts the backends besides the given one which are alive.
+func otherAlive(backends []*Backend, backend *Backend) int {
+	alive := 0
+	for _, b := range backends {
+		if b != backend && b.IsAlive() {
+			alive++
+		}
+	}
+	return alive
+}
+
+func without(backends []*Backend, backend *Backend) []*Backend {
+	var remaining []*Backend
+	for _, b := range backends {
+		if b != backend {
+			remaining = append(remaining, b)
+		}
+	}
+	return remaining
+}
+
+// fail handles a request the backend couldn't answer. Failures of the backend are
+// reported to the route, and the request is either left to serve to retry on another
+// backend or answered with the error page.
+func (r *routedRequest) fail(res http.ResponseWriter, req *http.Request, backend *Backend, err error) {
+	status := errorStatus(req, err)
+	if status != http.StatusBadGateway && status != http.StatusGatewayTimeout ||
+		status == http.StatusBadGateway && errors.Is(req.Context().Err(), context.Canceled) {
+		// the client went away or broke the limits of the route, the backend isn't to blame
+		log.Debug().Err(err).Str("target", backend.Target.Host).Int("status", status).Msg("request abandoned")
+		res.WriteHeader(status)
+		return
+	}
+
+	failure := &UpstreamError{Route: r.route.Name(), Backend: backend, Kind: classifyFailure(backend, err), Status: status, Err: err}
+	failure.Retried = r.retries > 0 && failure.Kind != FailureTimeout && retryable(req)
+	r.failure = failure
+	r.route.report(failure)
+	if !failure.Retried {
+		r.route.writeError(res, req, status, failureReasons[failure.Kind])
+	}
+}
+
+// report logs the failure and passes it on to whoever installed the route.
+func (r *Route) report(failure *UpstreamError) {
+	target := ""
+	if failure.Backend != nil {
+		target = failure.Backend.Target.Host
+	}
+	log.Err(failure.Err).
+		Str("route", failure.Route).
+		Str("target", target).
+		Str("kind", failure.Kind).
+		Int("status", failure.Status).
+		Bool("retried", failure.Retried).
+		Msg("failed to proxy request")
+	if r.onError != nil {
+		r.onError(failure)
+	}
+}
+
+// forward sends the request to the backends until one answers it, idempotent requests
+// are retried on other backends when theirs couldn't be reached.
+func (r *Route) forward(res http.ResponseWriter, req *http.Request, secure bool) *Backend {
+	routed := routeOf(req)
+	backends := r.Backends()
+	var backend *Backend
+	for attempt := 0; ; attempt++ {
+		next := r.Balancer.Next(req, backends)
+		if next == nil {
+			break
+		}
+		backend = next
+		routed.failure = nil
+		routed.retries = otherAlive(backends, backend)
+		if routed.retries > maxUpstreamRetries-attempt {
+			routed.retries = maxUpstreamRetries - attempt
+		}
+
+		log.Debug().
+			Str("method", req.Method).
+			Str("origin", req.Header.Get("X-Forwarded-Host")).
+			Str("target", backend.Target.String()).
+			Str("path", req.URL.String()).
+			Bool("secure", secure).
+			Int("attempt", attempt).
+			Msg("proxy")
+		req.URL.Host = backend.Target.Host
+		req.URL.Scheme = backend.Target.Scheme
+		req.Host = backend.Target.Host
+		backend.serve(res, req)
+		if routed.failure == nil || !routed.failure.Retried {
+			return backend
+		}
+		backends = without(backends, backend)
+	}
+
+	if routed.failure != nil {
+		// the backends left died while the request was being retried
+		r.writeError(res, req, routed.failure.Status, failureReasons[routed.failure.Kind])
+		return backend
+	}
+	r.report(&UpstreamError{Route: r.Name(), Kind: FailureCrashed, Status: http.StatusBadGateway, Err: errNoBackend})
+	r.writeError(res, req, http.StatusBadGateway, failureReasons[FailureCrashed])
+	return nil
+}
+
+func (b *Backend) serve(res http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&b.active, 1)
+	defer atomic.AddInt64(&b.active, -1)
+	b.Proxy.ServeHTTP(res, req)
+}
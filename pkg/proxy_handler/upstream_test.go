@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package proxy_handler
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// firstAlive always picks the first live backend, so tests know which one fails.
+type firstAlive struct{}
+
+func (firstAlive) Next(_ *http.Request, backends []*Backend) *Backend {
+	for _, backend := range backends {
+		if backend.IsAlive() {
+			return backend
+		}
+	}
+	return nil
+}
+
+func TestHttpReverseProxyManager_UpstreamErrors(t *testing.T) {
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(time.Millisecond * 500)
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer live.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	var (
+		mu       sync.Mutex
+		failures []*UpstreamError
+	)
+	proxyManager := NewHttpReverseProxyManager()
+	backend := func(target string) *Backend {
+		b, err := NewBackend(target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	refused, answering := backend(closed.URL), backend(live.URL)
+	err := proxyManager.InstallRouteWithOptions("app.local", &RouteOptions{
+		Backends: []*Backend{refused, answering},
+		Balancer: firstAlive{},
+		Limits:   RouteLimits{WriteTimeout: time.Millisecond * 100},
+		OnError: func(failure *UpstreamError) {
+			mu.Lock()
+			defer mu.Unlock()
+			failures = append(failures, failure)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reported := func() []*UpstreamError {
+		mu.Lock()
+		defer mu.Unlock()
+		reported := failures
+		failures = nil
+		return reported
+	}
+
+	handler := proxyManager.Handler(false)
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://app.local"+path, strings.NewReader(body))
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	// idempotent requests are retried on the next replica
+	if res := request("GET", "/", ""); res.Code != http.StatusOK || res.Body.String() != "ok" {
+		t.Errorf("expected the request to be retried, got %v %q", res.Code, res.Body.String())
+	}
+	if got := reported(); len(got) != 1 || got[0].Kind != FailureRefused || !got[0].Retried || got[0].Backend != refused {
+		t.Errorf("expected a retried refused connection, got %+v", got)
+	}
+
+	// requests with a body aren't
+	res := request("POST", "/", "payload")
+	if res.Code != http.StatusBadGateway || !strings.Contains(res.Body.String(), template.HTMLEscapeString(failureReasons[FailureRefused])) {
+		t.Errorf("expected the error page, got %v", res.Code)
+	}
+	if got := reported(); len(got) != 1 || got[0].Retried {
+		t.Errorf("expected a failure which wasn't retried, got %+v", got)
+	}
+
+	refused.Alive = func() bool { return false }
+	res = request("GET", "/slow", "")
+	if res.Code != http.StatusGatewayTimeout || !strings.Contains(res.Body.String(), template.HTMLEscapeString(failureReasons[FailureTimeout])) {
+		t.Errorf("expected a timeout, got %v", res.Code)
+	}
+	if got := reported(); len(got) != 1 || got[0].Kind != FailureTimeout || got[0].Retried {
+		t.Errorf("expected a timeout which wasn't retried, got %+v", got)
+	}
+
+	answering.Alive = func() bool { return false }
+	res = request("GET", "/", "")
+	if res.Code != http.StatusBadGateway || !strings.Contains(res.Body.String(), template.HTMLEscapeString(failureReasons[FailureCrashed])) {
+		t.Errorf("expected the error page when every replica is down, got %v", res.Code)
+	}
+	if got := reported(); len(got) != 1 || got[0].Kind != FailureCrashed || got[0].Backend != nil {
+		t.Errorf("expected the route to be reported as down, got %+v", got)
+	}
+
+	// a process which died after it was picked has crashed, whatever the error
+	if kind := classifyFailure(refused, errors.New("connection reset by peer")); kind != FailureCrashed {
+		t.Errorf("expected a crash, got %v", kind)
+	}
+}
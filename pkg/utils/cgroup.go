@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrCgroupsUnsupported = errors.New("cgroups v2 aren't available on this platform")
+)
+
+// CgroupLimits are the resource limits of a cgroup, zero values are left unlimited.
+type CgroupLimits struct {
+	MemoryMax int64
+	CPUWeight int
+	PidsMax   int
+	IOWeight  int
+}
+
+func (l *CgroupLimits) Empty() bool {
+	return l == nil || *l == CgroupLimits{}
+}
+
+// controllers returns the cgroup controllers needed to apply the limits, memory is
+// always enabled so out of memory kills can be detected.
+func (l *CgroupLimits) controllers() []string {
+	controllers := []string{"memory"}
+	if l.CPUWeight > 0 {
+		controllers = append(controllers, "cpu")
+	}
+	if l.PidsMax > 0 {
+		controllers = append(controllers, "pids")
+	}
+	if l.IOWeight > 0 {
+		controllers = append(controllers, "io")
+	}
+	return controllers
+}
+
+var sizeUnits = map[string]int64{
+	"":   1,
+	"B":  1,
+	"K":  1 << 10,
+	"KB": 1 << 10,
+	"M":  1 << 20,
+	"MB": 1 << 20,
+	"G":  1 << 30,
+	"GB": 1 << 30,
+	"T":  1 << 40,
+	"TB": 1 << 40,
+}
+
+// ParseSize parses sizes like "512M", "1.5GB" or "1024" into bytes, units are powers of 1024.
+func ParseSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	unit := strings.TrimLeft(size, "0123456789.")
+	// KiB and KB are the same thing here
+	multiplier, exists := sizeUnits[strings.Replace(strings.TrimSpace(unit), "IB", "B", 1)]
+	if !exists {
+		return 0, fmt.Errorf("unknown unit '%v' in size '%v'", unit, size)
+	}
+	value, err := strconv.ParseFloat(strings.TrimSuffix(size, unit), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size '%v'", size)
+	}
+	return int64(value * float64(multiplier)), nil
+}
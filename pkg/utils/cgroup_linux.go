@@ -0,0 +1,146 @@
+// +build linux
+
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Cgroup is a cgroup v2 directory the processes of a provision are placed in.
+type Cgroup struct {
+	Path string
+	// mount is where the cgroup2 filesystem is mounted, the cgroup is removed up to it
+	mount string
+	root  string
+}
+
+// cgroupMount finds where the cgroup2 filesystem is mounted, which is /sys/fs/cgroup
+// on most distributions and /sys/fs/cgroup/unified on hybrid setups.
+func cgroupMount() (string, error) {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 2 && fields[2] == "cgroup2" {
+			return fields[1], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", ErrCgroupsUnsupported
+}
+
+// NewCgroup creates the cgroup root/name with the limits applied, an empty root
+// defaults to a kerfuffle cgroup at the top of the hierarchy. The controllers are
+// enabled in every cgroup between the mount and the new one, so none of those can
+// contain processes themselves.
+func NewCgroup(root string, name string, limits *CgroupLimits) (*Cgroup, error) {
+	mount, err := cgroupMount()
+	if err != nil {
+		return nil, err
+	}
+	if root == "" {
+		root = filepath.Join(mount, "kerfuffle")
+	}
+	root = filepath.Clean(root)
+	if !strings.HasPrefix(root, mount+string(filepath.Separator)) {
+		return nil, fmt.Errorf("cgroup root '%v' isn't within the cgroup2 mount '%v'", root, mount)
+	}
+
+	cgroup := &Cgroup{Path: filepath.Join(root, name), mount: mount, root: root}
+	if err := os.MkdirAll(cgroup.Path, 0755); err != nil {
+		return nil, err
+	}
+
+	var parents []string
+	for dir := filepath.Dir(cgroup.Path); dir != filepath.Dir(mount); dir = filepath.Dir(dir) {
+		parents = append([]string{dir}, parents...)
+	}
+	for _, parent := range parents {
+		for _, controller := range limits.controllers() {
+			if err := writeCgroupFile(parent, "cgroup.subtree_control", "+"+controller); err != nil {
+				_ = cgroup.Remove()
+				return nil, fmt.Errorf("can't enable the %v controller in '%v': %w", controller, parent, err)
+			}
+		}
+	}
+
+	settings := map[string]string{}
+	if limits.MemoryMax > 0 {
+		settings["memory.max"] = strconv.FormatInt(limits.MemoryMax, 10)
+		// the whole provision goes down instead of whichever process the kernel picks
+		settings["memory.oom.group"] = "1"
+	}
+	if limits.CPUWeight > 0 {
+		settings["cpu.weight"] = strconv.Itoa(limits.CPUWeight)
+	}
+	if limits.PidsMax > 0 {
+		settings["pids.max"] = strconv.Itoa(limits.PidsMax)
+	}
+	if limits.IOWeight > 0 {
+		settings["io.weight"] = fmt.Sprintf("default %v", limits.IOWeight)
+	}
+	for file, value := range settings {
+		if err := writeCgroupFile(cgroup.Path, file, value); err != nil {
+			_ = cgroup.Remove()
+			return nil, fmt.Errorf("can't set %v: %w", file, err)
+		}
+	}
+	return cgroup, nil
+}
+
+func writeCgroupFile(dir string, file string, value string) error {
+	return ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644)
+}
+
+// Add moves the process into the cgroup, its future children follow it.
+func (c *Cgroup) Add(pid int) error {
+	return writeCgroupFile(c.Path, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// OOMKills returns the amount of processes the OOM killer killed within the cgroup.
+func (c *Cgroup) OOMKills() (int, error) {
+	events, err := ioutil.ReadFile(filepath.Join(c.Path, "memory.events"))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(events), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return strconv.Atoi(fields[1])
+		}
+	}
+	return 0, nil
+}
+
+// Remove deletes the cgroup along with the parents it leaves empty, which only
+// works once every process in it has exited.
+func (c *Cgroup) Remove() error {
+	err := os.Remove(c.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for dir := filepath.Dir(c.Path); dir != c.root && strings.HasPrefix(dir, c.root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
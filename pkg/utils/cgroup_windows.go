@@ -0,0 +1,30 @@
+// +build windows
+
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package utils
+
+// Cgroup only exists on linux, resource limits can't be applied on windows.
+type Cgroup struct {
+	Path string
+}
+
+func NewCgroup(root string, name string, limits *CgroupLimits) (*Cgroup, error) {
+	return nil, ErrCgroupsUnsupported
+}
+
+func (c *Cgroup) Add(pid int) error {
+	return ErrCgroupsUnsupported
+}
+
+func (c *Cgroup) OOMKills() (int, error) {
+	return 0, ErrCgroupsUnsupported
+}
+
+func (c *Cgroup) Remove() error {
+	return nil
+}
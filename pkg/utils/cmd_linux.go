@@ -9,16 +9,42 @@
 package utils
 
 import (
+	"os"
 	"os/exec"
 	"syscall"
 )
 
+var signalNames = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
 func AttachSysProcAttr(cmd *exec.Cmd) {
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true,
 	}
 }
 
-func KillProcess(cmd *exec.Cmd) {
+// SignalProcessGroup sends the signal to the process group of the command, which
+// AttachSysProcAttr made the command the leader of. A group that's already gone isn't an error.
+func SignalProcessGroup(cmd *exec.Cmd, signal os.Signal) error {
+	sig, ok := signal.(syscall.Signal)
+	if !ok {
+		return ErrUnsupportedSignal
+	}
+	err := syscall.Kill(-cmd.Process.Pid, sig)
+	if err == syscall.ESRCH {
+		return nil
+	}
+	return err
+}
 
+// KillProcess kills the command along with everything else in its process group.
+func KillProcess(cmd *exec.Cmd) error {
+	return SignalProcessGroup(cmd, syscall.SIGKILL)
 }
@@ -9,12 +9,34 @@
 package utils
 
 import (
+	"github.com/shirou/gopsutil/process"
+	"os"
 	"os/exec"
 	"syscall"
 )
 
+var signalNames = map[string]syscall.Signal{
+	"SIGINT":  syscall.SIGINT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGTERM": syscall.SIGTERM,
+}
+
 func AttachSysProcAttr(cmd *exec.Cmd) {
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
 	}
 }
+
+// SignalProcessGroup can't deliver signals on windows, the caller has to fall back to KillProcess.
+func SignalProcessGroup(cmd *exec.Cmd, signal os.Signal) error {
+	return ErrUnsupportedSignal
+}
+
+// KillProcess terminates the command and all of its descendants.
+func KillProcess(cmd *exec.Cmd) error {
+	proc, err := process.NewProcess(int32(cmd.Process.Pid))
+	if err != nil {
+		return err
+	}
+	return KillAllFamilyTree(proc)
+}
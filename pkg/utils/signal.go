@@ -0,0 +1,31 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	ErrUnsupportedSignal = errors.New("signal isn't supported on this platform")
+)
+
+// ParseSignal looks up a signal by its name, with or without the SIG prefix.
+func ParseSignal(name string) (os.Signal, error) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	signal, exists := signalNames[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown signal '%v'", name)
+	}
+	return signal, nil
+}
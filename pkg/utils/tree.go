@@ -0,0 +1,48 @@
+/*
+ * Copyright (c) 2021 @nokusukun.
+ * This file is part of Kerfuffle which is released under Apache.
+ * See file LICENSE or go to https://github.com/nokusukun/kerfuffle/blob/master/LICENSE for full license details.
+ */
+
+package utils
+
+import (
+	"github.com/shirou/gopsutil/process"
+)
+
+// ProcessChildren maps every running process to the processes it spawned. It's
+// built from a single scan since asking for the children of each process is slow.
+func ProcessChildren() (map[int32][]int32, error) {
+	pids, err := process.Pids()
+	if err != nil {
+		return nil, err
+	}
+	children := map[int32][]int32{}
+	for _, pid := range pids {
+		proc, err := process.NewProcess(pid)
+		if err != nil {
+			// exited in the meantime
+			continue
+		}
+		ppid, err := proc.Ppid()
+		if err != nil {
+			continue
+		}
+		children[ppid] = append(children[ppid], pid)
+	}
+	return children, nil
+}
+
+// Descendants returns every process below pid.
+func Descendants(children map[int32][]int32, pid int32) []int32 {
+	var descendants []int32
+	for _, child := range children[pid] {
+		// pid 0 is its own parent on some platforms
+		if child == pid {
+			continue
+		}
+		descendants = append(descendants, child)
+		descendants = append(descendants, Descendants(children, child)...)
+	}
+	return descendants
+}